@@ -20,6 +20,9 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"regexp"
+	"strings"
+	"time"
 
 	// nolint[lll]
 	guuid "github.com/google/uuid"
@@ -43,6 +46,15 @@ var TimestampUtcRfc3339 string
 func main() {
 	klog.InitFlags(nil)
 
+	// "cip diff [flags]" compares registries, and has flags of its own.
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		runDiff(os.Args[2:])
+	}
+	// "cip retain [flags]" deletes old digests from a (staging) registry.
+	if len(os.Args) > 1 && os.Args[1] == "retain" {
+		runRetain(os.Args[2:])
+	}
+
 	manifestPtr := flag.String(
 		"manifest", "", "the manifest file to load")
 	thinManifestDirPtr := flag.String(
@@ -91,6 +103,21 @@ func main() {
 		"read all images in a repository and print to stdout")
 	snapshotTag := ""
 	flag.StringVar(&snapshotTag, "snapshot-tag", snapshotTag, "only snapshot images with the given tag")
+	snapshotImageGlob := ""
+	flag.StringVar(&snapshotImageGlob, "snapshot-image-glob", snapshotImageGlob,
+		"(only works with -snapshot/-manifest-based-snapshot-of) only snapshot the images whose name, or one of whose parent paths, matches the given glob (e.g. 'foo' or 'foo/*-amd64')")
+	snapshotImageRegex := ""
+	flag.StringVar(&snapshotImageRegex, "snapshot-image-regex", snapshotImageRegex,
+		"(only works with -snapshot/-manifest-based-snapshot-of) only snapshot the images whose name matches the given regular expression")
+	snapshotTagRegex := ""
+	flag.StringVar(&snapshotTagRegex, "snapshot-tag-regex", snapshotTagRegex,
+		"(only works with -snapshot/-manifest-based-snapshot-of) only snapshot the tags that match the given regular expression (digests without any such tag are discarded)")
+	snapshotCreatedAfter := ""
+	flag.StringVar(&snapshotCreatedAfter, "snapshot-created-after", snapshotCreatedAfter,
+		"(only works with -snapshot) only snapshot the digests created after the given time (YYYY-MM-DD or RFC 3339)")
+	snapshotUploadedAfter := ""
+	flag.StringVar(&snapshotUploadedAfter, "snapshot-uploaded-after", snapshotUploadedAfter,
+		"(only works with -snapshot) only snapshot the digests uploaded after the given time (YYYY-MM-DD or RFC 3339)")
 	minimalSnapshotPtr := flag.Bool(
 		"minimal-snapshot",
 		false,
@@ -98,7 +125,19 @@ func main() {
 	outputFormatPtr := flag.String(
 		"output-format",
 		"YAML",
-		"(only works with -snapshot/-manifest-based-snapshot-of) choose output format of the snapshot (default: YAML; allowed values: 'YAML' or 'CSV')")
+		"(only works with -snapshot/-manifest-based-snapshot-of) choose output format of the snapshot (default: YAML; allowed values: 'YAML', 'CSV' or 'JSON'; with -snapshot, JSON includes the media type, size and timestamps of each digest, and the parent/child relationships of manifest lists; with -manifest-based-snapshot-of, no registry is read, so JSON has none of these)")
+	snapshotThinManifestDir := ""
+	flag.StringVar(&snapshotThinManifestDir, "snapshot-thin-manifest-dir", snapshotThinManifestDir,
+		"(only works with -snapshot) instead of printing the snapshot, write a thin manifest for the registry into the given thin manifest directory, as manifests/<name>/promoter-manifest.yaml and images/<name>/images.yaml; the manifest lists the snapshotted registry as its source, and the registries in -snapshot-thin-manifest-dests as its destinations")
+	snapshotThinManifestDests := ""
+	flag.StringVar(&snapshotThinManifestDests, "snapshot-thin-manifest-dests", snapshotThinManifestDests,
+		"(REQUIRED with -snapshot-thin-manifest-dir) comma-separated destination registries of the thin manifest, e.g. 'us.gcr.io/k8s-artifacts-prod/foo,eu.gcr.io/k8s-artifacts-prod/foo'")
+	snapshotThinManifestDestSvcAcc := ""
+	flag.StringVar(&snapshotThinManifestDestSvcAcc, "snapshot-thin-manifest-dest-service-account", snapshotThinManifestDestSvcAcc,
+		"(only works with -snapshot-thin-manifest-dir) service account of the destination registries of the thin manifest")
+	snapshotThinManifestName := ""
+	flag.StringVar(&snapshotThinManifestName, "snapshot-thin-manifest-name", snapshotThinManifestName,
+		"(only works with -snapshot-thin-manifest-dir) the <name> of the thin manifest (default: the last part of the registry name, without any 'k8s-staging-' prefix)")
 	snapshotSvcAccPtr := flag.String(
 		"snapshot-service-account",
 		"",
@@ -130,6 +169,18 @@ func main() {
 		"audit-gcp-project-id",
 		os.Getenv("CIP_AUDIT_GCP_PROJECT_ID"),
 		"GCP project ID (name); used for labeling error reporting logs to GCP")
+	auditTrailPathPtr := flag.String(
+		"audit-trail-path",
+		os.Getenv("CIP_AUDIT_TRAIL_PATH"),
+		"(only works with -audit) path to a file where every audit decision is appended as a JSON line; the records can be queried at /trail (default: no audit trail)")
+	auditReconcileIntervalPtr := flag.String(
+		"audit-reconcile-interval",
+		os.Getenv("CIP_AUDIT_RECONCILE_INTERVAL"),
+		"(only works with -audit) how often to compare all destination registries against the manifests, e.g. '6h' (default: never; a sweep can still be triggered with a request to /reconcile)")
+	auditReplayPtr := flag.String(
+		"audit-replay",
+		"",
+		"(only works with -thin-manifest-dir) audit the GCR Pub/Sub payloads (one JSON object per line) in the given file against the manifests offline, and print the verdict for each; exits with 1 if any of them are rejected")
 	flag.Parse()
 
 	if len(os.Args) == 1 {
@@ -148,6 +199,64 @@ func main() {
 		os.Exit(0)
 	}
 
+	switch *outputFormatPtr {
+	case "YAML", "CSV", "JSON":
+	default:
+		klog.Exitf("invalid value %q for -output-format (allowed values: 'YAML', 'CSV' or 'JSON')", *outputFormatPtr)
+	}
+	if len(snapshotThinManifestDir) > 0 && len(*snapshotPtr) == 0 {
+		klog.Exitln("-snapshot-thin-manifest-dir requires -snapshot")
+	}
+	var thinManifestDests []reg.RegistryContext
+	for _, dest := range strings.Split(snapshotThinManifestDests, ",") {
+		if dest = strings.TrimSpace(dest); dest != "" {
+			thinManifestDests = append(thinManifestDests, reg.RegistryContext{
+				Name:           reg.RegistryName(dest),
+				ServiceAccount: snapshotThinManifestDestSvcAcc,
+			})
+		}
+	}
+	if len(snapshotThinManifestDir) > 0 && len(thinManifestDests) == 0 {
+		klog.Exitln("-snapshot-thin-manifest-dir requires -snapshot-thin-manifest-dests")
+	}
+
+	snapshotFilter := reg.SnapshotFilter{ImageGlob: snapshotImageGlob}
+	if err := snapshotFilter.Validate(); err != nil {
+		klog.Exitf("invalid -snapshot-image-glob: %v", err)
+	}
+	if snapshotImageRegex != "" {
+		re, err := regexp.Compile(snapshotImageRegex)
+		if err != nil {
+			klog.Exitf("invalid -snapshot-image-regex: %v", err)
+		}
+		snapshotFilter.ImageRegex = re
+	}
+	if snapshotTagRegex != "" {
+		re, err := regexp.Compile(snapshotTagRegex)
+		if err != nil {
+			klog.Exitf("invalid -snapshot-tag-regex: %v", err)
+		}
+		snapshotFilter.TagRegex = re
+	}
+	if snapshotCreatedAfter != "" {
+		t, err := reg.ParseSnapshotTime(snapshotCreatedAfter)
+		if err != nil {
+			klog.Exitf("invalid -snapshot-created-after: %v", err)
+		}
+		snapshotFilter.CreatedAfter = t
+	}
+	if snapshotUploadedAfter != "" {
+		t, err := reg.ParseSnapshotTime(snapshotUploadedAfter)
+		if err != nil {
+			klog.Exitf("invalid -snapshot-uploaded-after: %v", err)
+		}
+		snapshotFilter.UploadedAfter = t
+	}
+	if (snapshotCreatedAfter != "" || snapshotUploadedAfter != "") &&
+		len(*snapshotPtr) == 0 {
+		klog.Exitln("-snapshot-created-after and -snapshot-uploaded-after require -snapshot")
+	}
+
 	if *auditorPtr {
 		uuid := os.Getenv("CIP_AUDIT_TESTCASE_UUID")
 		if len(uuid) > 0 {
@@ -156,7 +265,43 @@ func main() {
 			uuid = guuid.New().String()
 			klog.Infof("Starting auditor in Regular Mode (%s)", uuid)
 		}
-		audit.Auditor(*auditGcpProjectID, *auditManifestRepoUrlPtr, *auditManifestRepoBranchPtr, *auditManifestPathPtr, uuid)
+		var reconcileInterval time.Duration
+		if len(*auditReconcileIntervalPtr) > 0 {
+			var err error
+			reconcileInterval, err = time.ParseDuration(*auditReconcileIntervalPtr)
+			if err != nil {
+				klog.Exitf("invalid -audit-reconcile-interval: %v", err)
+			}
+		}
+		err := audit.Auditor(*auditGcpProjectID, *auditManifestRepoUrlPtr, *auditManifestRepoBranchPtr, *auditManifestPathPtr, uuid, *auditTrailPathPtr, reconcileInterval)
+		if err != nil {
+			klog.Exitln(err)
+		}
+		os.Exit(0)
+	}
+
+	if len(*auditReplayPtr) > 0 {
+		if *thinManifestDirPtr == "" {
+			klog.Exitln("-audit-replay requires -thin-manifest-dir")
+		}
+		mfests, err := reg.ParseThinManifestsFromDir(*thinManifestDirPtr)
+		if err != nil {
+			klog.Exitln(err)
+		}
+		f, err := os.Open(*auditReplayPtr)
+		if err != nil {
+			klog.Exitln(err)
+		}
+		rejected, err := audit.Replay(mfests, f, os.Stdout)
+		_ = f.Close()
+		if err != nil {
+			klog.Exitln(err)
+		}
+		if rejected > 0 {
+			klog.Errorf("%d transaction(s) rejected", rejected)
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
 
 	// Activate service accounts.
@@ -284,6 +429,10 @@ func main() {
 			}
 			rii = reg.EdgesToRegInvImage(promotionEdges,
 				*manifestBasedSnapshotOf)
+			rii, err = snapshotFilter.Apply(rii, nil)
+			if err != nil {
+				klog.Exitln(err)
+			}
 
 			if *minimalSnapshotPtr {
 				sc.ReadRegistries(
@@ -291,7 +440,7 @@ func main() {
 					true,
 					reg.MkReadRepositoryCmdReal)
 				sc.ReadGCRManifestLists(reg.MkReadManifestListCmdReal)
-				rii = sc.RemoveChildDigestEntries(rii)
+				rii = sc.RemoveChildDigestEntries(srcRegistry.Name, rii)
 			}
 		} else {
 			sc, err = reg.MakeSyncContext(
@@ -314,21 +463,47 @@ func main() {
 			if snapshotTag != "" {
 				rii = reg.FilterByTag(rii, snapshotTag)
 			}
+			rii, err = snapshotFilter.Apply(rii, sc.DigestInfo[srcRegistry.Name])
+			if err != nil {
+				klog.Exitln(err)
+			}
+			if *minimalSnapshotPtr || *outputFormatPtr == "JSON" {
+				sc.ReadGCRManifestLists(reg.MkReadManifestListCmdReal)
+			}
 			if *minimalSnapshotPtr {
 				klog.Info("-minimal-snapshot specifed; removing tagless child digests of manifest lists")
-				sc.ReadGCRManifestLists(reg.MkReadManifestListCmdReal)
-				rii = sc.RemoveChildDigestEntries(rii)
+				rii = sc.RemoveChildDigestEntries(srcRegistry.Name, rii)
+			}
+		}
+
+		if len(snapshotThinManifestDir) > 0 {
+			name := snapshotThinManifestName
+			if name == "" {
+				name = reg.ThinManifestNameFor(srcRegistry.Name)
 			}
+			err := reg.WriteThinManifest(
+				snapshotThinManifestDir,
+				name,
+				append([]reg.RegistryContext{*srcRegistry}, thinManifestDests...),
+				rii)
+			if err != nil {
+				klog.Exitln(err)
+			}
+			os.Exit(0)
 		}
 
 		var snapshot string
 		switch *outputFormatPtr {
 		case "CSV":
 			snapshot = rii.ToCSV()
-		case "YAML":
-			snapshot = rii.ToYAML()
+		case "JSON":
+			snapshot, err = rii.ToJSON(
+				sc.DigestInfo[srcRegistry.Name],
+				sc.ManifestListParents[srcRegistry.Name])
+			if err != nil {
+				klog.Exitln(err)
+			}
 		default:
-			klog.Errorf("invalid value %s for -output-format; defaulting to YAML", *outputFormatPtr)
 			snapshot = rii.ToYAML()
 		}
 		fmt.Print(snapshot)
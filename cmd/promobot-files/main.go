@@ -21,27 +21,42 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 
 	"k8s.io/klog"
 	"sigs.k8s.io/k8s-container-image-promoter/pkg/cmd"
 )
 
+// GitDescribe is stamped by bazel.
+var GitDescribe string
+
 func main() {
 	klog.InitFlags(nil)
 
 	var options cmd.PromoteFilesOptions
 	options.PopulateDefaults()
+	options.PromoterVersion = GitDescribe
 
 	flag.StringVar(
 		&options.FilestoresPath,
 		"filestores",
 		options.FilestoresPath,
-		"the manifest of filestores (REQUIRED)")
+		"the manifest of filestores"+
+			" (REQUIRED, unless -thin-manifest-dir is used)")
 	flag.StringVar(
 		&options.FilesPath,
 		"files",
 		options.FilesPath,
-		"path to the files manifest (REQUIRED).  A directory can be specified.")
+		"path to the files manifest (REQUIRED, unless -thin-manifest-dir"+
+			" is used).  A directory can be specified.")
+	flag.StringVar(
+		&options.ThinManifestDir,
+		"thin-manifest-dir",
+		options.ThinManifestDir,
+		"read the manifests of all projects from a directory with a"+
+			" filestores/<project>/filestores.yaml and a"+
+			" files/<project>/files.yaml for every project"+
+			" (instead of -filestores and -files)")
 	flag.BoolVar(
 		&options.DryRun,
 		"dry-run",
@@ -49,6 +64,12 @@ func main() {
 		"print what would have happened by running this tool;"+
 			" do not actually modify any registry")
 
+	flag.IntVar(
+		&options.Threads,
+		"threads",
+		options.Threads,
+		"number of files to copy concurrently")
+
 	flag.BoolVar(
 		&options.UseServiceAccount,
 		"use-service-account",
@@ -56,10 +77,58 @@ func main() {
 		"allow service account usage with gcloud calls"+
 			" (default: false)")
 
-	flag.Parse()
+	flag.BoolVar(
+		&options.ForceDownloadVerification,
+		"force-download-verification",
+		options.ForceDownloadVerification,
+		"when copying between buckets of the same provider (server-side),"+
+			" download each source file to verify its sha256 instead of"+
+			" trusting its sha256 metadata")
+
+	flag.BoolVar(
+		&options.Prune,
+		"prune",
+		options.Prune,
+		"delete files in the destination filestores that are not in the"+
+			" manifest (by default, they are only reported)")
+
+	flag.IntVar(
+		&options.MaxDeletions,
+		"max-deletions",
+		options.MaxDeletions,
+		"with -prune, refuse to delete anything if more than this many"+
+			" files would be deleted (across all manifests)")
+
+	flag.BoolVar(
+		&options.AllowOverwrite,
+		"allow-overwrite",
+		options.AllowOverwrite,
+		"replace files in immutable filestores whose content does not"+
+			" match the manifest (by default, this is an error)")
+
+	// "promobot-files verify [flags]" only checks the destination filestores.
+	args := os.Args[1:]
+	run := cmd.RunPromoteFiles
+	if len(args) != 0 && args[0] == "verify" {
+		run = cmd.RunVerifyFiles
+		args = args[1:]
+	}
+	// The default FlagSet exits on errors.
+	_ = flag.CommandLine.Parse(args)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// On SIGINT, stop starting new copies and cancel the ones in flight.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		<-sigs
+		klog.Warning("interrupted; cancelling promotion")
+		cancel()
+	}()
 
-	ctx := context.Background()
-	if err := cmd.RunPromoteFiles(ctx, options); err != nil {
+	if err := run(ctx, options); err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		// nolint[gomnd]
 		os.Exit(1)
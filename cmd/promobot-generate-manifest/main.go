@@ -20,15 +20,25 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"golang.org/x/xerrors"
 	"k8s.io/klog"
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
 	"sigs.k8s.io/k8s-container-image-promoter/pkg/cmd"
 	"sigs.k8s.io/yaml"
 )
 
+// The values of the --output-format flag
+const (
+	outputFormatYAML       = "yaml"
+	outputFormatSHA256Sums = "sha256sums"
+)
+
 func main() {
 	ctx := context.Background()
 
@@ -41,6 +51,12 @@ func main() {
 
 // nolint[lll]
 func run(ctx context.Context) error {
+	// "promobot-generate-manifest images [flags]" generates the images of a
+	// container image manifest instead.
+	if len(os.Args) > 1 && os.Args[1] == "images" {
+		return runImages(os.Args[2:])
+	}
+
 	klog.InitFlags(nil)
 
 	src := ""
@@ -48,36 +64,185 @@ func run(ctx context.Context) error {
 		&src,
 		"src",
 		src,
-		"the base directory to copy from")
+		"the base directory, or the base of a filestore (gs://, s3:// or file://), to hash the files of")
+
+	include := ""
+	flag.StringVar(
+		&include,
+		"include",
+		include,
+		"comma-separated globs of the files to include (default: all files)")
+
+	exclude := ""
+	flag.StringVar(
+		&exclude,
+		"exclude",
+		exclude,
+		"comma-separated globs of the files to exclude")
+
+	mergeWith := ""
+	flag.StringVar(
+		&mergeWith,
+		"merge-with",
+		mergeWith,
+		"an existing manifest to add the new files to; files whose sha256 changed are reported, and cause a non-zero exit code")
+
+	outputFormat := outputFormatYAML
+	flag.StringVar(
+		&outputFormat,
+		"output-format",
+		outputFormat,
+		"the format of the output: "+outputFormatYAML+" (a manifest), or "+outputFormatSHA256Sums+" (like the output of sha256sum)")
+
+	var opt cmd.GenerateManifestOptions
+	opt.PopulateDefaults()
+
+	flag.IntVar(
+		&opt.Threads,
+		"threads",
+		opt.Threads,
+		"number of files to hash concurrently")
+
+	flag.BoolVar(
+		&opt.UseServiceAccount,
+		"use-service-account",
+		opt.UseServiceAccount,
+		"allow service account usage with gcloud calls")
 
 	flag.Parse()
 
 	if src == "" {
 		return xerrors.New("must specify --src")
 	}
+	if outputFormat != outputFormatYAML && outputFormat != outputFormatSHA256Sums {
+		return xerrors.Errorf("unknown --output-format %q (supported formats: %s, %s)", outputFormat, outputFormatYAML, outputFormatSHA256Sums)
+	}
 
-	var opt cmd.GenerateManifestOptions
-	opt.PopulateDefaults()
-
-	s, err := filepath.Abs(src)
-	if err != nil {
-		return xerrors.Errorf("cannot resolve %q to absolute path: %w", src, err)
+	if strings.Contains(src, "://") {
+		opt.Src = src
+	} else {
+		s, err := filepath.Abs(src)
+		if err != nil {
+			return xerrors.Errorf("cannot resolve %q to absolute path: %w", src, err)
+		}
+		opt.BaseDir = s
 	}
-	opt.BaseDir = s
+	opt.Include = splitGlobs(include)
+	opt.Exclude = splitGlobs(exclude)
 
 	manifest, err := cmd.GenerateManifest(ctx, opt)
 	if err != nil {
 		return err
 	}
 
-	manifestYAML, err := yaml.Marshal(manifest)
+	var changed []cmd.ChangedFile
+	if mergeWith != "" {
+		b, err := ioutil.ReadFile(mergeWith)
+		if err != nil {
+			return xerrors.Errorf("error reading manifest %q: %w", mergeWith, err)
+		}
+		existing, err := api.ParseManifest(b)
+		if err != nil {
+			return xerrors.Errorf("error reading manifest %q: %w", mergeWith, err)
+		}
+		manifest, changed = cmd.MergeManifest(existing, manifest)
+	}
+
+	var output []byte
+	if outputFormat == outputFormatSHA256Sums {
+		output, err = api.FormatSHA256Sums(manifest.Files)
+	} else {
+		output, err = yaml.Marshal(manifest)
+	}
 	if err != nil {
 		return xerrors.Errorf("error serializing manifest: %w", err)
 	}
 
-	if _, err := os.Stdout.Write(manifestYAML); err != nil {
+	if _, err := os.Stdout.Write(output); err != nil {
+		return err
+	}
+
+	for _, f := range changed {
+		fmt.Fprintf(os.Stderr, "sha256 of %q changed from %s to %s\n", f.Name, f.OldSHA256, f.NewSHA256)
+	}
+	if len(changed) != 0 {
+		return xerrors.Errorf("%d files in %q have changed", len(changed), mergeWith)
+	}
+
+	return nil
+}
+
+// nolint[lll]
+func runImages(args []string) error {
+	fs := flag.NewFlagSet("images", flag.ExitOnError)
+	klog.InitFlags(fs)
+
+	var opt cmd.GenerateImagesOptions
+	opt.PopulateDefaults()
+
+	fs.StringVar(
+		&opt.Registry,
+		"registry",
+		opt.Registry,
+		"the staging registry to read the images from, e.g. gcr.io/k8s-staging-foo")
+	fs.StringVar(
+		&opt.ServiceAccount,
+		"service-account",
+		opt.ServiceAccount,
+		"the service account to read the registry with (with -use-service-account)")
+	fs.BoolVar(
+		&opt.UseServiceAccount,
+		"use-service-account",
+		opt.UseServiceAccount,
+		"allow service account usage with gcloud calls")
+	fs.IntVar(
+		&opt.Threads,
+		"threads",
+		opt.Threads,
+		"number of concurrent goroutines to use when talking to GCR")
+	fs.StringVar(
+		&opt.ImageGlob,
+		"image",
+		opt.ImageGlob,
+		"a glob of the image names to include, e.g. 'foo/*' (default: all images)")
+	fs.StringVar(
+		&opt.TagRegex,
+		"tag-regex",
+		opt.TagRegex,
+		"include the tags matching this regular expression, e.g. '^v[0-9.]+$'")
+	fs.StringVar(
+		&opt.TagSemver,
+		"tag-semver",
+		opt.TagSemver,
+		"include the tags that are semantic versions within this range, e.g. '>=1.2.0 <2.0.0' (instead of -tag-regex)")
+	fs.StringVar(
+		&opt.MergeWith,
+		"merge-with",
+		opt.MergeWith,
+		"an existing images.yaml to add the images to; it is an error to retarget any of its tags")
+
+	// The FlagSet exits on errors.
+	_ = fs.Parse(args)
+
+	images, err := cmd.GenerateImages(opt, reg.MkReadRepositoryCmdReal)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stdout.WriteString(images.ToYAML()); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// splitGlobs splits a comma-separated list of globs
+func splitGlobs(s string) []string {
+	var globs []string
+	for _, glob := range strings.Split(s, ",") {
+		if glob = strings.TrimSpace(glob); glob != "" {
+			globs = append(globs, glob)
+		}
+	}
+	return globs
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"k8s.io/klog"
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+)
+
+// runDiff implements "cip diff [flags]", which compares a registry with
+// another registry (e.g., two mirrors), or with what the promoter manifests
+// want to have promoted to it. It exits with 1 if there are any differences,
+// and with diffExitError if they cannot be computed.
+//
+// nolint[lll]
+func runDiff(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	klog.InitFlags(fs)
+
+	registry := fs.String(
+		"registry",
+		"",
+		"the registry to compare, e.g. us.gcr.io/k8s-artifacts-prod (REQUIRED)")
+	serviceAccount := fs.String(
+		"service-account",
+		"",
+		"service account to use for -registry")
+	otherRegistry := fs.String(
+		"other-registry",
+		"",
+		"the registry to compare -registry against, e.g. eu.gcr.io/k8s-artifacts-prod")
+	otherServiceAccount := fs.String(
+		"other-service-account",
+		"",
+		"service account to use for -other-registry")
+	thinManifestDir := fs.String(
+		"thin-manifest-dir",
+		"",
+		"compare -registry against the images that the thin manifests in this directory promote to it (instead of -other-registry)")
+	outputFormat := fs.String(
+		"output-format",
+		"YAML",
+		"choose output format of the differences (allowed values: 'YAML' or 'JSON')")
+	threads := fs.Int(
+		"threads",
+		10, "number of concurrent goroutines to use when talking to GCR")
+	useServiceAccount := fs.Bool(
+		"use-service-account",
+		false,
+		"pass '--account=...' to all gcloud calls (default: false)")
+
+	// The FlagSet exits on errors.
+	_ = fs.Parse(args)
+
+	if *registry == "" {
+		exitDiffError("-registry is required")
+	}
+	if (*otherRegistry == "") == (*thinManifestDir == "") {
+		exitDiffError("exactly one of -other-registry or -thin-manifest-dir is required")
+	}
+	if *outputFormat != "YAML" && *outputFormat != "JSON" {
+		exitDiffError(fmt.Sprintf("invalid value %q for -output-format (allowed values: 'YAML' or 'JSON')", *outputFormat))
+	}
+
+	// Manifests do not list the children of manifest lists, so drop them
+	// when comparing against manifests. Between registries, missing children
+	// are real differences.
+	withoutChildren := *thinManifestDir != ""
+	read := func(
+		name reg.RegistryName,
+		serviceAccount string) (reg.RegInvImage, reg.RegInvDigestInfo) {
+		rii, info, err := readRegistry(
+			reg.RegistryContext{Name: name, ServiceAccount: serviceAccount},
+			*threads,
+			*useServiceAccount,
+			withoutChildren)
+		if err != nil {
+			exitDiffError(err)
+		}
+		return rii, info
+	}
+
+	left, leftInfo := read(reg.RegistryName(*registry), *serviceAccount)
+
+	var right reg.RegInvImage
+	var rightInfo reg.RegInvDigestInfo
+	var rightName string
+	if *otherRegistry != "" {
+		right, rightInfo = read(reg.RegistryName(*otherRegistry), *otherServiceAccount)
+		rightName = *otherRegistry
+	} else {
+		mfests, err := reg.ParseThinManifestsFromDir(*thinManifestDir)
+		if err != nil {
+			exitDiffError(err)
+		}
+		edges, err := reg.ToPromotionEdges(mfests)
+		if err != nil {
+			exitDiffError(err)
+		}
+		right = reg.EdgesToRegInvImage(edges, *registry)
+		rightName = *thinManifestDir
+	}
+
+	d := reg.Diff(*registry, rightName, left, right)
+	d.AddDigestInfo(leftInfo, rightInfo)
+
+	var out string
+	var err error
+	if *outputFormat == "JSON" {
+		out, err = d.ToJSON()
+	} else {
+		out, err = d.ToYAML()
+	}
+	if err != nil {
+		exitDiffError(err)
+	}
+	fmt.Print(out)
+
+	if !d.IsEmpty() {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// diffExitError is the exit code of "cip diff" when the differences cannot be
+// computed, to tell it apart from finding differences (exit code 1).
+const diffExitError = 2
+
+// exitDiffError logs its arguments and exits with diffExitError.
+func exitDiffError(args ...interface{}) {
+	klog.ErrorDepth(1, args...)
+	klog.Flush()
+	os.Exit(diffExitError)
+}
+
+// readRegistry reads all the images in a registry (and their DigestInfo),
+// recursively. If withoutChildren is true, the untagged children of manifest
+// lists are dropped.
+func readRegistry(
+	rc reg.RegistryContext,
+	threads int,
+	useServiceAccount bool,
+	withoutChildren bool) (reg.RegInvImage, reg.RegInvDigestInfo, error) {
+	mfests := []reg.Manifest{{Registries: []reg.RegistryContext{rc}}}
+	sc, err := reg.MakeSyncContext(mfests, 2, threads, true, useServiceAccount)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sc.ReadRegistries(
+		[]reg.RegistryContext{rc},
+		true,
+		reg.MkReadRepositoryCmdReal)
+	if len(sc.InvIgnore) > 0 {
+		return nil, nil, fmt.Errorf(
+			"could not read all of %q (failed to read: %v)",
+			rc.Name, sc.InvIgnore)
+	}
+	if !withoutChildren {
+		return sc.Inv[rc.Name], sc.DigestInfo[rc.Name], nil
+	}
+
+	// Without the children of a manifest list that could not be read, they
+	// would show up as extra digests.
+	sc.ReadGCRManifestLists(reg.MkReadManifestListCmdReal)
+	if len(sc.UnreadManifestLists) > 0 {
+		return nil, nil, fmt.Errorf(
+			"could not read all the manifest lists of %q (failed to read: %v)",
+			rc.Name, sc.UnreadManifestLists)
+	}
+
+	return sc.RemoveChildDigestEntries(rc.Name, sc.Inv[rc.Name]),
+		sc.DigestInfo[rc.Name],
+		nil
+}
@@ -26,12 +26,17 @@ import (
 	"os"
 	"path/filepath"
 	"runtime/debug"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/errorreporting"
 	"cloud.google.com/go/logging"
 	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
 	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
 	"k8s.io/klog"
 	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
 )
@@ -45,6 +50,21 @@ type ServerContext struct {
 	ThinManifestDirPath  string
 	ErrorReportingClient *errorreporting.Client
 	LogClient            *logging.Client
+	// Trail records every decision made by the auditor. It is nil if the
+	// audit trail is disabled.
+	Trail *Trail
+	// loadedManifests is set to 1 (atomically) once the manifests have been
+	// read successfully.
+	loadedManifests int32
+	// reconciling is set to 1 (atomically) while a reconciliation sweep
+	// runs, so that sweeps do not overlap.
+	reconciling int32
+	// cacheMutex guards the manifests (and their ManifestIndex) last cloned
+	// from RepoURL at commit cachedSha.
+	cacheMutex      sync.Mutex
+	cachedManifests []reg.Manifest
+	cachedIndex     reg.ManifestIndex
+	cachedSha       string
 }
 
 // PubSubMessageInner is the inner struct that holds the actual Pub/Sub
@@ -68,7 +88,7 @@ const (
 )
 
 func initServerContext(
-	gcpProjectID, repoURLStr, branch, path, uuid string,
+	gcpProjectID, repoURLStr, branch, path, uuid, trailPath string,
 ) (*ServerContext, error) {
 
 	repoURL, err := url.Parse(repoURLStr)
@@ -76,6 +96,14 @@ func initServerContext(
 		return nil, err
 	}
 
+	var trail *Trail
+	if len(trailPath) > 0 {
+		trail, err = OpenTrail(trailPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	erc := initErrorReportingClient(gcpProjectID)
 	logClient := initLogClient(gcpProjectID)
 
@@ -86,6 +114,7 @@ func initServerContext(
 		ThinManifestDirPath:  path,
 		ErrorReportingClient: erc,
 		LogClient:            logClient,
+		Trail:                trail,
 	}
 
 	return &serverContext, nil
@@ -125,13 +154,20 @@ func initErrorReportingClient(projectID string) *errorreporting.Client {
 	return erc
 }
 
-// Auditor runs an HTTP server.
-func Auditor(gcpProjectID, repoURL, branch, path, uuid string) {
+// Auditor runs an HTTP server. If reconcileInterval is positive, a full
+// reconciliation sweep of all destination registries is also run periodically
+// in the background. If trailPath is not empty, every decision is recorded in
+// an audit trail at that path. Auditor returns once the server has been shut
+// down by SIGTERM (or SIGINT) and in-flight requests have been drained, or with
+// an error if the server could not be initialized or run.
+func Auditor(
+	gcpProjectID, repoURL, branch, path, uuid, trailPath string,
+	reconcileInterval time.Duration) error {
 	klog.Info("Starting Auditor")
 	serverContext, err := initServerContext(
-		gcpProjectID, repoURL, branch, path, uuid)
+		gcpProjectID, repoURL, branch, path, uuid, trailPath)
 	if err != nil {
-		klog.Exitln(err)
+		return err
 	}
 
 	klog.Infoln(serverContext)
@@ -141,27 +177,43 @@ func Auditor(gcpProjectID, repoURL, branch, path, uuid string) {
 	// nolint[errcheck]
 	defer serverContext.ErrorReportingClient.Close()
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		serverContext.Audit(w, r)
-	})
+	// Stop the periodic sweeps once the server has been shut down.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go serverContext.preloadManifests()
+	if reconcileInterval > 0 {
+		klog.Infof("Reconciling registries every %v", reconcileInterval)
+		go serverContext.reconcileEvery(ctx, reconcileInterval)
+	}
 	// Determine port for HTTP service.
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 		klog.Infof("Defaulting to port %s", port)
 	}
+	srv := &http.Server{
+		Addr:         fmt.Sprintf(":%s", port),
+		Handler:      serverContext.Handler(),
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+	}
 	// Start HTTP server.
 	klog.Infof("Listening on port %s", port)
-	klog.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
+	if err := serve(srv); err != nil {
+		return err
+	}
+	klog.Info("Auditor stopped")
+	return nil
 }
 
 func cloneToTempDir(
 	repoURL fmt.Stringer,
 	branch string,
-) (string, error) {
+) (string, string, error) {
 	tdir, err := ioutil.TempDir("", "k8s.io-")
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	r, err := git.PlainClone(tdir, false, &git.CloneOptions{
@@ -170,7 +222,7 @@ func cloneToTempDir(
 		Depth:         cloneDepth,
 	})
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	sha, err := getHeadSha(r)
@@ -178,34 +230,84 @@ func cloneToTempDir(
 		klog.Infof("cloned %v at revision %v", tdir, sha)
 	}
 
-	return tdir, nil
+	return tdir, sha, nil
+}
+
+// remoteHeadSha returns the commit that branch points to in the remote
+// repository, without cloning it.
+func remoteHeadSha(repoURL fmt.Stringer, branch string) (string, error) {
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: "origin",
+		URLs: []string{repoURL.String()},
+	})
+	refs, err := remote.List(&git.ListOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	name := plumbing.NewBranchReferenceName(branch)
+	for _, ref := range refs {
+		if ref.Name() == name {
+			return ref.Hash().String(), nil
+		}
+	}
+	return "", fmt.Errorf("branch %q not found in %v", branch, repoURL)
 }
 
 // It could be the case that the repository is defined simply as a local path on
 // disk (in the case of e2e tests where we do not have a full-fledghed online
 // repository for the manifests we want to audit) --- in such cases, we have to
 // use the local path instead of freshly cloning a remote repo.
-func (s *ServerContext) getManifests() ([]reg.Manifest, error) {
-	// There is no remote; use the local path directly.
+//
+// The Git commit of the manifests is returned as well (it is empty if the local
+// path is not part of a Git repository). The manifests cloned from a remote
+// repository are cached along with their ManifestIndex, and only cloned again
+// once the branch points to another commit.
+func (s *ServerContext) getManifests() (
+	[]reg.Manifest, reg.ManifestIndex, string, error) {
+
+	// There is no remote; use the local path directly. It is cheap to parse
+	// again, and may have uncommitted changes, so it is not cached.
 	if len(s.RepoURL.String()) == 0 {
 		manifests, err := reg.ParseThinManifestsFromDir(s.ThinManifestDirPath)
 		if err != nil {
-			return nil, err
+			return nil, reg.ManifestIndex{}, "", err
+		}
+
+		var sha string
+		r, err := git.PlainOpenWithOptions(
+			s.ThinManifestDirPath,
+			&git.PlainOpenOptions{DetectDotGit: true})
+		if err == nil {
+			sha, _ = getHeadSha(r)
 		}
 
-		return manifests, nil
+		s.setManifestsLoaded()
+		return manifests, reg.MakeManifestIndex(manifests), sha, nil
 	}
 
-	var repoPath string
-	repoPath, err := cloneToTempDir(s.RepoURL, s.RepoBranch)
+	// Hold the lock while cloning, so that concurrent events for the same
+	// commit wait for a single clone.
+	s.cacheMutex.Lock()
+	defer s.cacheMutex.Unlock()
+
+	headSha, err := remoteHeadSha(s.RepoURL, s.RepoBranch)
 	if err != nil {
-		return nil, err
+		// Fall back to cloning, which reports its own errors.
+		klog.Errorf("could not look up the head of %v: %v", s.RepoURL, err)
+	} else if len(s.cachedSha) > 0 && headSha == s.cachedSha {
+		return s.cachedManifests, s.cachedIndex, s.cachedSha, nil
+	}
+
+	repoPath, sha, err := cloneToTempDir(s.RepoURL, s.RepoBranch)
+	if err != nil {
+		return nil, reg.ManifestIndex{}, "", err
 	}
 
 	manifests, err := reg.ParseThinManifestsFromDir(
 		filepath.Join(repoPath, s.ThinManifestDirPath))
 	if err != nil {
-		return nil, err
+		return nil, reg.ManifestIndex{}, "", err
 	}
 
 	// Garbage-collect freshly-cloned repo (we don't need it any more).
@@ -217,7 +319,13 @@ func (s *ServerContext) getManifests() ([]reg.Manifest, error) {
 		klog.Errorf("Could not remove temporary Git repo %v: %v", repoPath, err)
 	}
 
-	return manifests, nil
+	index := reg.MakeManifestIndex(manifests)
+	s.cachedManifests = manifests
+	s.cachedIndex = index
+	s.cachedSha = sha
+
+	s.setManifestsLoaded()
+	return manifests, index, sha, nil
 }
 
 func getHeadSha(repo *git.Repository) (string, error) {
@@ -230,52 +338,90 @@ func getHeadSha(repo *git.Repository) (string, error) {
 }
 
 // ParsePubSubMessage parses an HTTP request body into a reg.GCRPubSubPayload.
+// The payload is nil if there is an error.
 func ParsePubSubMessage(r *http.Request) (*reg.GCRPubSubPayload, error) {
+	_, gcrPayload, err := parsePubSubMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	return gcrPayload, nil
+}
+
+// parsePubSubMessage is like ParsePubSubMessage, but also returns the
+// enclosing PubSubMessage (if it could be parsed). The payload is returned even
+// if it is rejected (e.g., for a deletion), so that it can be recorded.
+func parsePubSubMessage(
+	r *http.Request) (*PubSubMessage, *reg.GCRPubSubPayload, error) {
+
 	var psm PubSubMessage
 	var gcrPayload reg.GCRPubSubPayload
 
 	// Handle basic errors (malformed requests).
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		return nil, fmt.Errorf("iotuil.ReadAll: %v", err)
+		return nil, nil, fmt.Errorf("iotuil.ReadAll: %v", err)
 	}
 	if err := json.Unmarshal(body, &psm); err != nil {
-		return nil, fmt.Errorf("json.Unmarshal: %v", err)
+		return nil, nil, fmt.Errorf("json.Unmarshal: %v", err)
 	}
 
 	if err := json.Unmarshal(psm.Message.Data, &gcrPayload); err != nil {
-		return nil, fmt.Errorf("json.Unmarshal: %v", err)
+		return &psm, nil, fmt.Errorf("json.Unmarshal: %v", err)
+	}
+
+	if err := ValidateGCRPubSubPayload(&gcrPayload); err != nil {
+		return &psm, &gcrPayload, err
 	}
 
+	return &psm, &gcrPayload, nil
+}
+
+// ValidateGCRPubSubPayload checks that the payload describes a GCR state change
+// that the auditor can handle.
+func ValidateGCRPubSubPayload(gcrPayload *reg.GCRPubSubPayload) error {
 	if len(gcrPayload.Digest) == 0 && len(gcrPayload.Tag) == 0 {
-		return nil, fmt.Errorf(
+		return fmt.Errorf(
 			"gcrPayload: neither Digest nor Tag was specified")
 	}
 
 	switch gcrPayload.Action {
 	case "":
-		return nil, fmt.Errorf("gcrPayload: Action not specified")
+		return fmt.Errorf("gcrPayload: Action not specified")
 	// All deletions will for now be treated as an error. If it's an insertion,
 	// it can either have "digest" with FQIN, or "digest" + "tag" with PQIN. So
 	// we always verify FQIN, and if there is PQIN, verify that as well.
 	case "DELETE":
 		// Even though this is an error, we successfully processed this message,
 		// so exit with an error.
-		return nil, fmt.Errorf(
-			"%v: deletions are prohibited", gcrPayload)
+		return fmt.Errorf(
+			"%v: deletions are prohibited", *gcrPayload)
 	case "INSERT":
-		return &gcrPayload, nil
+		return nil
 	default:
-		return nil, fmt.Errorf(
+		return fmt.Errorf(
 			"gcrPayload: unknown action %q", gcrPayload.Action)
 	}
 }
 
+// record appends a Record to the audit trail (if it is enabled). Failures are
+// only logged, because the auditor's verdict should not depend on whether it
+// could be recorded.
+func (s *ServerContext) record(rec *Record) {
+	if s.Trail == nil {
+		return
+	}
+
+	rec.Time = time.Now().UTC()
+	rec.ServerID = s.ID
+	if err := s.Trail.Append(rec); err != nil {
+		klog.Errorf("could not append to audit trail: %v", err)
+	}
+}
+
 // Audit receives and processes a Pub/Sub push message. It has 3 parts: (1)
 // parse the request body to understand the GCR state change, (2) update the Git
 // repo of the promoter manifests, and (3) reconcile these two against each
-// other.
-// nolint[funlen]
+// other (see AuditPayload()).
 func (s *ServerContext) Audit(w http.ResponseWriter, r *http.Request) {
 	logInfo := s.LogClient.Logger(LogName).StandardLogger(logging.Info)
 	logError := s.LogClient.Logger(LogName).StandardLogger(logging.Error)
@@ -298,11 +444,21 @@ func (s *ServerContext) Audit(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 	// (1) Parse request payload.
-	gcrPayload, err := ParsePubSubMessage(r)
+	psm, gcrPayload, err := parsePubSubMessage(r)
+	rec := Record{}
+	if psm != nil {
+		rec.MessageID = psm.Message.ID
+	}
+	if gcrPayload != nil {
+		rec.Payload = *gcrPayload
+	}
 	if err != nil {
 		// It's important to fail any message we cannot parse, because this
 		// notifies us of any changes in how the messages are created in the
 		// first place.
+		rec.Verdict = VerdictRejected
+		rec.Reason = fmt.Sprintf("parse failure: %v", err)
+		s.record(&rec)
 		msg := fmt.Sprintf("(%s) TRANSACTION REJECTED: parse failure: %v", s.ID, err)
 		_, _ = w.Write([]byte(msg))
 		panic(msg)
@@ -313,7 +469,7 @@ func (s *ServerContext) Audit(w http.ResponseWriter, r *http.Request) {
 	logInfo.Println(msg)
 
 	// (2) Clone fresh repo (or use one already on disk).
-	manifests, err := s.getManifests()
+	manifests, index, sha, err := s.getManifests()
 	if err != nil {
 		logError.Println(err)
 		// If there is an error, return an HTTP error so that the Pub/Sub
@@ -329,18 +485,80 @@ func (s *ServerContext) Audit(w http.ResponseWriter, r *http.Request) {
 	logInfo.Printf("(%s) s.RepoBranch: %v", s.ID, s.RepoBranch)
 	logInfo.Printf("(%s) s.ThinManifestDirPath: %v", s.ID, s.ThinManifestDirPath)
 
+	rec.ManifestCommit = sha
+
 	// (3) Compare GCR state change with the intent of the promoter manifests.
-	for _, manifest := range manifests {
-		if manifest.Contains(*gcrPayload) {
-			msg := fmt.Sprintf(
-				"(%s) TRANSACTION VERIFIED: %v: agrees with manifest\n", s.ID, gcrPayload)
-			logInfo.Println(msg)
-			_, _ = w.Write([]byte(msg))
-			return
-		}
+	err = AuditPayload(
+		manifests, index, gcrPayload, ReadSrcRegistryReal, &rec)
+	if err != nil {
+		// Retry Pub/Sub message. There is no verdict yet, so there is nothing
+		// to record.
+		logError.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.record(&rec)
+
+	msg = fmt.Sprintf(
+		"(%s) TRANSACTION %s: %v: %s", s.ID, rec.Verdict, gcrPayload, rec.Reason)
+	if rec.Verdict == VerdictVerified {
+		logInfo.Println(msg)
+		_, _ = w.Write([]byte(msg + "\n"))
+		return
+	}
+
+	// Return 200 OK, because we don't want to re-process this transaction.
+	// "Terminating" the auditing here simplifies debugging as well, because the
+	// same message is not repeated over and over again in the logs.
+	_, _ = w.Write([]byte(msg))
+	panic(msg)
+}
+
+// ReadSrcRegistryReal reads the given source registry over the network, along
+// with all of its manifest lists. It is used by AuditPayload().
+func ReadSrcRegistryReal(sc *reg.SyncContext, srcRegistry reg.RegistryContext) {
+	sc.ReadRegistries(
+		[]reg.RegistryContext{srcRegistry},
+		true,
+		reg.MkReadRepositoryCmdReal)
+	sc.ReadGCRManifestLists(reg.MkReadManifestListCmdReal)
+}
+
+// AuditPayload compares a GCR state change against the intent of the promoter
+// manifests (looked up in index, see reg.MakeManifestIndex()), and fills in the
+// Verdict and Reason (and if possible, the ManifestFile and Image) of rec.
+//
+// If the payload is not mentioned by the manifests directly, it may still be
+// the child image of a manifest list. To check this, readSrcRegistry is called
+// to populate the ManifestListParents of a SyncContext. If readSrcRegistry is nil
+// (e.g., because we are working offline), child images are rejected.
+//
+// An error is only returned if the payload could not be audited at all, and
+// so should be retried later.
+//
+// nolint[funlen]
+func AuditPayload(
+	manifests []reg.Manifest,
+	index reg.ManifestIndex,
+	gcrPayload *reg.GCRPubSubPayload,
+	readSrcRegistry func(*reg.SyncContext, reg.RegistryContext),
+	rec *Record) error {
+
+	if entry, ok := index.Lookup(*gcrPayload); ok {
+		rec.Verdict = VerdictVerified
+		rec.Reason = "agrees with manifest"
+		rec.ManifestFile = entry.ManifestFile
+		rec.Image = string(entry.ImageName)
+		return nil
 	}
 
-	// (4) It could be that the manifest is a child manifest (part of a fat
+	if readSrcRegistry == nil {
+		rec.Verdict = VerdictRejected
+		rec.Reason = "could not validate (child images of manifest lists were not checked)"
+		return nil
+	}
+
+	// It could be that the manifest is a child manifest (part of a fat
 	// manifest). This is the case where the user only specifies the digest of
 	// the parent image, but not the child image. When the promoter copies over
 	// the entirety of the fat manifest, it will necessarily copy over the child
@@ -364,12 +582,9 @@ func (s *ServerContext) Audit(w http.ResponseWriter, r *http.Request) {
 		// useServiceAccount
 		false)
 	if err != nil {
-		// Retry Pub/Sub message if the above fails (it shouldn't because
-		// MakeSyncContext can only error out if the useServiceAccount bool is
-		// set to True).
-		logError.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		// This shouldn't happen, because MakeSyncContext can only error out if
+		// the useServiceAccount bool is set to True.
+		return err
 	}
 	// Find the subproject's registry.
 	var srcRegistry reg.RegistryContext
@@ -392,40 +607,57 @@ func (s *ServerContext) Audit(w http.ResponseWriter, r *http.Request) {
 	// If we can't find the source registry for this image, then reject the
 	// transaction.
 	if string(srcRegistry.Name) == "" {
-		msg := fmt.Sprintf("(%s) TRANSACTION REJECTED: could not determine source registry: %v", s.ID, gcrPayload)
-		_, _ = w.Write([]byte(msg))
-		panic(msg)
+		rec.Verdict = VerdictRejected
+		rec.Reason = "could not determine source registry"
+		return nil
 	}
-	sc.ReadRegistries(
-		[]reg.RegistryContext{srcRegistry},
-		true,
-		reg.MkReadRepositoryCmdReal)
-	sc.ReadGCRManifestLists(reg.MkReadManifestListCmdReal)
-	klog.Infof("sc.ParentDigest is: %v", sc.ParentDigest)
+	readSrcRegistry(&sc, srcRegistry)
+	klog.Infof(
+		"sc.ManifestListParents[%v] is: %v",
+		srcRegistry.Name,
+		sc.ManifestListParents[srcRegistry.Name])
 	var childDigest reg.Digest
 	childImageParts := strings.Split(gcrPayload.Digest, "@")
 	if len(childImageParts) != 2 {
-		msg := fmt.Sprintf("(%s) TRANSACTION REJECTED: could not split child digest information: %v", s.ID, gcrPayload.Digest)
-		_, _ = w.Write([]byte(msg))
-		panic(msg)
+		rec.Verdict = VerdictRejected
+		rec.Reason = fmt.Sprintf(
+			"could not split child digest information %q", gcrPayload.Digest)
+		return nil
 	}
 	childDigest = reg.Digest(childImageParts[1])
-	klog.Infof("looking for child digest %v", childDigest)
-	if parentDigest, hasParent := sc.ParentDigest[childDigest]; hasParent {
-		msg := fmt.Sprintf(
-			"(%s) TRANSACTION VERIFIED: %v: agrees with manifest (parent digest %v)\n", s.ID, gcrPayload, parentDigest)
-		logInfo.Println(msg)
-		_, _ = w.Write([]byte(msg))
-		return
+	// The child must be referenced by a manifest list of the same image in the
+	// source registry; a manifest list of another image that happens to share
+	// the digest does not count.
+	_, childImage, err := reg.SplitByKnownRegistries(
+		reg.RegistryName(childImageParts[0]),
+		sc.RegistryContexts)
+	if err != nil {
+		rec.Verdict = VerdictRejected
+		rec.Reason = fmt.Sprintf(
+			"could not split child image information %q", gcrPayload.Digest)
+		return nil
+	}
+	klog.Infof("looking for child digest %v of %v", childDigest, childImage)
+	parents := sc.ManifestListParents[srcRegistry.Name][reg.ImageDigest{
+		ImageName: childImage,
+		Digest:    childDigest,
+	}]
+	if len(parents) > 0 {
+		parentDigests := make([]string, 0, len(parents))
+		for parentDigest := range parents {
+			parentDigests = append(parentDigests, string(parentDigest))
+		}
+		sort.Strings(parentDigests)
+		rec.Verdict = VerdictVerified
+		rec.Reason = fmt.Sprintf(
+			"agrees with manifest (parent digest %v)",
+			strings.Join(parentDigests, ", "))
+		return nil
 	}
 
-	// (5) If all of the above checks fail, then this transaction is unable tobe
+	// If all of the above checks fail, then this transaction is unable to be
 	// verified.
-	msg = fmt.Sprintf(
-		"(%s) TRANSACTION REJECTED: %v: could not validate", s.ID, gcrPayload)
-	// Return 200 OK, because we don't want to re-process this transaction.
-	// "Terminating" the auditing here simplifies debugging as well, because the
-	// same message is not repeated over and over again in the logs.
-	_, _ = w.Write([]byte(msg))
-	panic(msg)
+	rec.Verdict = VerdictRejected
+	rec.Reason = "could not validate"
+	return nil
 }
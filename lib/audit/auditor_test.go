@@ -17,14 +17,22 @@ limitations under the License.
 package audit
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
 	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
 )
 
@@ -123,8 +131,328 @@ func TestParsePubSubMessage(t *testing.T) {
 	}
 
 	for _, test := range shouldBeInValid {
-		_, gotErr := ParsePubSubMessage(inputToHTTPReq(test.input))
+		gotPayload, gotErr := ParsePubSubMessage(inputToHTTPReq(test.input))
 		errEqual := checkEqual(gotErr, test.expected)
 		checkError(t, errEqual, "checkError: test: shouldBeInValid\n")
+		if gotPayload != nil {
+			t.Errorf("expected no payload on error, got %v", gotPayload)
+		}
+	}
+}
+
+func TestTrail(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "cip-audit-trail-")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tdir)
+
+	trail, err := OpenTrail(filepath.Join(tdir, "trail.jsonl"))
+	if err != nil {
+		t.Fatalf("could not open trail: %v", err)
+	}
+
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	records := []Record{
+		{
+			Time:      t0,
+			MessageID: "1",
+			Payload: reg.GCRPubSubPayload{
+				Action: "INSERT",
+				Digest: "us.gcr.io/prod/foo@sha256:0000000000000000000000000000000000000000000000000000000000000000",
+				Tag:    "us.gcr.io/prod/foo:1.0",
+			},
+			ManifestCommit: "abc",
+			ManifestFile:   "manifests/foo/promoter-manifest.yaml",
+			Image:          "foo",
+			Verdict:        VerdictVerified,
+			Reason:         "agrees with manifest",
+		},
+		{
+			Time:      t0.Add(time.Hour),
+			MessageID: "2",
+			Payload: reg.GCRPubSubPayload{
+				Action: "INSERT",
+				Digest: "us.gcr.io/prod/foo@sha256:1111111111111111111111111111111111111111111111111111111111111111",
+			},
+			ManifestCommit: "abc",
+			Verdict:        VerdictRejected,
+			Reason:         "could not validate",
+		},
+	}
+	for i := range records {
+		if err := trail.Append(&records[i]); err != nil {
+			t.Fatalf("could not append to trail: %v", err)
+		}
+	}
+
+	var tests = []struct {
+		name     string
+		query    RecordQuery
+		expected []Record
+	}{
+		{
+			"Everything",
+			RecordQuery{},
+			records,
+		},
+		{
+			"By bare digest",
+			RecordQuery{
+				Digest: "sha256:0000000000000000000000000000000000000000000000000000000000000000",
+			},
+			records[:1],
+		},
+		{
+			"By FQIN",
+			RecordQuery{
+				Digest: "us.gcr.io/prod/foo@sha256:1111111111111111111111111111111111111111111111111111111111111111",
+			},
+			records[1:],
+		},
+		{
+			"By verdict",
+			RecordQuery{Verdict: VerdictRejected},
+			records[1:],
+		},
+		{
+			"By time",
+			RecordQuery{Since: t0.Add(time.Minute)},
+			records[1:],
+		},
+		{
+			"No match",
+			RecordQuery{MessageID: "3"},
+			[]Record{},
+		},
+	}
+
+	for _, test := range tests {
+		got, err := trail.Query(test.query)
+		if err != nil {
+			t.Fatalf("%s: could not query trail: %v", test.name, err)
+		}
+		errEqual := checkEqual(got, test.expected)
+		checkError(t, errEqual, fmt.Sprintf("checkError: test: %q\n", test.name))
+	}
+}
+
+func TestReplay(t *testing.T) {
+	mfest, err := reg.ParseManifestYAML([]byte(`registries:
+- name: gcr.io/k8s-staging-foo
+  src: true
+- name: us.gcr.io/k8s-artifacts-prod/foo
+images:
+- name: bar
+  dmap:
+    "sha256:0000000000000000000000000000000000000000000000000000000000000000": ["1.0"]
+`))
+	if err != nil {
+		t.Fatalf("could not parse manifest: %v", err)
+	}
+
+	in := `{"action":"INSERT","digest":"us.gcr.io/k8s-artifacts-prod/foo/bar@sha256:0000000000000000000000000000000000000000000000000000000000000000","tag":"us.gcr.io/k8s-artifacts-prod/foo/bar:1.0"}
+
+{"action":"INSERT","digest":"us.gcr.io/k8s-artifacts-prod/foo/bar@sha256:1111111111111111111111111111111111111111111111111111111111111111"}
+{"action":"DELETE","digest":"us.gcr.io/k8s-artifacts-prod/foo/bar@sha256:0000000000000000000000000000000000000000000000000000000000000000"}
+`
+	var out strings.Builder
+	rejected, err := Replay([]reg.Manifest{mfest}, strings.NewReader(in), &out)
+	if err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+
+	errEqual := checkEqual(rejected, 2)
+	checkError(t, errEqual, "checkError: test: rejected count\n")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	expected := []string{
+		"(line 1) TRANSACTION VERIFIED: ",
+		"(line 3) TRANSACTION REJECTED: ",
+		"(line 4) TRANSACTION REJECTED: ",
+	}
+	errEqual = checkEqual(len(lines), len(expected))
+	checkError(t, errEqual, "checkError: test: number of verdicts\n")
+	for i := range expected {
+		if i >= len(lines) || !strings.HasPrefix(lines[i], expected[i]) {
+			t.Errorf("verdict %d: expected prefix %q, got %q",
+				i, expected[i], lines[i])
+		}
+	}
+
+	_, err = Replay(nil, strings.NewReader("{not json}\n"), &out)
+	if err == nil {
+		t.Error("expected error for malformed input")
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "cip-audit-readyz-")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tdir)
+
+	s := ServerContext{
+		RepoURL:             &url.URL{},
+		ThinManifestDirPath: filepath.Join(tdir, "does-not-exist"),
+	}
+	handler := s.Handler()
+
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+
+	errEqual := checkEqual(get("/healthz"), http.StatusOK)
+	checkError(t, errEqual, "checkError: test: healthz\n")
+
+	// The manifests cannot be loaded, so we are not ready.
+	s.preloadManifests()
+	errEqual = checkEqual(get("/readyz"), http.StatusServiceUnavailable)
+	checkError(t, errEqual, "checkError: test: readyz (not loaded)\n")
+
+	files := map[string]string{
+		"manifests/foo/promoter-manifest.yaml": `registries:
+- name: gcr.io/k8s-staging-foo
+  src: true
+- name: us.gcr.io/k8s-artifacts-prod/foo
+imagesPath: "../../images/foo/images.yaml"
+`,
+		"images/foo/images.yaml": `- name: bar
+  dmap:
+    "sha256:0000000000000000000000000000000000000000000000000000000000000000": ["1.0"]
+`,
+	}
+	for name, content := range files {
+		path := filepath.Join(tdir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("could not create dir: %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("could not write %s: %v", name, err)
+		}
+	}
+	s.ThinManifestDirPath = tdir
+	s.preloadManifests()
+	errEqual = checkEqual(get("/readyz"), http.StatusOK)
+	checkError(t, errEqual, "checkError: test: readyz (loaded)\n")
+}
+
+func TestReconciliationOverlap(t *testing.T) {
+	// Pretend that a sweep is already running.
+	s := &ServerContext{reconciling: 1}
+
+	err := s.RunReconciliation()
+	errEqual := checkEqual(err, ErrReconciliationRunning)
+	checkError(t, errEqual, "checkError: test: RunReconciliation\n")
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/reconcile", nil))
+	errEqual = checkEqual(w.Code, http.StatusConflict)
+	checkError(t, errEqual, "checkError: test: /reconcile\n")
+
+	// The periodic sweeps stop once the context is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		s.reconcileEvery(ctx, time.Millisecond)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("reconcileEvery did not stop")
+	}
+}
+
+func TestManifestCache(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "cip-audit-cache-")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tdir)
+
+	repo, err := git.PlainInit(tdir, false)
+	if err != nil {
+		t.Fatalf("could not create repo: %v", err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatalf("could not get worktree: %v", err)
+	}
+	commit := func(files map[string]string) {
+		for name, content := range files {
+			path := filepath.Join(tdir, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatalf("could not create dir: %v", err)
+			}
+			if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatalf("could not write %s: %v", name, err)
+			}
+			if _, err := wt.Add(name); err != nil {
+				t.Fatalf("could not add %s: %v", name, err)
+			}
+		}
+		_, err := wt.Commit("update", &git.CommitOptions{
+			Author: &object.Signature{Name: "test", When: time.Now()},
+		})
+		if err != nil {
+			t.Fatalf("could not commit: %v", err)
+		}
+	}
+
+	images := `- name: bar
+  dmap:
+    "sha256:0000000000000000000000000000000000000000000000000000000000000000": ["1.0"]
+`
+	commit(map[string]string{
+		"manifests/foo/promoter-manifest.yaml": `registries:
+- name: gcr.io/k8s-staging-foo
+  src: true
+- name: us.gcr.io/k8s-artifacts-prod/foo
+imagesPath: "../../images/foo/images.yaml"
+`,
+		"images/foo/images.yaml": images,
+	})
+
+	s := ServerContext{
+		RepoURL:             &url.URL{Scheme: "file", Path: tdir},
+		RepoBranch:          "master",
+		ThinManifestDirPath: ".",
+	}
+	get := func() ([]reg.Manifest, string) {
+		manifests, _, sha, err := s.getManifests()
+		if err != nil {
+			t.Fatalf("could not get manifests: %v", err)
+		}
+		if len(manifests) != 1 || len(sha) == 0 {
+			t.Fatalf("unexpected manifests %v at %q", manifests, sha)
+		}
+		return manifests, sha
+	}
+
+	// The same commit is not cloned (nor parsed) again.
+	manifests1, sha1 := get()
+	manifests2, sha2 := get()
+	errEqual := checkEqual(sha2, sha1)
+	checkError(t, errEqual, "checkError: test: same commit\n")
+	if &manifests1[0] != &manifests2[0] {
+		t.Error("manifests were loaded again for the same commit")
+	}
+
+	commit(map[string]string{
+		"images/foo/images.yaml": images + `- name: baz
+  dmap:
+    "sha256:1111111111111111111111111111111111111111111111111111111111111111": ["1.0"]
+`,
+	})
+	manifests3, sha3 := get()
+	if sha3 == sha1 {
+		t.Error("the new commit was not loaded")
 	}
+	errEqual = checkEqual(len(manifests3[0].Images), 2)
+	checkError(t, errEqual, "checkError: test: new commit\n")
 }
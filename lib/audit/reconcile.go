@@ -0,0 +1,187 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/errorreporting"
+	"cloud.google.com/go/logging"
+	"k8s.io/klog"
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+)
+
+// ReconcileRegistries performs a full reconciliation sweep. Unlike Audit(),
+// which only looks at a single GCR state change, it reads the destination
+// registries in their entirety and compares them against the promoter
+// manifests. This catches drift that was never announced over Pub/Sub (e.g.,
+// a dropped message, or changes made outside of the promoter).
+func (s *ServerContext) ReconcileRegistries() (
+	[]reg.ReconciliationReport, error) {
+
+	manifests, _, _, err := s.getManifests()
+	if err != nil {
+		return nil, err
+	}
+
+	edges, err := reg.ToPromotionEdges(manifests)
+	if err != nil {
+		return nil, err
+	}
+
+	sc, err := reg.MakeSyncContext(
+		manifests,
+		// verbosity
+		2,
+		// threads
+		10,
+		// dry run (we only ever read from registries here)
+		true,
+		// useServiceAccount
+		false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the destination registries recursively, because we want to find
+	// images that are not mentioned by any manifest.
+	dstRegistries := make([]reg.RegistryContext, 0)
+	for _, rc := range sc.RegistryContexts {
+		if !rc.Src {
+			dstRegistries = append(dstRegistries, rc)
+		}
+	}
+	sc.ReadRegistries(dstRegistries, true, reg.MkReadRepositoryCmdReal)
+
+	// Only read those source repositories that are mentioned by the manifests.
+	// This is all we need to tell apart LOST images from those that just
+	// haven't been promoted yet.
+	srcRepos := make(map[reg.RegistryContext]interface{})
+	for edge := range edges {
+		rc := edge.SrcRegistry
+		rc.Name = rc.Name + "/" + reg.RegistryName(edge.SrcImageTag.ImageName)
+		srcRepos[rc] = nil
+	}
+	srcRegistries := make([]reg.RegistryContext, 0, len(srcRepos))
+	for rc := range srcRepos {
+		srcRegistries = append(srcRegistries, rc)
+	}
+	sc.ReadRegistries(srcRegistries, false, reg.MkReadRepositoryCmdReal)
+
+	// If we could not read some repositories, the inventory is incomplete and
+	// the comparison below would report bogus discrepancies.
+	if len(sc.InvIgnore) > 0 {
+		return nil, fmt.Errorf(
+			"could not read all repositories: %v", sc.InvIgnore)
+	}
+
+	// Child images of manifest lists are promoted implicitly along with their
+	// parents, so we need to know about them to avoid flagging them.
+	sc.ReadGCRManifestLists(reg.MkReadManifestListCmdReal)
+
+	return sc.Reconcile(edges), nil
+}
+
+// ErrReconciliationRunning is returned by RunReconciliation() if another
+// sweep is still running.
+var ErrReconciliationRunning = errors.New(
+	"a reconciliation sweep is already running")
+
+// RunReconciliation runs ReconcileRegistries() and logs the results. Any
+// discrepancies are also sent to Error Reporting. Sweeps do not overlap: if
+// one is already running, ErrReconciliationRunning is returned.
+func (s *ServerContext) RunReconciliation() error {
+	if !atomic.CompareAndSwapInt32(&s.reconciling, 0, 1) {
+		return ErrReconciliationRunning
+	}
+	defer atomic.StoreInt32(&s.reconciling, 0)
+
+	logInfo := s.LogClient.Logger(LogName).StandardLogger(logging.Info)
+	logError := s.LogClient.Logger(LogName).StandardLogger(logging.Error)
+
+	logInfo.Printf("(%s) RECONCILIATION STARTED", s.ID)
+
+	reports, err := s.ReconcileRegistries()
+	if err != nil {
+		logError.Printf("(%s) RECONCILIATION FAILED: %v", s.ID, err)
+		return err
+	}
+
+	dirty := 0
+	for i := range reports {
+		report := &reports[i]
+		if report.IsClean() {
+			logInfo.Printf("(%s) RECONCILIATION OK: %s", s.ID, report.Registry)
+			continue
+		}
+
+		dirty++
+		msg := fmt.Sprintf("(%s) RECONCILIATION MISMATCH: %s",
+			s.ID, report.PrettyValue())
+		logError.Println(msg)
+		s.ErrorReportingClient.Report(errorreporting.Entry{
+			Error: fmt.Errorf("%s", msg),
+		})
+	}
+
+	logInfo.Printf("(%s) RECONCILIATION FINISHED: %d of %d registries differ from the manifests",
+		s.ID, dirty, len(reports))
+
+	return nil
+}
+
+// Reconcile is the HTTP handler counterpart of RunReconciliation(). It allows
+// the sweep to be triggered externally (e.g., by Cloud Scheduler), which is
+// more reliable than an in-process timer on platforms that throttle the CPU
+// between requests, such as Cloud Run.
+func (s *ServerContext) Reconcile(w http.ResponseWriter, r *http.Request) {
+	err := s.RunReconciliation()
+	if err == ErrReconciliationRunning {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write([]byte("reconciliation finished\n"))
+}
+
+// reconcileEvery runs RunReconciliation() periodically, until ctx is done.
+func (s *ServerContext) reconcileEvery(
+	ctx context.Context,
+	interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.RunReconciliation(); err != nil {
+				klog.Errorf("reconciliation failed: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+)
+
+// Replay audits previously captured GCR state changes against the given
+// promoter manifests, without talking to Pub/Sub, Cloud Logging or any
+// registry. The input is a stream of GCRPubSubPayload JSON objects, one per
+// line; blank lines are ignored. A verdict is printed to out for every event.
+//
+// Because no registries are read, child images of manifest lists that are not
+// named in the manifests directly are always rejected.
+//
+// The number of rejected events is returned.
+func Replay(
+	manifests []reg.Manifest,
+	in io.Reader,
+	out io.Writer) (int, error) {
+
+	index := reg.MakeManifestIndex(manifests)
+	rejected := 0
+	lineNum := 0
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		lineNum++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var gcrPayload reg.GCRPubSubPayload
+		if err := json.Unmarshal(line, &gcrPayload); err != nil {
+			return rejected, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+
+		rec := Record{Payload: gcrPayload}
+		if err := ValidateGCRPubSubPayload(&gcrPayload); err != nil {
+			rec.Verdict = VerdictRejected
+			rec.Reason = err.Error()
+		} else if err := AuditPayload(
+			manifests, index, &gcrPayload, nil, &rec); err != nil {
+			return rejected, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+
+		if rec.Verdict == VerdictRejected {
+			rejected++
+		}
+
+		_, err := fmt.Fprintf(out, "(line %d) TRANSACTION %s: %v: %s\n",
+			lineNum, rec.Verdict, &gcrPayload, rec.Reason)
+		if err != nil {
+			return rejected, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return rejected, err
+	}
+
+	return rejected, nil
+}
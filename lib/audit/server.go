@@ -0,0 +1,114 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	// readTimeout bounds how long a client may take to send a request. Pub/Sub
+	// push requests are tiny, so this can be short.
+	readTimeout = 30 * time.Second
+	// writeTimeout bounds how long a single request may take from start to
+	// finish. Audits clone the manifest repo and may have to read the source
+	// registry, and reconciliation sweeps read entire registries, so be
+	// generous.
+	writeTimeout = 15 * time.Minute
+	// shutdownTimeout is how long in-flight requests are given to finish after
+	// a SIGTERM. Cloud Run only waits 10 seconds before sending SIGKILL.
+	shutdownTimeout = 9 * time.Second
+)
+
+// Handler returns the HTTP handler that serves all of the auditor's endpoints.
+func (s *ServerContext) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.Audit)
+	mux.HandleFunc("/reconcile", s.Reconcile)
+	mux.HandleFunc("/trail", s.QueryTrail)
+	mux.HandleFunc("/healthz", s.Healthz)
+	mux.HandleFunc("/readyz", s.Readyz)
+	return mux
+}
+
+// Healthz is the liveness check. It only tells whether the server is up.
+func (s *ServerContext) Healthz(w http.ResponseWriter, r *http.Request) {
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// Readyz is the readiness check. The auditor is only ready once it has
+// successfully loaded the promoter manifests at least once, because it cannot
+// verify anything without them.
+func (s *ServerContext) Readyz(w http.ResponseWriter, r *http.Request) {
+	if !s.manifestsLoaded() {
+		http.Error(w, "manifests not loaded", http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func (s *ServerContext) manifestsLoaded() bool {
+	return atomic.LoadInt32(&s.loadedManifests) == 1
+}
+
+func (s *ServerContext) setManifestsLoaded() {
+	atomic.StoreInt32(&s.loadedManifests, 1)
+}
+
+// preloadManifests loads the manifests once, so that the readiness check
+// passes without having to wait for the first Pub/Sub message.
+func (s *ServerContext) preloadManifests() {
+	if _, _, _, err := s.getManifests(); err != nil {
+		klog.Errorf("could not load manifests: %v", err)
+	}
+}
+
+// serve runs the HTTP server until it receives SIGTERM or SIGINT, at which
+// point it stops accepting new connections and waits (up to shutdownTimeout)
+// for in-flight requests to finish.
+func serve(srv *http.Server) error {
+	idle := make(chan struct{})
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+		sig := <-sigs
+		klog.Infof("Received %v; draining requests", sig)
+
+		ctx, cancel := context.WithTimeout(
+			context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			klog.Errorf("could not drain all requests: %v", err)
+		}
+		close(idle)
+	}()
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+
+	<-idle
+	return nil
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+)
+
+const (
+	// VerdictVerified is the Verdict of a Record for a GCR state change that
+	// agrees with the promoter manifests.
+	VerdictVerified = "VERIFIED"
+	// VerdictRejected is the Verdict of a Record for a GCR state change that
+	// could not be verified.
+	VerdictRejected = "REJECTED"
+)
+
+// Record is a single entry in the audit trail. It captures a decision made by
+// the auditor, along with enough context to find out why the decision was made
+// (namely, the exact revision of the promoter manifests that was used).
+type Record struct {
+	Time      time.Time            `json:"time"`
+	ServerID  string               `json:"serverID"`
+	MessageID string               `json:"messageID,omitempty"`
+	Payload   reg.GCRPubSubPayload `json:"payload"`
+	// ManifestCommit is the Git commit of the promoter manifests that were
+	// consulted. It is empty if the manifests could not be read, or if they do
+	// not live in a Git repository.
+	ManifestCommit string `json:"manifestCommit,omitempty"`
+	// ManifestFile and Image are the promoter manifest and the image within it
+	// that matched the Payload (if any).
+	ManifestFile string `json:"manifestFile,omitempty"`
+	Image        string `json:"image,omitempty"`
+	Verdict      string `json:"verdict"`
+	Reason       string `json:"reason"`
+}
+
+// RecordQuery holds the criteria for selecting Records from a Trail. Empty
+// fields match everything.
+type RecordQuery struct {
+	MessageID string
+	// Digest matches either the full FQIN of the payload's digest, or just the
+	// "sha256:..." part of it.
+	Digest string
+	// Tag matches the full PQIN of the payload's tag.
+	Tag     string
+	Verdict string
+	Since   time.Time
+}
+
+// Trail is an append-only audit trail, stored as a file of JSON lines (one
+// Record per line).
+type Trail struct {
+	mutex sync.Mutex
+	path  string
+}
+
+// OpenTrail opens (and creates, if necessary) the audit trail at the given
+// path.
+func OpenTrail(path string) (*Trail, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit trail %q: %v", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	return &Trail{path: path}, nil
+}
+
+// Append writes the given Record to the end of the Trail. The write is flushed
+// to disk before returning.
+func (t *Trail) Append(rec *Record) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	f, err := os.OpenFile(t.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Query returns all Records that match the query, in the order in which they
+// were appended.
+func (t *Trail) Query(q RecordQuery) ([]Record, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	f, err := os.Open(t.path)
+	if err != nil {
+		return nil, err
+	}
+	// nolint[errcheck]
+	defer f.Close()
+
+	records := make([]Record, 0)
+	scanner := bufio.NewScanner(f)
+	// Payloads are small, but leave some headroom for long rejection reasons.
+	// nolint[gomnd]
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("corrupt audit trail %q: %v", t.path, err)
+		}
+		if q.Matches(&rec) {
+			records = append(records, rec)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// Matches checks whether the Record satisfies all criteria of the query.
+func (q *RecordQuery) Matches(rec *Record) bool {
+	if len(q.MessageID) > 0 && rec.MessageID != q.MessageID {
+		return false
+	}
+	if len(q.Digest) > 0 &&
+		rec.Payload.Digest != q.Digest &&
+		!strings.HasSuffix(rec.Payload.Digest, "@"+q.Digest) {
+		return false
+	}
+	if len(q.Tag) > 0 && rec.Payload.Tag != q.Tag {
+		return false
+	}
+	if len(q.Verdict) > 0 && rec.Verdict != q.Verdict {
+		return false
+	}
+	if !q.Since.IsZero() && rec.Time.Before(q.Since) {
+		return false
+	}
+	return true
+}
+
+// ParseRecordQuery builds a RecordQuery out of the URL query parameters
+// "messageID", "digest", "tag", "verdict" and "since" (RFC 3339).
+func ParseRecordQuery(r *http.Request) (RecordQuery, error) {
+	params := r.URL.Query()
+	q := RecordQuery{
+		MessageID: params.Get("messageID"),
+		Digest:    params.Get("digest"),
+		Tag:       params.Get("tag"),
+		Verdict:   strings.ToUpper(params.Get("verdict")),
+	}
+	if since := params.Get("since"); len(since) > 0 {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return q, fmt.Errorf("invalid value for since: %v", err)
+		}
+		q.Since = t
+	}
+	return q, nil
+}
+
+// QueryTrail is the HTTP handler for querying the audit trail. The matching
+// Records are returned as a JSON array.
+func (s *ServerContext) QueryTrail(w http.ResponseWriter, r *http.Request) {
+	if s.Trail == nil {
+		http.Error(w, "audit trail is not enabled", http.StatusNotFound)
+		return
+	}
+
+	q, err := ParseRecordQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	records, err := s.Trail.Query(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(records)
+}
@@ -0,0 +1,227 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"encoding/json"
+	"sort"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// RegistryDiff describes how two registries (or a registry and the intent of
+// the promoter manifests for it), Left and Right, differ.
+type RegistryDiff struct {
+	Left  string `json:"left" yaml:"left"`
+	Right string `json:"right" yaml:"right"`
+
+	// MissingImages are images that are only in Right.
+	MissingImages []ImageName `json:"missingImages,omitempty" yaml:"missingImages,omitempty"`
+	// ExtraImages are images that are only in Left.
+	ExtraImages []ImageName `json:"extraImages,omitempty" yaml:"extraImages,omitempty"`
+
+	// MissingDigests are digests that are only in Right (of the images that
+	// are in both).
+	MissingDigests []DiffDigest `json:"missingDigests,omitempty" yaml:"missingDigests,omitempty"`
+	// ExtraDigests are digests that are only in Left (of the images that are
+	// in both).
+	ExtraDigests []DiffDigest `json:"extraDigests,omitempty" yaml:"extraDigests,omitempty"`
+
+	// MissingTags are tags that are only in Right (of the images that are in
+	// both).
+	MissingTags []DiffTag `json:"missingTags,omitempty" yaml:"missingTags,omitempty"`
+	// ExtraTags are tags that are only in Left (of the images that are in
+	// both).
+	ExtraTags []DiffTag `json:"extraTags,omitempty" yaml:"extraTags,omitempty"`
+	// DifferentTags are tags that point to different digests in Left and
+	// Right.
+	DifferentTags []DiffTag `json:"differentTags,omitempty" yaml:"differentTags,omitempty"`
+}
+
+// DiffDigest is a digest of an image in a RegistryDiff, along with what the
+// registry that has it reports about it, if known (see AddDigestInfo()).
+type DiffDigest struct {
+	Image     ImageName `json:"image" yaml:"image"`
+	Digest    Digest    `json:"digest" yaml:"digest"`
+	Tags      []Tag     `json:"tags,omitempty" yaml:"tags,omitempty"`
+	MediaType string    `json:"mediaType,omitempty" yaml:"mediaType,omitempty"`
+	Size      uint64    `json:"size,omitempty" yaml:"size,omitempty"`
+	Created   string    `json:"created,omitempty" yaml:"created,omitempty"`
+	Uploaded  string    `json:"uploaded,omitempty" yaml:"uploaded,omitempty"`
+}
+
+// DiffTag is a tag of an image in a RegistryDiff, with the digests that it
+// points to on either side.
+type DiffTag struct {
+	Image       ImageName `json:"image" yaml:"image"`
+	Tag         Tag       `json:"tag" yaml:"tag"`
+	LeftDigest  Digest    `json:"leftDigest,omitempty" yaml:"leftDigest,omitempty"`
+	RightDigest Digest    `json:"rightDigest,omitempty" yaml:"rightDigest,omitempty"`
+}
+
+// Diff compares two RegInvImages (named left and right, for the report). The
+// digests and tags of images that are on one side only are not listed
+// individually.
+func Diff(left, right string, a, b RegInvImage) RegistryDiff {
+	d := RegistryDiff{Left: left, Right: right}
+
+	for imageName := range b.Minus(a) {
+		d.MissingImages = append(d.MissingImages, imageName)
+	}
+	for imageName := range a.Minus(b) {
+		d.ExtraImages = append(d.ExtraImages, imageName)
+	}
+	sort.Slice(d.MissingImages, func(i, j int) bool {
+		return d.MissingImages[i] < d.MissingImages[j]
+	})
+	sort.Slice(d.ExtraImages, func(i, j int) bool {
+		return d.ExtraImages[i] < d.ExtraImages[j]
+	})
+
+	// Only compare the digests and tags of the images on both sides.
+	common := a.Intersection(b)
+	aCommon := make(RegInvImage)
+	bCommon := make(RegInvImage)
+	for imageName := range common {
+		aCommon[imageName] = a[imageName]
+		bCommon[imageName] = b[imageName]
+	}
+
+	aDigests := aCommon.ToRegInvImageDigest()
+	bDigests := bCommon.ToRegInvImageDigest()
+	d.MissingDigests = toDiffDigests(bDigests.Minus(aDigests))
+	d.ExtraDigests = toDiffDigests(aDigests.Minus(bDigests))
+
+	aTags := aCommon.ToRegInvImageTag()
+	bTags := bCommon.ToRegInvImageTag()
+	for imageTag, digest := range bTags.Minus(aTags) {
+		d.MissingTags = append(d.MissingTags, DiffTag{
+			Image:       imageTag.ImageName,
+			Tag:         imageTag.Tag,
+			RightDigest: digest,
+		})
+	}
+	for imageTag, digest := range aTags.Minus(bTags) {
+		d.ExtraTags = append(d.ExtraTags, DiffTag{
+			Image:      imageTag.ImageName,
+			Tag:        imageTag.Tag,
+			LeftDigest: digest,
+		})
+	}
+	for imageTag, digest := range aTags.Intersection(bTags) {
+		if other := bTags[imageTag]; other != digest {
+			d.DifferentTags = append(d.DifferentTags, DiffTag{
+				Image:       imageTag.ImageName,
+				Tag:         imageTag.Tag,
+				LeftDigest:  digest,
+				RightDigest: other,
+			})
+		}
+	}
+	sortDiffTags(d.MissingTags)
+	sortDiffTags(d.ExtraTags)
+	sortDiffTags(d.DifferentTags)
+
+	return d
+}
+
+func toDiffDigests(riid RegInvImageDigest) []DiffDigest {
+	var digests []DiffDigest
+	for imageDigest, tags := range riid {
+		sorted := append([]Tag{}, tags...)
+		sort.Slice(sorted, func(i, j int) bool {
+			return sorted[i] < sorted[j]
+		})
+		if len(sorted) == 0 {
+			sorted = nil
+		}
+		digests = append(digests, DiffDigest{
+			Image:  imageDigest.ImageName,
+			Digest: imageDigest.Digest,
+			Tags:   sorted,
+		})
+	}
+	sort.Slice(digests, func(i, j int) bool {
+		if digests[i].Image != digests[j].Image {
+			return digests[i].Image < digests[j].Image
+		}
+		return digests[i].Digest < digests[j].Digest
+	})
+	return digests
+}
+
+func sortDiffTags(tags []DiffTag) {
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Image != tags[j].Image {
+			return tags[i].Image < tags[j].Image
+		}
+		return tags[i].Tag < tags[j].Tag
+	})
+}
+
+// AddDigestInfo annotates the digests that are only on one side with their
+// DigestInfo, from left for ExtraDigests and from right for MissingDigests.
+// Either map may be nil (e.g. if that side is read from manifests).
+func (d *RegistryDiff) AddDigestInfo(left, right RegInvDigestInfo) {
+	addDigestInfo(d.ExtraDigests, left)
+	addDigestInfo(d.MissingDigests, right)
+}
+
+func addDigestInfo(digests []DiffDigest, info RegInvDigestInfo) {
+	for i := range digests {
+		digestInfo, ok := info[ImageDigest{
+			ImageName: digests[i].Image,
+			Digest:    digests[i].Digest,
+		}]
+		if !ok {
+			continue
+		}
+		digests[i].MediaType = string(digestInfo.MediaType)
+		digests[i].Size = digestInfo.Size
+		digests[i].Created = formatSnapshotTime(digestInfo.Created)
+		digests[i].Uploaded = formatSnapshotTime(digestInfo.Uploaded)
+	}
+}
+
+// IsEmpty returns true if there are no differences.
+func (d *RegistryDiff) IsEmpty() bool {
+	return len(d.MissingImages) == 0 &&
+		len(d.ExtraImages) == 0 &&
+		len(d.MissingDigests) == 0 &&
+		len(d.ExtraDigests) == 0 &&
+		len(d.MissingTags) == 0 &&
+		len(d.ExtraTags) == 0 &&
+		len(d.DifferentTags) == 0
+}
+
+// ToYAML displays a RegistryDiff as YAML.
+func (d *RegistryDiff) ToYAML() (string, error) {
+	b, err := yaml.Marshal(d)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// ToJSON displays a RegistryDiff as JSON.
+func (d *RegistryDiff) ToJSON() (string, error) {
+	b, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b) + "\n", nil
+}
@@ -0,0 +1,328 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/util/version"
+)
+
+// TagSelector decides whether a tag (and the digest it points to) should be
+// put in a generated manifest.
+type TagSelector func(tag Tag) bool
+
+// MkTagRegexSelector creates a TagSelector that selects the tags matched by
+// the regular expression expr. The match is not anchored; use "^...$" to
+// match whole tags.
+func MkTagRegexSelector(expr string) (TagSelector, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tag regex %q: %v", expr, err)
+	}
+	return func(tag Tag) bool {
+		return re.MatchString(string(tag))
+	}, nil
+}
+
+// semverConstraint is a single comparison of a semver range, like ">=1.2.0".
+type semverConstraint struct {
+	op      string
+	version *version.Version
+}
+
+// semverOps are the supported comparison operators, longest first (so that
+// ">=" is not mistaken for ">").
+var semverOps = []string{">=", "<=", "!=", ">", "<", "="}
+
+func (c semverConstraint) matches(v *version.Version) bool {
+	cmp, err := v.Compare(c.version.String())
+	if err != nil {
+		return false
+	}
+
+	switch c.op {
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	default:
+		return cmp == 0
+	}
+}
+
+// MkTagSemverSelector creates a TagSelector that selects the tags that are
+// semantic versions (with an optional leading "v") within the range rng. A
+// range is a space-separated list of comparisons that must all hold, such as
+// ">=1.2.0 <2.0.0"; several ranges can be joined with "||". The supported
+// operators are =, !=, <, <=, > and >= (a version without an operator must
+// match exactly). Pre-releases are ordered as in semver, so "v1.3.0-rc.1"
+// is within ">=1.2.0".
+func MkTagSemverSelector(rng string) (TagSelector, error) {
+	var alternatives [][]semverConstraint
+	for _, alternative := range strings.Split(rng, "||") {
+		var constraints []semverConstraint
+		for _, field := range strings.Fields(alternative) {
+			c := semverConstraint{op: "="}
+			for _, op := range semverOps {
+				if strings.HasPrefix(field, op) {
+					c.op = op
+					field = strings.TrimPrefix(field, op)
+					break
+				}
+			}
+
+			v, err := version.ParseSemantic(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid semver range %q: %v", rng, err)
+			}
+			c.version = v
+			constraints = append(constraints, c)
+		}
+		if len(constraints) == 0 {
+			return nil, fmt.Errorf("invalid semver range %q: empty range", rng)
+		}
+		alternatives = append(alternatives, constraints)
+	}
+
+	return func(tag Tag) bool {
+		v, err := version.ParseSemantic(string(tag))
+		if err != nil {
+			return false
+		}
+		for _, constraints := range alternatives {
+			matched := true
+			for _, c := range constraints {
+				if !c.matches(v) {
+					matched = false
+					break
+				}
+			}
+			if matched {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// SelectImages converts a RegInvImage into Images, keeping only the images
+// whose name matches imageGlob (like path.Match; an empty glob matches every
+// image), and only the tags selected by selectTag. Digests without any
+// selected tag are dropped. The images are sorted by name.
+func SelectImages(
+	rii RegInvImage,
+	imageGlob string,
+	selectTag TagSelector) (Images, error) {
+
+	if _, err := path.Match(imageGlob, ""); err != nil {
+		return nil, fmt.Errorf("invalid image glob %q: %v", imageGlob, err)
+	}
+
+	images := make(Images, 0)
+	for imageName, digestTags := range rii {
+		if imageGlob != "" {
+			// nolint[errcheck]
+			if matched, _ := path.Match(imageGlob, string(imageName)); !matched {
+				continue
+			}
+		}
+
+		dmap := make(DigestTags)
+		for digest, tags := range digestTags {
+			var selected TagSlice
+			for _, tag := range tags {
+				if selectTag(tag) {
+					selected = append(selected, tag)
+				}
+			}
+			if len(selected) > 0 {
+				sort.Slice(selected, func(i, j int) bool {
+					return selected[i] < selected[j]
+				})
+				dmap[digest] = selected
+			}
+		}
+		if len(dmap) > 0 {
+			images = append(images, Image{ImageName: imageName, Dmap: dmap})
+		}
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].ImageName < images[j].ImageName
+	})
+	return images, nil
+}
+
+// OrderedImages are like Images, but they keep the order of the digests of
+// each image (the Dmap of an Image is a map), so that an existing images file
+// can be added to without reordering it (see MergeImages()).
+type OrderedImages []ImageWithDigestSlice
+
+// ParseOrderedImagesFromFile parses OrderedImages from a file.
+func ParseOrderedImagesFromFile(filePath string) (OrderedImages, error) {
+	b, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseOrderedImagesYAML(b)
+}
+
+// ParseOrderedImagesYAML parses OrderedImages from a byteslice, in the format
+// of ParseImagesYAML().
+func ParseOrderedImagesYAML(b []byte) (OrderedImages, error) {
+	images, err := ParseImagesYAML(b)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the digests again, only to find out their order.
+	var order []struct {
+		Dmap yaml.MapSlice `yaml:"dmap"`
+	}
+	if err := yaml.Unmarshal(b, &order); err != nil {
+		return nil, err
+	}
+
+	ordered := make(OrderedImages, 0, len(images))
+	for i, image := range images {
+		orderedImage := ImageWithDigestSlice{name: string(image.ImageName)}
+		for _, item := range order[i].Dmap {
+			hash := fmt.Sprint(item.Key)
+			var tags []string
+			for _, tag := range image.Dmap[Digest(hash)] {
+				tags = append(tags, string(tag))
+			}
+			orderedImage.digests = append(
+				orderedImage.digests,
+				digest{hash: hash, tags: tags})
+		}
+		ordered = append(ordered, orderedImage)
+	}
+
+	return ordered, nil
+}
+
+// MergeImages adds the digests and tags in generated to existing. Nothing in
+// existing is removed or reordered: new images are appended in the order of
+// generated, new digests are appended (sorted) to the digests of their image,
+// and new tags are appended to the tags of their digest. It is an error for
+// generated to have a tag that points to a different digest in existing,
+// because promoted tags must never be retargeted; nothing is merged in that
+// case.
+func MergeImages(
+	existing OrderedImages,
+	generated Images) (OrderedImages, error) {
+
+	merged := make(OrderedImages, 0, len(existing)+len(generated))
+	indices := make(map[ImageName]int)
+	for _, image := range existing {
+		digests := make([]digest, 0, len(image.digests))
+		for _, d := range image.digests {
+			digests = append(digests, digest{
+				hash: d.hash,
+				tags: append([]string{}, d.tags...),
+			})
+		}
+		indices[ImageName(image.name)] = len(merged)
+		merged = append(merged, ImageWithDigestSlice{
+			name:    image.name,
+			digests: digests,
+		})
+	}
+
+	var conflicts []string
+	for _, image := range generated {
+		i, found := indices[image.ImageName]
+		if !found {
+			indices[image.ImageName] = len(merged)
+			merged = append(merged, ImageWithDigestSlice{
+				name: string(image.ImageName),
+			})
+			i = len(merged) - 1
+		}
+		mergedImage := &merged[i]
+
+		digestIndices := make(map[string]int)
+		tagDigests := make(map[string]string)
+		for j, d := range mergedImage.digests {
+			digestIndices[d.hash] = j
+			for _, tag := range d.tags {
+				tagDigests[tag] = d.hash
+			}
+		}
+
+		// Go through the digests in order, so that new digests (and the
+		// conflicts) are in a deterministic order.
+		hashes := make([]string, 0, len(image.Dmap))
+		for hash := range image.Dmap {
+			hashes = append(hashes, string(hash))
+		}
+		sort.Strings(hashes)
+
+		for _, hash := range hashes {
+			j, ok := digestIndices[hash]
+			if !ok {
+				j = len(mergedImage.digests)
+				digestIndices[hash] = j
+				mergedImage.digests = append(
+					mergedImage.digests,
+					digest{hash: hash, tags: []string{}})
+			}
+			for _, tag := range image.Dmap[Digest(hash)] {
+				existingHash, tagged := tagDigests[string(tag)]
+				if tagged && existingHash != hash {
+					conflicts = append(conflicts, fmt.Sprintf(
+						"%s:%s points to %s, refusing to retarget it to %s",
+						image.ImageName, tag, existingHash, hash))
+					continue
+				}
+				if !tagged {
+					tagDigests[string(tag)] = hash
+					mergedImage.digests[j].tags = append(
+						mergedImage.digests[j].tags, string(tag))
+				}
+			}
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return nil, fmt.Errorf(
+			"cannot merge images:\n%s", strings.Join(conflicts, "\n"))
+	}
+
+	return merged, nil
+}
+
+// ToYAML displays OrderedImages as YAML, like RegInvImage.ToYAML() but in
+// their own order.
+func (images OrderedImages) ToYAML() string {
+	return imagesToYAML(images)
+}
@@ -67,8 +67,7 @@ func MakeSyncContext(
 		InvIgnore:         []ImageName{},
 		Tokens:            make(map[RootRepo]gcloud.Token),
 		RegistryContexts:  make([]RegistryContext, 0),
-		DigestMediaType:   make(DigestMediaType),
-		ParentDigest:      make(ParentDigest)}
+		DigestInfo:        make(MasterDigestInfo)}
 
 	registriesSeen := make(map[RegistryContext]interface{})
 	for _, mfest := range mfests {
@@ -501,7 +500,7 @@ func (sc *SyncContext) getPromotionCandidates(
 				}
 			} else {
 				// Pqin points to the wrong digest.
-				klog.Warningf("edge %v: tag %s points to the wrong digest; moving\n, dp.BadDigest")
+				klog.Warningf("edge %v: tag %s points to the wrong digest (%s); moving\n", edge, edge.DstImageTag.Tag, dp.BadDigest)
 			}
 		} else {
 			if dp.DigestExists {
@@ -1000,7 +999,7 @@ func getGCRManifestListWrapper(
 			return true, nil
 		}
 		// nolint[lll]
-		klog.Errorf("invalid gcrManifestList state: %s for request %s", gcrManifestList, req)
+		klog.Errorf("invalid gcrManifestList state: %v for request %v", gcrManifestList, req)
 		return false, nil
 	}
 
@@ -1257,6 +1256,7 @@ func (sc *SyncContext) ReadRegistries(
 			// Process the current repo.
 			rName := req.RequestParams.(RegistryContext).Name
 			digestTags := make(DigestTags)
+			digestInfo := make(map[Digest]DigestInfo)
 
 			for digest, mfestInfo := range tagsStruct.Manifests {
 				tagSlice := TagSlice{}
@@ -1265,14 +1265,16 @@ func (sc *SyncContext) ReadRegistries(
 				}
 				digestTags[Digest(digest)] = tagSlice
 
-				// Store MediaType.
-				mutex.Lock()
 				mediaType, err := supportedMediaType(mfestInfo.MediaType)
 				if err != nil {
 					fmt.Printf("digest %s: %s\n", digest, err)
 				}
-				sc.DigestMediaType[Digest(digest)] = mediaType
-				mutex.Unlock()
+				digestInfo[Digest(digest)] = DigestInfo{
+					MediaType: mediaType,
+					Size:      mfestInfo.Size,
+					Created:   mfestInfo.Created,
+					Uploaded:  mfestInfo.Uploaded,
+				}
 			}
 
 			// Only write an entry into our inventory if the entry has some
@@ -1296,6 +1298,19 @@ func (sc *SyncContext) ReadRegistries(
 				} else {
 					sc.Inv[rootReg][imageName] = digestTags
 				}
+				if sc.DigestInfo == nil {
+					sc.DigestInfo = make(MasterDigestInfo)
+				}
+				if sc.DigestInfo[rootReg] == nil {
+					sc.DigestInfo[rootReg] = make(RegInvDigestInfo)
+				}
+				for digest, info := range digestInfo {
+					imageDigest := ImageDigest{
+						ImageName: imageName,
+						Digest:    digest,
+					}
+					sc.DigestInfo[rootReg][imageDigest] = info
+				}
 				mutex.Unlock()
 			}
 
@@ -1340,10 +1355,11 @@ func (sc *SyncContext) ReadRegistries(
 	sc.ExecRequests(populateRequests, processRequest)
 }
 
-// ReadGCRManifestLists reads all manifest lists and populates the ParentDigest
-// field of the SyncContext. ParentDigest is a map of values of the form
-// map[ChildDigest]ParentDigest; and so, if a digest has an entry in this map,
-// it is referenced by a parent DockerManifestList.
+// ReadGCRManifestLists reads all manifest lists and populates the
+// ManifestListParents field of the SyncContext; if a digest of an image has an
+// entry in it, it is referenced by a parent manifest list of the same image (in
+// the same registry). The manifest lists that cannot be read are added to
+// UnreadManifestLists.
 //
 // TODO: Combine this function with ReadRegistries().
 //
@@ -1358,7 +1374,7 @@ func (sc *SyncContext) ReadGCRManifestLists(
 		reqs chan<- stream.ExternalRequest,
 		wg *sync.WaitGroup) {
 
-		// Find all images that are of ggcrV1Types.MediaType == DockerManifestList; these
+		// Find all images that are manifest lists (see IsManifestList()); these
 		// images will be queried.
 		for registryName, rii := range sc.Inv {
 			var rc RegistryContext
@@ -1369,7 +1385,8 @@ func (sc *SyncContext) ReadGCRManifestLists(
 			}
 			for imageName, digestTags := range rii {
 				for digest, tagSlice := range digestTags {
-					if sc.DigestMediaType[digest] == ggcrV1Types.DockerManifestList {
+					info, _ := sc.GetDigestInfo(registryName, imageName, digest)
+					if IsManifestList(info.MediaType) {
 						// Create the request.
 						var req stream.ExternalRequest
 						var tag Tag
@@ -1413,6 +1430,11 @@ func (sc *SyncContext) ReadGCRManifestLists(
 					Error{
 						Context: "getGCRManifestListWrapper",
 						Error:   err}}
+				mutex.Lock()
+				sc.UnreadManifestLists = append(
+					sc.UnreadManifestLists,
+					req.RequestParams.(GCRManifestListContext))
+				mutex.Unlock()
 				requestResults <- reqRes
 				wg.Add(-1)
 
@@ -1422,8 +1444,9 @@ func (sc *SyncContext) ReadGCRManifestLists(
 			gmlc := req.RequestParams.(GCRManifestListContext)
 
 			for _, gManifest := range gcrManifestList.Manifests {
+				child := (Digest)((gManifest.Digest.Algorithm) + ":" + (gManifest.Digest.Hex))
 				mutex.Lock()
-				sc.ParentDigest[(Digest)((gManifest.Digest.Algorithm)+":"+(gManifest.Digest.Hex))] = gmlc.Digest
+				sc.addManifestListParent(gmlc, child)
 				mutex.Unlock()
 			}
 
@@ -1436,6 +1459,41 @@ func (sc *SyncContext) ReadGCRManifestLists(
 	sc.ExecRequests(populateRequests, processRequest)
 }
 
+// addManifestListParent records that the manifest list gmlc references child
+// in ManifestListParents.
+func (sc *SyncContext) addManifestListParent(
+	gmlc GCRManifestListContext,
+	child Digest) {
+
+	if sc.ManifestListParents == nil {
+		sc.ManifestListParents = make(map[RegistryName]ManifestListParents)
+	}
+	parents, ok := sc.ManifestListParents[gmlc.RegistryContext.Name]
+	if !ok {
+		parents = make(ManifestListParents)
+		sc.ManifestListParents[gmlc.RegistryContext.Name] = parents
+	}
+	imageDigest := ImageDigest{ImageName: gmlc.ImageName, Digest: child}
+	if parents[imageDigest] == nil {
+		parents[imageDigest] = make(map[Digest]bool)
+	}
+	parents[imageDigest][gmlc.Digest] = true
+}
+
+// GetDigestInfo returns the DigestInfo of a digest of an image in a registry,
+// as read by ReadRegistries(). It returns false if there is none.
+func (sc *SyncContext) GetDigestInfo(
+	registryName RegistryName,
+	imageName ImageName,
+	digest Digest) (DigestInfo, bool) {
+
+	info, ok := sc.DigestInfo[registryName][ImageDigest{
+		ImageName: imageName,
+		Digest:    digest,
+	}]
+	return info, ok
+}
+
 // FilterByTag removes all images in RegInvImage that do not match the
 // filterTag.
 func FilterByTag(rii RegInvImage, filterTag string) RegInvImage {
@@ -1457,13 +1515,20 @@ func FilterByTag(rii RegInvImage, filterTag string) RegInvImage {
 	return filtered
 }
 
-// RemoveChildDigestEntries removes all tagless images in RegInvImage that are
-// referenced by ManifestLists in the Registries.
-func (sc *SyncContext) RemoveChildDigestEntries(rii RegInvImage) RegInvImage {
+// RemoveChildDigestEntries removes all tagless images in RegInvImage (read from
+// registryName) that are referenced by ManifestLists of the same image.
+func (sc *SyncContext) RemoveChildDigestEntries(
+	registryName RegistryName,
+	rii RegInvImage) RegInvImage {
+
+	parents := sc.ManifestListParents[registryName]
 	filtered := make(RegInvImage)
 	for imageName, digestTags := range rii {
 		for digest, tagSlice := range digestTags {
-			_, hasParent := sc.ParentDigest[digest]
+			hasParent := len(parents[ImageDigest{
+				ImageName: imageName,
+				Digest:    digest,
+			}]) > 0
 			// If this image digest is only referenced as part of a parent
 			// ManfestList (i.e. not directly tagged), we filter it out.
 			if hasParent && len(tagSlice) == 0 {
@@ -1755,8 +1820,11 @@ func (rii *RegInvImage) ToSorted() []ImageWithDigestSlice {
 // ToYAML displays a RegInvImage as YAML, but with the map items sorted
 // alphabetically.
 func (rii *RegInvImage) ToYAML() string {
-	images := rii.ToSorted()
+	return imagesToYAML(rii.ToSorted())
+}
 
+// imagesToYAML displays images as YAML, in the given order.
+func imagesToYAML(images []ImageWithDigestSlice) string {
 	var b strings.Builder
 	for _, image := range images {
 		fmt.Fprintf(&b, "- name: %s\n", image.name)
@@ -1864,7 +1932,7 @@ func mkPopulateRequestsForPromotionEdges(
 			if dp.PqinExists {
 				if !dp.DigestExists {
 					// Pqin points to the wrong digest.
-					klog.Errorf("edge %s: tag '%s' in dest points to %s, not %s (as per the manifest), but tag moves are not supported; skipping\n", promoteMe, promoteMe.DstImageTag.Tag, dp.BadDigest, promoteMe.Digest)
+					klog.Errorf("edge %v: tag '%s' in dest points to %s, not %s (as per the manifest), but tag moves are not supported; skipping\n", promoteMe, promoteMe.DstImageTag.Tag, dp.BadDigest, promoteMe.Digest)
 					continue
 				}
 			}
@@ -1977,6 +2045,186 @@ func EdgesToRegInvImage(
 	return rii
 }
 
+// Reconcile compares the contents of every destination registry in sc.Inv
+// against the intent of the given promotion edges (see ToPromotionEdges()). It
+// does not make any network calls; sc.Inv must already be populated with the
+// destination registries (and the source repositories of the edges, to tell
+// apart LOST images from those that are merely not promoted yet). If
+// sc.ManifestListParents is populated as well, tagless child digests of manifest
+// lists are not reported as unexpected.
+//
+// nolint[gocyclo]
+func (sc *SyncContext) Reconcile(
+	edges map[PromotionEdge]interface{}) []ReconciliationReport {
+
+	// Collect the desired state of each destination registry.
+	wanted := make(MasterInventory)
+	for _, rc := range sc.RegistryContexts {
+		if !rc.Src {
+			wanted[rc.Name] = make(RegInvImage)
+		}
+	}
+	for edge := range edges {
+		rii, ok := wanted[edge.DstRegistry.Name]
+		if !ok {
+			rii = make(RegInvImage)
+			wanted[edge.DstRegistry.Name] = rii
+		}
+		imageName := edge.DstImageTag.ImageName
+		if rii[imageName] == nil {
+			rii[imageName] = make(DigestTags)
+		}
+		if len(edge.DstImageTag.Tag) > 0 {
+			rii[imageName][edge.Digest] = append(
+				rii[imageName][edge.Digest],
+				edge.DstImageTag.Tag)
+		} else if _, ok := rii[imageName][edge.Digest]; !ok {
+			rii[imageName][edge.Digest] = TagSlice{}
+		}
+	}
+
+	registryNames := make([]RegistryName, 0, len(wanted))
+	for registryName := range wanted {
+		registryNames = append(registryNames, registryName)
+	}
+	sort.Slice(registryNames, func(i, j int) bool {
+		return registryNames[i] < registryNames[j]
+	})
+
+	reports := make([]ReconciliationReport, 0, len(registryNames))
+	for _, registryName := range registryNames {
+		want := wanted[registryName]
+		got := sc.RemoveChildDigestEntries(registryName, sc.Inv[registryName])
+
+		report := ReconciliationReport{
+			Registry:          registryName,
+			UnexpectedDigests: make(RegInvImageDigest),
+			UnexpectedTags:    make(RegInvImageTag),
+			TagDrift:          make(RegInvImageTag),
+			Pending:           []PromotionEdge{},
+			Lost:              []PromotionEdge{},
+		}
+
+		// Images that no manifest knows about are unexpected in their
+		// entirety.
+		unknown := got.Minus(want)
+		for id, tags := range unknown.ToRegInvImageDigest() {
+			report.UnexpectedDigests[id] = tags
+		}
+		for it, digest := range unknown.ToRegInvImageTag() {
+			report.UnexpectedTags[it] = digest
+		}
+
+		// For images that are known, compare them digest-by-digest and
+		// tag-by-tag.
+		known := got.Intersection(want)
+		wantDigests := want.ToRegInvImageDigest()
+		for id, tags := range known.ToRegInvImageDigest().Minus(wantDigests) {
+			report.UnexpectedDigests[id] = tags
+		}
+		gotTags := known.ToRegInvImageTag()
+		wantTags := want.ToRegInvImageTag()
+		for it, digest := range gotTags.Minus(wantTags) {
+			report.UnexpectedTags[it] = digest
+		}
+		for it, digest := range gotTags.Intersection(wantTags) {
+			if digest != wantTags[it] {
+				report.TagDrift[it] = digest
+			}
+		}
+
+		// Find all promotions that have not happened yet.
+		for edge := range edges {
+			if edge.DstRegistry.Name != registryName {
+				continue
+			}
+
+			sp, dp := edge.VertexProps(sc.Inv)
+			if dp.PqinDigestMatch {
+				continue
+			}
+			if edge.DstImageTag.Tag == "" && dp.DigestExists {
+				continue
+			}
+			// The tag exists, but points elsewhere; this is already recorded
+			// as TagDrift.
+			if dp.PqinExists {
+				continue
+			}
+
+			if sp.DigestExists {
+				report.Pending = append(report.Pending, edge)
+			} else {
+				report.Lost = append(report.Lost, edge)
+			}
+		}
+		sortPromotionEdges(report.Pending)
+		sortPromotionEdges(report.Lost)
+
+		reports = append(reports, report)
+	}
+
+	return reports
+}
+
+func sortPromotionEdges(edges []PromotionEdge) {
+	key := func(edge PromotionEdge) string {
+		return ToFQIN(edge.DstRegistry.Name,
+			edge.DstImageTag.ImageName,
+			edge.Digest) + " " + string(edge.DstImageTag.Tag)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		return key(edges[i]) < key(edges[j])
+	})
+}
+
+// IsClean returns true if the registry agrees with the promoter manifests.
+func (r *ReconciliationReport) IsClean() bool {
+	return len(r.UnexpectedDigests) == 0 &&
+		len(r.UnexpectedTags) == 0 &&
+		len(r.TagDrift) == 0 &&
+		len(r.Pending) == 0 &&
+		len(r.Lost) == 0
+}
+
+// PrettyValue is a prettified string representation of a
+// ReconciliationReport. Each discrepancy is printed on its own line, sorted
+// alphabetically.
+func (r *ReconciliationReport) PrettyValue() string {
+	lines := make([]string, 0)
+	for id := range r.UnexpectedDigests {
+		lines = append(lines, fmt.Sprintf("UNEXPECTED DIGEST: %s",
+			ToFQIN(r.Registry, id.ImageName, id.Digest)))
+	}
+	for it, digest := range r.UnexpectedTags {
+		lines = append(lines, fmt.Sprintf("UNEXPECTED TAG: %s (points to %s)",
+			ToPQIN(r.Registry, it.ImageName, it.Tag), digest))
+	}
+	for it, digest := range r.TagDrift {
+		lines = append(lines, fmt.Sprintf("TAG DRIFT: %s (points to %s)",
+			ToPQIN(r.Registry, it.ImageName, it.Tag), digest))
+	}
+	for _, edge := range r.Pending {
+		lines = append(lines, fmt.Sprintf("NOT YET PROMOTED: %s (tag %q)",
+			ToFQIN(r.Registry, edge.DstImageTag.ImageName, edge.Digest),
+			edge.DstImageTag.Tag))
+	}
+	for _, edge := range r.Lost {
+		lines = append(lines, fmt.Sprintf("LOST: %s (tag %q; missing from %s)",
+			ToFQIN(r.Registry, edge.DstImageTag.ImageName, edge.Digest),
+			edge.DstImageTag.Tag,
+			edge.SrcRegistry.Name))
+	}
+	sort.Strings(lines)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s:\n", r.Registry)
+	for _, line := range lines {
+		fmt.Fprintf(&b, "  %s\n", line)
+	}
+	return b.String()
+}
+
 // getRegistriesToRead collects all unique Docker repositories we want to read
 // from. This way, we don't have to read the entire Docker registry, but only
 // those paths that we are thinking of modifying.
@@ -2168,7 +2416,9 @@ func (sc *SyncContext) PrintCapturedRequests(capReqs *CapturedRequests) {
 		fmt.Println("captured reqs summary:")
 		fmt.Println("")
 		for _, pr := range prs {
-			fmt.Printf("captured req: %v", pr.PrettyValue())
+			fmt.Printf("captured req: %v%v\n",
+				strings.TrimSuffix(pr.PrettyValue(), "\n"),
+				sc.describeDigest(&pr))
 		}
 		fmt.Println("")
 	} else {
@@ -2176,6 +2426,35 @@ func (sc *SyncContext) PrintCapturedRequests(capReqs *CapturedRequests) {
 	}
 }
 
+// describeDigest describes the image that a PromotionRequest acts on (the
+// source image, or the destination image for deletions), if its DigestInfo is
+// known. The description starts with a space, unless it is empty.
+func (sc *SyncContext) describeDigest(pr *PromotionRequest) string {
+	registryName, imageName := pr.RegistrySrc, pr.ImageNameSrc
+	if pr.TagOp == Delete {
+		registryName, imageName = pr.RegistryDest, pr.ImageNameDest
+	}
+	info, ok := sc.GetDigestInfo(registryName, imageName, pr.Digest)
+	if !ok {
+		return ""
+	}
+
+	var details []string
+	if info.MediaType != "" {
+		details = append(details, string(info.MediaType))
+	}
+	if info.Size > 0 {
+		details = append(details, fmt.Sprintf("%d bytes", info.Size))
+	}
+	if !info.Uploaded.IsZero() {
+		details = append(details, "uploaded "+formatSnapshotTime(info.Uploaded))
+	}
+	if len(details) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(details, ", ") + ")"
+}
+
 // PrettyValue is a prettified string representation of a TagOp.
 func (op *TagOp) PrettyValue() string {
 	var tagOpPretty string
@@ -2232,48 +2511,85 @@ func MkRequestCapturer(captured *CapturedRequests) ProcessRequest {
 }
 
 // GarbageCollect deletes all images that are not referenced by Docker tags.
+// Untagged manifest lists are deleted before the other untagged images, so
+// that the images they reference can be deleted in the same run.
 // nolint[gocyclo]
 func (sc *SyncContext) GarbageCollect(
 	mfest Manifest,
 	mkProducer func(RegistryContext, ImageName, Digest) stream.Producer,
 	customProcessRequest *ProcessRequest) {
 
-	var populateRequests PopulateRequests = func(
-		sc *SyncContext,
-		reqs chan<- stream.ExternalRequest,
-		wg *sync.WaitGroup) {
-
-		for _, registry := range mfest.Registries {
-			if registry.Name == sc.SrcRegistry.Name {
-				continue
+	deletions := make(map[RegistryContext][]ImageDigest)
+	for _, registry := range mfest.Registries {
+		if registry.Name == sc.SrcRegistry.Name {
+			continue
+		}
+		for imageName, digestTags := range sc.Inv[registry.Name] {
+			for digest, tagArray := range digestTags {
+				if len(tagArray) > 0 {
+					continue
+				}
+				deletions[registry] = append(
+					deletions[registry],
+					ImageDigest{ImageName: imageName, Digest: digest})
 			}
-			for imageName, digestTags := range sc.Inv[registry.Name] {
-				for digest, tagArray := range digestTags {
-					if len(tagArray) == 0 {
-						var req stream.ExternalRequest
-						req.StreamProducer = mkProducer(
-							registry,
-							imageName,
-							digest)
-						req.RequestParams = PromotionRequest{
-							Delete,
-							sc.SrcRegistry.Name,
-							registry.Name,
-							registry.ServiceAccount,
+		}
+	}
 
-							// No source image name, because tag deletions
-							// should only delete the what's in the
-							// destination registry
-							ImageName(""),
+	sc.deleteImageDigests(
+		sc.SrcRegistry.Name,
+		deletions,
+		mkProducer,
+		customProcessRequest)
+}
 
-							imageName,
-							digest,
-							"",
-							"",
-						}
-						wg.Add(1)
-						reqs <- req
+// deleteImageDigests deletes the given digests from each registry. Manifest
+// lists are deleted first, because GCR refuses to delete images that are
+// referenced by a manifest list. With DryRun, the deletions are only printed.
+// srcRegistry is only recorded in the PromotionRequests.
+func (sc *SyncContext) deleteImageDigests(
+	srcRegistry RegistryName,
+	deletions map[RegistryContext][]ImageDigest,
+	mkProducer func(RegistryContext, ImageName, Digest) stream.Producer,
+	customProcessRequest *ProcessRequest) {
+
+	populateRequestsFor := func(manifestLists bool) PopulateRequests {
+		return func(
+			sc *SyncContext,
+			reqs chan<- stream.ExternalRequest,
+			wg *sync.WaitGroup) {
+
+			for registry, imageDigests := range deletions {
+				for _, imageDigest := range imageDigests {
+					info, _ := sc.GetDigestInfo(
+						registry.Name,
+						imageDigest.ImageName,
+						imageDigest.Digest)
+					if IsManifestList(info.MediaType) != manifestLists {
+						continue
 					}
+
+					var req stream.ExternalRequest
+					req.StreamProducer = mkProducer(
+						registry,
+						imageDigest.ImageName,
+						imageDigest.Digest)
+					req.RequestParams = PromotionRequest{
+						TagOp:          Delete,
+						RegistrySrc:    srcRegistry,
+						RegistryDest:   registry.Name,
+						ServiceAccount: registry.ServiceAccount,
+
+						// No source image name, because tag deletions
+						// should only delete the what's in the
+						// destination registry
+						ImageNameSrc: ImageName(""),
+
+						ImageNameDest: imageDigest.ImageName,
+						Digest:        imageDigest.Digest,
+					}
+					wg.Add(1)
+					reqs <- req
 				}
 			}
 		}
@@ -2290,11 +2606,6 @@ func (sc *SyncContext) GarbageCollect(
 		for req := range reqs {
 			reqRes := RequestResult{Context: req}
 			jsons, errors := getJSONSFromProcess(req)
-			if len(errors) > 0 {
-				reqRes.Errors = errors
-				requestResults <- reqRes
-				continue
-			}
 			for _, json := range jsons {
 				klog.Info("DELETED image:", json)
 			}
@@ -2316,17 +2627,30 @@ func (sc *SyncContext) GarbageCollect(
 	if customProcessRequest != nil {
 		processRequest = *customProcessRequest
 	}
-	sc.ExecRequests(populateRequests, processRequest)
+	sc.ExecRequests(populateRequestsFor(true), processRequest)
+	sc.ExecRequests(populateRequestsFor(false), processRequest)
 
 	if sc.DryRun {
 		sc.PrintCapturedRequests(&captured)
 	}
 }
 
+// IsManifestList checks whether images of the given media type reference other
+// images (child manifests), i.e. whether they are Docker manifest lists or OCI
+// image indexes.
+func IsManifestList(mediaType ggcrV1Types.MediaType) bool {
+	return mediaType == ggcrV1Types.DockerManifestList ||
+		mediaType == ggcrV1Types.OCIImageIndex
+}
+
 func supportedMediaType(v string) (ggcrV1Types.MediaType, error) {
 	switch ggcrV1Types.MediaType(v) {
 	case ggcrV1Types.DockerManifestList:
 		return ggcrV1Types.DockerManifestList, nil
+	case ggcrV1Types.OCIImageIndex:
+		return ggcrV1Types.OCIImageIndex, nil
+	case ggcrV1Types.OCIManifestSchema1:
+		return ggcrV1Types.OCIManifestSchema1, nil
 	case ggcrV1Types.DockerManifestSchema1:
 		return ggcrV1Types.DockerManifestSchema1, nil
 	case ggcrV1Types.DockerManifestSchema1Signed:
@@ -2366,7 +2690,11 @@ func (sc *SyncContext) ClearRepository(
 				}
 				for imageName, digestTags := range sc.Inv[registry.Name] {
 					for digest := range digestTags {
-						mediaType, ok := sc.DigestMediaType[digest]
+						info, ok := sc.GetDigestInfo(
+							registry.Name,
+							imageName,
+							digest)
+						mediaType := info.MediaType
 						if !ok {
 							fmt.Println("could not detect MediaType of digest", digest)
 							continue
@@ -2444,24 +2772,17 @@ func (sc *SyncContext) ClearRepository(
 		processRequest = *customProcessRequest
 	}
 
-	var isEqualTo (func(ggcrV1Types.MediaType) func(ggcrV1Types.MediaType) bool) = func(want ggcrV1Types.MediaType) func(ggcrV1Types.MediaType) bool {
-		return func(got ggcrV1Types.MediaType) bool {
-			return want == got
-		}
-	}
-
-	var isNotEqualTo (func(ggcrV1Types.MediaType) func(ggcrV1Types.MediaType) bool) = func(want ggcrV1Types.MediaType) func(ggcrV1Types.MediaType) bool {
+	var isNot (func(func(ggcrV1Types.MediaType) bool) func(ggcrV1Types.MediaType) bool) = func(predicate func(ggcrV1Types.MediaType) bool) func(ggcrV1Types.MediaType) bool {
 		return func(got ggcrV1Types.MediaType) bool {
-			return want != got
+			return !predicate(got)
 		}
 	}
 
 	// Avoid the GCR error that complains if you try to delete an image which is
-	// referenced by a DockerManifestList, by first deleting all such manifest
-	// lists.
-	deleteManifestLists := deleteRequestsPopulator(isEqualTo(ggcrV1Types.DockerManifestList))
+	// referenced by a manifest list, by first deleting all such manifest lists.
+	deleteManifestLists := deleteRequestsPopulator(IsManifestList)
 	sc.ExecRequests(deleteManifestLists, processRequest)
-	deleteOthers := deleteRequestsPopulator(isNotEqualTo(ggcrV1Types.DockerManifestList))
+	deleteOthers := deleteRequestsPopulator(isNot(IsManifestList))
 	sc.ExecRequests(deleteOthers, processRequest)
 
 	if sc.DryRun {
@@ -2528,41 +2849,94 @@ func GetDeleteCmd(
 }
 
 // Contains checks whether a given Manifest mentions the contents of a
-// gcrPayload (re-interpreted as a FQIN or PQIN).
-// nolint[gocyclo]
+// gcrPayload (re-interpreted as a FQIN or PQIN), with the same rules as
+// ManifestIndex.Lookup(). If many lookups are needed, build a ManifestIndex
+// with MakeManifestIndex() once instead.
 func (m Manifest) Contains(gcrPayload GCRPubSubPayload) bool {
-	fqinOnly := len(gcrPayload.Tag) == 0
-
 	for _, rc := range m.Registries {
 		if rc.Src {
 			continue
 		}
-		// Speed up the search by skipping over registry names whose leading
-		// characters do not match.
-		if !strings.HasPrefix(gcrPayload.Digest, (string)(rc.Name)) {
-			continue
+		for _, image := range m.Images {
+			for digest, tags := range image.Dmap {
+				if ToFQIN(rc.Name, image.ImageName, digest) != gcrPayload.Digest {
+					continue
+				}
+				if len(gcrPayload.Tag) == 0 {
+					return true
+				}
+				for _, tag := range tags {
+					if ToPQIN(rc.Name, image.ImageName, tag) == gcrPayload.Tag {
+						return true
+					}
+				}
+			}
 		}
+	}
 
-		for _, image := range m.Images {
-			if !strings.Contains(gcrPayload.Digest, (string)(image.ImageName)) {
+	return false
+}
+
+// MakeManifestIndex creates a ManifestIndex of all images that the given
+// Manifests promote to their destination registries.
+func MakeManifestIndex(mfests []Manifest) ManifestIndex {
+	index := ManifestIndex{
+		fqins: make(map[string]ManifestIndexEntry),
+		pqins: make(map[string][]ManifestIndexEntry),
+	}
+
+	for _, mfest := range mfests {
+		for _, rc := range mfest.Registries {
+			if rc.Src {
 				continue
 			}
-			for digest, tags := range image.Dmap {
-				fqin := ToFQIN(rc.Name, image.ImageName, digest)
-				if fqinOnly {
-					if gcrPayload.Digest == fqin {
-						return true
+			for _, image := range mfest.Images {
+				for digest, tags := range image.Dmap {
+					entry := ManifestIndexEntry{
+						ManifestFile: mfest.filepath,
+						Registry:     rc.Name,
+						ImageName:    image.ImageName,
+						Digest:       digest,
 					}
-				} else {
+
+					fqin := ToFQIN(rc.Name, image.ImageName, digest)
+					// If more than one Manifest promotes the same image, the
+					// first one wins.
+					if _, ok := index.fqins[fqin]; !ok {
+						index.fqins[fqin] = entry
+					}
+
 					for _, tag := range tags {
+						entry.Tag = tag
 						pqin := ToPQIN(rc.Name, image.ImageName, tag)
-						if gcrPayload.Tag == pqin {
-							return gcrPayload.Digest == fqin
-						}
+						index.pqins[pqin] = append(index.pqins[pqin], entry)
 					}
 				}
 			}
 		}
 	}
-	return false
+
+	return index
+}
+
+// Lookup finds the entry in the promoter manifests that matches the
+// gcrPayload. If the payload has a tag, then the tag must be mentioned in the
+// manifests and must point to the payload's digest. Otherwise, only the digest
+// must be mentioned.
+func (index ManifestIndex) Lookup(
+	gcrPayload GCRPubSubPayload) (ManifestIndexEntry, bool) {
+
+	if len(gcrPayload.Tag) == 0 {
+		entry, ok := index.fqins[gcrPayload.Digest]
+		return entry, ok
+	}
+
+	for _, entry := range index.pqins[gcrPayload.Tag] {
+		fqin := ToFQIN(entry.Registry, entry.ImageName, entry.Digest)
+		if gcrPayload.Digest == fqin {
+			return entry, true
+		}
+	}
+
+	return ManifestIndexEntry{}, false
 }
@@ -19,11 +19,15 @@ package inventory
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	cr "github.com/google/go-containerregistry/pkg/v1/types"
 	"sigs.k8s.io/k8s-container-image-promoter/lib/json"
@@ -1211,8 +1215,7 @@ func TestReadRegistries(t *testing.T) {
 		}
 		sc := SyncContext{
 			RegistryContexts: rcs,
-			Inv:              map[RegistryName]RegInvImage{fakeRegName: nil},
-			DigestMediaType:  make(DigestMediaType)}
+			Inv:              map[RegistryName]RegInvImage{fakeRegName: nil}}
 		// test is used to pin the "test" variable from the outer "range"
 		// scope (see scopelint).
 		test := test
@@ -1235,6 +1238,24 @@ func TestReadRegistries(t *testing.T) {
 		expected := test.expectedOutput
 		err := checkEqual(got, expected)
 		checkError(t, err, fmt.Sprintf("Test: %v\n", test.name))
+
+		// The DigestInfo of every digest is kept (it is the same for all of
+		// the digests above).
+		created := time.Unix(0, 1501774217070*int64(time.Millisecond))
+		uploaded := time.Unix(0, 1552917295327*int64(time.Millisecond))
+		for imageName, digestTags := range got {
+			for digest := range digestTags {
+				info, ok := sc.GetDigestInfo(fakeRegName, imageName, digest)
+				if !ok ||
+					info.MediaType != cr.DockerManifestSchema2 ||
+					info.Size != 12875324 ||
+					!info.Created.Equal(created) ||
+					!info.Uploaded.Equal(uploaded) {
+					t.Errorf("Test: %v\nunexpected DigestInfo for %s@%s: %v",
+						test.name, imageName, digest, info)
+				}
+			}
+		}
 	}
 }
 
@@ -1244,11 +1265,46 @@ func TestReadGManifestLists(t *testing.T) {
 
 	var tests = []struct {
 		name           string
+		mediaType      cr.MediaType
 		input          map[string]string
-		expectedOutput ParentDigest
+		expectedOutput map[Digest]Digest
 	}{
 		{
 			"Basic example",
+			cr.DockerManifestList,
+			map[string]string{
+				"gcr.io/foo/someImage": `{
+   "schemaVersion": 2,
+   "mediaType": "application/vnd.docker.distribution.manifest.list.v2+json",
+   "manifests": [
+      {
+         "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+         "size": 739,
+         "digest": "sha256:0bd88bcba94f800715fca33ffc4bde430646a7c797237313cbccdcdef9f80f2d",
+         "platform": {
+            "architecture": "amd64",
+            "os": "linux"
+         }
+      },
+      {
+         "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+         "size": 739,
+         "digest": "sha256:0ad4f92011b2fa5de88a6e6a2d8b97f38371246021c974760e5fc54b9b7069e5",
+         "platform": {
+            "architecture": "s390x",
+            "os": "linux"
+         }
+      }
+   ]
+}`,
+			},
+			map[Digest]Digest{
+				"sha256:0bd88bcba94f800715fca33ffc4bde430646a7c797237313cbccdcdef9f80f2d": "sha256:0000000000000000000000000000000000000000000000000000000000000000",
+				"sha256:0ad4f92011b2fa5de88a6e6a2d8b97f38371246021c974760e5fc54b9b7069e5": "sha256:0000000000000000000000000000000000000000000000000000000000000000"},
+		},
+		{
+			"OCI image index",
+			cr.OCIImageIndex,
 			map[string]string{
 				"gcr.io/foo/someImage": `{
    "schemaVersion": 2,
@@ -1275,7 +1331,7 @@ func TestReadGManifestLists(t *testing.T) {
    ]
 }`,
 			},
-			ParentDigest{
+			map[Digest]Digest{
 				"sha256:0bd88bcba94f800715fca33ffc4bde430646a7c797237313cbccdcdef9f80f2d": "sha256:0000000000000000000000000000000000000000000000000000000000000000",
 				"sha256:0ad4f92011b2fa5de88a6e6a2d8b97f38371246021c974760e5fc54b9b7069e5": "sha256:0000000000000000000000000000000000000000000000000000000000000000"},
 		},
@@ -1296,9 +1352,12 @@ func TestReadGManifestLists(t *testing.T) {
 				"gcr.io/foo": {
 					"someImage": DigestTags{
 						"sha256:0000000000000000000000000000000000000000000000000000000000000000": TagSlice{"1.0"}}}},
-			DigestMediaType: DigestMediaType{
-				"sha256:0000000000000000000000000000000000000000000000000000000000000000": cr.DockerManifestList},
-			ParentDigest: make(ParentDigest)}
+			DigestInfo: MasterDigestInfo{
+				"gcr.io/foo": {
+					{
+						ImageName: "someImage",
+						Digest:    "sha256:0000000000000000000000000000000000000000000000000000000000000000",
+					}: DigestInfo{MediaType: test.mediaType}}}}
 		// test is used to pin the "test" variable from the outer "range"
 		// scope (see scopelint).
 		test := test
@@ -1317,10 +1376,18 @@ func TestReadGManifestLists(t *testing.T) {
 			return &sr
 		}
 		sc.ReadGCRManifestLists(mkFakeStream1)
-		got := sc.ParentDigest
-		expected := test.expectedOutput
-		err := checkEqual(got, expected)
-		checkError(t, err, fmt.Sprintf("Test: %v\n", test.name))
+
+		// The children are recorded by registry and image.
+		expectedParents := make(ManifestListParents)
+		for child, parent := range test.expectedOutput {
+			imageDigest := ImageDigest{ImageName: "someImage", Digest: child}
+			expectedParents[imageDigest] = map[Digest]bool{parent: true}
+		}
+		err := checkEqual(
+			sc.ManifestListParents,
+			map[RegistryName]ManifestListParents{
+				fakeRegName: expectedParents})
+		checkError(t, err, fmt.Sprintf("Test: %v (parents)\n", test.name))
 	}
 }
 
@@ -1981,6 +2048,151 @@ func TestCheckOverlappingEdges(t *testing.T) {
 	}
 }
 
+func TestReconcile(t *testing.T) {
+	srcRC := RegistryContext{
+		Name:           "gcr.io/foo",
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+	destRC := RegistryContext{
+		Name:           "gcr.io/bar",
+		ServiceAccount: "robot",
+	}
+	mfest := Manifest{
+		Registries: []RegistryContext{srcRC, destRC},
+		Images: []Image{
+			{
+				ImageName: "a",
+				Dmap: DigestTags{
+					"sha256:000": TagSlice{"0.9"},
+					"sha256:111": TagSlice{"1.0"}}},
+			{
+				ImageName: "b",
+				Dmap: DigestTags{
+					"sha256:222": TagSlice{"2.0"},
+					"sha256:333": TagSlice{}}},
+			{
+				ImageName: "c",
+				Dmap: DigestTags{
+					"sha256:444": TagSlice{"4.0"}}},
+		},
+		srcRegistry: &srcRC}
+	edges, err := ToPromotionEdges([]Manifest{mfest})
+	if err != nil {
+		t.Fatalf("ToPromotionEdges: %v", err)
+	}
+	edge := func(image ImageName, digest Digest, tag Tag) PromotionEdge {
+		return mkPromotionEdge(srcRC, destRC, image, digest, tag)
+	}
+
+	var tests = []struct {
+		name     string
+		inv      MasterInventory
+		parents  map[RegistryName]ManifestListParents
+		expected []ReconciliationReport
+	}{
+		{
+			"Everything promoted",
+			MasterInventory{
+				"gcr.io/foo": RegInvImage{
+					"a": DigestTags{
+						"sha256:000": TagSlice{"0.9"},
+						"sha256:111": TagSlice{"1.0"}},
+					"b": DigestTags{
+						"sha256:222": TagSlice{"2.0"},
+						"sha256:333": TagSlice{}},
+					"c": DigestTags{
+						"sha256:444": TagSlice{"4.0"}}},
+				"gcr.io/bar": RegInvImage{
+					"a": DigestTags{
+						"sha256:000": TagSlice{"0.9"},
+						"sha256:111": TagSlice{"1.0"}},
+					"b": DigestTags{
+						"sha256:222": TagSlice{"2.0"},
+						"sha256:333": TagSlice{}},
+					"c": DigestTags{
+						"sha256:444": TagSlice{"4.0"}}}},
+			nil,
+			[]ReconciliationReport{
+				{
+					Registry:          "gcr.io/bar",
+					UnexpectedDigests: RegInvImageDigest{},
+					UnexpectedTags:    RegInvImageTag{},
+					TagDrift:          RegInvImageTag{},
+					Pending:           []PromotionEdge{},
+					Lost:              []PromotionEdge{},
+				},
+			},
+		},
+		{
+			"Drift, unexpected images, pending and lost promotions",
+			MasterInventory{
+				"gcr.io/foo": RegInvImage{
+					"a": DigestTags{
+						"sha256:000": TagSlice{"0.9"},
+						"sha256:111": TagSlice{"1.0"}},
+					"b": DigestTags{
+						"sha256:222": TagSlice{"2.0"}}},
+				"gcr.io/bar": RegInvImage{
+					"a": DigestTags{
+						"sha256:000": TagSlice{"0.9", "1.0"},
+						"sha256:999": TagSlice{"latest"},
+						// Child of a manifest list; not unexpected.
+						"sha256:888": TagSlice{}},
+					"b": DigestTags{
+						"sha256:222": TagSlice{}},
+					"z": DigestTags{
+						"sha256:777": TagSlice{"7.0"},
+						// Same digest as the child of the manifest list of
+						// "a", but unexpected in "z".
+						"sha256:888": TagSlice{}}}},
+			map[RegistryName]ManifestListParents{
+				"gcr.io/bar": {
+					{ImageName: "a", Digest: "sha256:888"}: {
+						"sha256:000": true,
+					},
+				},
+			},
+			[]ReconciliationReport{
+				{
+					Registry: "gcr.io/bar",
+					UnexpectedDigests: RegInvImageDigest{
+						{"a", "sha256:999"}: TagSlice{"latest"},
+						{"z", "sha256:777"}: TagSlice{"7.0"},
+						{"z", "sha256:888"}: TagSlice{},
+					},
+					UnexpectedTags: RegInvImageTag{
+						{"a", "latest"}: "sha256:999",
+						{"z", "7.0"}:    "sha256:777",
+					},
+					TagDrift: RegInvImageTag{
+						{"a", "1.0"}: "sha256:000",
+					},
+					Pending: []PromotionEdge{
+						edge("b", "sha256:222", "2.0"),
+					},
+					Lost: []PromotionEdge{
+						edge("b", "sha256:333", ""),
+						edge("c", "sha256:444", "4.0"),
+					},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		sc := SyncContext{
+			RegistryContexts: []RegistryContext{destRC, srcRC},
+			Inv:              test.inv,
+			// Tagless children of manifest lists are not unexpected.
+			ManifestListParents: test.parents,
+		}
+		got := sc.Reconcile(edges)
+		err := checkEqual(got, test.expected)
+		checkError(t, err, fmt.Sprintf("checkError: test: %v\n", test.name))
+	}
+}
+
 // TestPromotion is the most important test as it simulates the main job of the
 // promoter.
 func TestPromotion(t *testing.T) {
@@ -2735,6 +2947,367 @@ func TestGarbageCollectionMulti(t *testing.T) {
 	}
 }
 
+func TestGarbageCollectionManifestListsFirst(t *testing.T) {
+	srcRC := RegistryContext{
+		Name:           "gcr.io/foo",
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+	destRC := RegistryContext{
+		Name:           "gcr.io/bar",
+		ServiceAccount: "robot",
+	}
+	mfest := Manifest{Registries: []RegistryContext{srcRC, destRC}}
+	sc := SyncContext{
+		SrcRegistry: &srcRC,
+		Inv: MasterInventory{
+			"gcr.io/bar": RegInvImage{
+				"a": DigestTags{
+					"sha256:111": nil,
+					"sha256:aaa": nil,
+					"sha256:bbb": nil,
+					"sha256:ccc": TagSlice{"1.0"}}}},
+		DigestInfo: MasterDigestInfo{
+			"gcr.io/bar": RegInvDigestInfo{
+				{ImageName: "a", Digest: "sha256:111"}: DigestInfo{
+					MediaType: cr.DockerManifestList},
+				{ImageName: "a", Digest: "sha256:aaa"}: DigestInfo{
+					MediaType: cr.DockerManifestSchema2}}}}
+
+	var deleted []Digest
+	var processRequestFake ProcessRequest = func(
+		sc *SyncContext,
+		reqs chan stream.ExternalRequest,
+		errs chan<- RequestResult,
+		wg *sync.WaitGroup,
+		mutex *sync.Mutex) {
+
+		for req := range reqs {
+			pr := req.RequestParams.(PromotionRequest)
+			mutex.Lock()
+			deleted = append(deleted, pr.Digest)
+			mutex.Unlock()
+			wg.Add(-1)
+		}
+	}
+	nopStream := func(RegistryContext, ImageName, Digest) stream.Producer {
+		return nil
+	}
+
+	sc.GarbageCollect(mfest, nopStream, &processRequestFake)
+
+	// The manifest list is deleted first; the order of the others does not
+	// matter.
+	if len(deleted) != 3 || deleted[0] != "sha256:111" {
+		t.Fatalf("unexpected deletions %v", deleted)
+	}
+	rest := map[Digest]bool{deleted[1]: true, deleted[2]: true}
+	if !rest["sha256:aaa"] || !rest["sha256:bbb"] {
+		t.Errorf("unexpected deletions %v", deleted)
+	}
+}
+
+func TestDescribeDigest(t *testing.T) {
+	uploaded, err := ParseSnapshotTime("2020-01-02T03:04:05Z")
+	checkError(t, err, "unexpected error\n")
+	sc := SyncContext{
+		DigestInfo: MasterDigestInfo{
+			"gcr.io/src": RegInvDigestInfo{
+				{ImageName: "a", Digest: "sha256:111"}: DigestInfo{
+					MediaType: cr.DockerManifestSchema2,
+					Size:      1234,
+					Uploaded:  uploaded}},
+			"gcr.io/dest": RegInvDigestInfo{
+				{ImageName: "b", Digest: "sha256:111"}: DigestInfo{
+					MediaType: cr.DockerManifestList}}}}
+
+	var tests = []struct {
+		name     string
+		pr       PromotionRequest
+		expected string
+	}{
+		{
+			"Promotion (described by the source image)",
+			PromotionRequest{
+				TagOp:         Add,
+				RegistrySrc:   "gcr.io/src",
+				RegistryDest:  "gcr.io/dest",
+				ImageNameSrc:  "a",
+				ImageNameDest: "b",
+				Digest:        "sha256:111",
+				Tag:           "1.0"},
+			" (application/vnd.docker.distribution.manifest.v2+json, 1234 bytes, uploaded 2020-01-02T03:04:05Z)",
+		},
+		{
+			"Deletion (described by the destination image)",
+			PromotionRequest{
+				TagOp:         Delete,
+				RegistryDest:  "gcr.io/dest",
+				ImageNameDest: "b",
+				Digest:        "sha256:111"},
+			" (application/vnd.docker.distribution.manifest.list.v2+json)",
+		},
+		{
+			"Unknown image",
+			PromotionRequest{
+				TagOp:         Delete,
+				RegistryDest:  "gcr.io/dest",
+				ImageNameDest: "a",
+				Digest:        "sha256:111"},
+			"",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		got := sc.describeDigest(&test.pr)
+		checkError(t, checkEqual(got, test.expected),
+			fmt.Sprintf("Test: %v\n", test.name))
+	}
+}
+
+func TestSelectForRetention(t *testing.T) {
+	now, err := ParseSnapshotTime("2020-06-01")
+	checkError(t, err, "unexpected error\n")
+	daysAgo := func(days int) DigestInfo {
+		return DigestInfo{
+			MediaType: cr.DockerManifestSchema2,
+			Uploaded:  now.Add(-time.Duration(days) * 24 * time.Hour),
+		}
+	}
+	rii := RegInvImage{
+		"a": DigestTags{
+			"sha256:111": TagSlice{"1.0"},
+			"sha256:222": TagSlice{"2.0"},
+			"sha256:333": TagSlice{"3.0", "latest"},
+			"sha256:444": TagSlice{},
+			"sha256:555": TagSlice{},
+			// No DigestInfo.
+			"sha256:666": TagSlice{"0.1"},
+		},
+		"b": DigestTags{
+			// A tagged manifest list, with 2 untagged children.
+			"sha256:ccc": TagSlice{"1.0"},
+			"sha256:c01": TagSlice{},
+			"sha256:c02": TagSlice{},
+			// An old tagged manifest list, with 1 untagged child (and
+			// sha256:c02, which it shares with sha256:ccc).
+			"sha256:ddd": TagSlice{"0.9"},
+			"sha256:d01": TagSlice{},
+		},
+	}
+	info := RegInvDigestInfo{
+		{ImageName: "a", Digest: "sha256:111"}: daysAgo(90),
+		{ImageName: "a", Digest: "sha256:222"}: daysAgo(60),
+		{ImageName: "a", Digest: "sha256:333"}: daysAgo(1),
+		{ImageName: "a", Digest: "sha256:444"}: daysAgo(40),
+		{ImageName: "a", Digest: "sha256:555"}: daysAgo(10),
+		{ImageName: "b", Digest: "sha256:ccc"}: DigestInfo{
+			MediaType: cr.DockerManifestList,
+			Uploaded:  now.Add(-24 * time.Hour),
+		},
+		{ImageName: "b", Digest: "sha256:c01"}: daysAgo(100),
+		{ImageName: "b", Digest: "sha256:c02"}: daysAgo(100),
+		{ImageName: "b", Digest: "sha256:ddd"}: DigestInfo{
+			MediaType: cr.DockerManifestList,
+			Uploaded:  now.Add(-200 * 24 * time.Hour),
+		},
+		{ImageName: "b", Digest: "sha256:d01"}: daysAgo(200),
+	}
+	parents := ManifestListParents{
+		{ImageName: "b", Digest: "sha256:c01"}: {"sha256:ccc": true},
+		{ImageName: "b", Digest: "sha256:c02"}: {
+			"sha256:ccc": true,
+			"sha256:ddd": true,
+		},
+		{ImageName: "b", Digest: "sha256:d01"}: {"sha256:ddd": true},
+	}
+
+	var tests = []struct {
+		name       string
+		policy     RetentionPolicy
+		referenced map[Digest]bool
+		expected   []ImageDigest
+	}{
+		{
+			"No rules",
+			RetentionPolicy{},
+			nil,
+			[]ImageDigest{},
+		},
+		{
+			"Keep the last tagged digest",
+			RetentionPolicy{KeepTagged: 1},
+			nil,
+			[]ImageDigest{
+				{ImageName: "a", Digest: "sha256:111"},
+				{ImageName: "a", Digest: "sha256:222"},
+				{ImageName: "b", Digest: "sha256:ddd"},
+			},
+		},
+		{
+			"Keep the last 2 tagged digests, except referenced ones",
+			RetentionPolicy{KeepTagged: 2},
+			map[Digest]bool{"sha256:111": true},
+			[]ImageDigest{},
+		},
+		{
+			"Delete old untagged digests (but not children of kept lists)",
+			RetentionPolicy{UntaggedMaxAge: 30 * 24 * time.Hour},
+			nil,
+			[]ImageDigest{
+				{ImageName: "a", Digest: "sha256:444"},
+			},
+		},
+		{
+			"Delete old lists along with their children (but not shared ones)",
+			RetentionPolicy{
+				KeepTagged:     1,
+				UntaggedMaxAge: 30 * 24 * time.Hour,
+			},
+			map[Digest]bool{"sha256:444": true},
+			[]ImageDigest{
+				{ImageName: "a", Digest: "sha256:111"},
+				{ImageName: "a", Digest: "sha256:222"},
+				{ImageName: "b", Digest: "sha256:d01"},
+				{ImageName: "b", Digest: "sha256:ddd"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		got := SelectForRetention(
+			rii, info, parents, test.referenced, test.policy, now)
+		checkError(t, checkEqual(got, test.expected),
+			fmt.Sprintf("Test: %v\n", test.name))
+	}
+
+	// A child that 2 untagged manifest lists share is only deleted along with
+	// both of them.
+	sharedRii := RegInvImage{
+		"c": DigestTags{
+			"sha256:e00": TagSlice{},
+			"sha256:eee": TagSlice{},
+			"sha256:fff": TagSlice{},
+		},
+	}
+	sharedParents := ManifestListParents{
+		{ImageName: "c", Digest: "sha256:e00"}: {
+			"sha256:eee": true,
+			"sha256:fff": true,
+		},
+	}
+	listDaysAgo := func(days int) DigestInfo {
+		info := daysAgo(days)
+		info.MediaType = cr.DockerManifestList
+		return info
+	}
+	for _, fffDays := range []int{100, 1} {
+		sharedInfo := RegInvDigestInfo{
+			{ImageName: "c", Digest: "sha256:e00"}: daysAgo(100),
+			{ImageName: "c", Digest: "sha256:eee"}: listDaysAgo(100),
+			{ImageName: "c", Digest: "sha256:fff"}: listDaysAgo(fffDays),
+		}
+		expected := []ImageDigest{
+			{ImageName: "c", Digest: "sha256:eee"},
+		}
+		if fffDays == 100 {
+			expected = []ImageDigest{
+				{ImageName: "c", Digest: "sha256:e00"},
+				{ImageName: "c", Digest: "sha256:eee"},
+				{ImageName: "c", Digest: "sha256:fff"},
+			}
+		}
+		got := SelectForRetention(
+			sharedRii,
+			sharedInfo,
+			sharedParents,
+			nil,
+			RetentionPolicy{UntaggedMaxAge: 30 * 24 * time.Hour},
+			now)
+		checkError(t, checkEqual(got, expected),
+			fmt.Sprintf("Shared child (list uploaded %d days ago)\n", fffDays))
+	}
+
+	referenced := ReferencedDigests([]Manifest{
+		{Images: []Image{
+			{ImageName: "a", Dmap: DigestTags{"sha256:111": TagSlice{"1.0"}}},
+		}},
+		{Images: []Image{
+			{ImageName: "z", Dmap: DigestTags{"sha256:999": TagSlice{}}},
+		}},
+	})
+	checkError(t,
+		checkEqual(referenced, map[Digest]bool{
+			"sha256:111": true,
+			"sha256:999": true,
+		}),
+		"ReferencedDigests\n")
+}
+
+func TestApplyRetention(t *testing.T) {
+	rc := RegistryContext{
+		Name:           "gcr.io/staging",
+		ServiceAccount: "robot",
+	}
+	sc := SyncContext{
+		DigestInfo: MasterDigestInfo{
+			"gcr.io/staging": RegInvDigestInfo{
+				{ImageName: "b", Digest: "sha256:ddd"}: DigestInfo{
+					MediaType: cr.DockerManifestList},
+				{ImageName: "b", Digest: "sha256:eee"}: DigestInfo{
+					MediaType: cr.OCIImageIndex}}}}
+	deletions := []ImageDigest{
+		{ImageName: "a", Digest: "sha256:111"},
+		{ImageName: "b", Digest: "sha256:d01"},
+		{ImageName: "b", Digest: "sha256:ddd"},
+		{ImageName: "b", Digest: "sha256:e01"},
+		{ImageName: "b", Digest: "sha256:eee"},
+	}
+
+	var deleted []PromotionRequest
+	var processRequestFake ProcessRequest = func(
+		sc *SyncContext,
+		reqs chan stream.ExternalRequest,
+		errs chan<- RequestResult,
+		wg *sync.WaitGroup,
+		mutex *sync.Mutex) {
+
+		for req := range reqs {
+			mutex.Lock()
+			deleted = append(deleted, req.RequestParams.(PromotionRequest))
+			mutex.Unlock()
+			wg.Add(-1)
+		}
+	}
+	nopStream := func(RegistryContext, ImageName, Digest) stream.Producer {
+		return nil
+	}
+
+	sc.ApplyRetention(rc, deletions, nopStream, &processRequestFake)
+
+	// The manifest list and the OCI image index are deleted first.
+	if len(deleted) != 5 {
+		t.Fatalf("unexpected deletions %v", deleted)
+	}
+	firstPass := map[Digest]bool{deleted[0].Digest: true, deleted[1].Digest: true}
+	if !firstPass["sha256:ddd"] || !firstPass["sha256:eee"] {
+		t.Fatalf("manifest lists were not deleted first: %v", deleted)
+	}
+	if deleted[1].Digest == "sha256:ddd" {
+		deleted[0], deleted[1] = deleted[1], deleted[0]
+	}
+	expected := PromotionRequest{
+		TagOp:          Delete,
+		RegistryDest:   "gcr.io/staging",
+		ServiceAccount: "robot",
+		ImageNameDest:  "b",
+		Digest:         "sha256:ddd",
+	}
+	checkError(t, checkEqual(deleted[0], expected), "ApplyRetention\n")
+}
+
 func TestSnapshot(t *testing.T) {
 	var tests = []struct {
 		name     string
@@ -2985,6 +3558,43 @@ func TestContains(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"INSERT's image name is a substring of an image in the Manifest (digest only)",
+			inputMfest,
+			GCRPubSubPayload{
+				Action: "INSERT",
+				Digest: "us.gcr.io/some-prod/foo@sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+			},
+			false,
+		},
+		{
+			"INSERT's image name is a superstring of an image in the Manifest (tag specified)",
+			inputMfest,
+			GCRPubSubPayload{
+				Action: "INSERT",
+				Digest: "us.gcr.io/some-prod/foo-controller-bar@sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+				Tag:    "us.gcr.io/some-prod/foo-controller-bar:1.0",
+			},
+			false,
+		},
+		{
+			"INSERT's registry name is a superstring of a registry in the Manifest",
+			inputMfest,
+			GCRPubSubPayload{
+				Action: "INSERT",
+				Digest: "us.gcr.io/some-prod-2/foo-controller@sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+			},
+			false,
+		},
+		{
+			"INSERT's digest is in the source registry only",
+			inputMfest,
+			GCRPubSubPayload{
+				Action: "INSERT",
+				Digest: "gcr.io/foo-staging/foo-controller@sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+			},
+			false,
+		},
 	}
 
 	for _, test := range tests {
@@ -2994,6 +3604,113 @@ func TestContains(t *testing.T) {
 	}
 }
 
+func TestManifestIndex(t *testing.T) {
+	srcRC := RegistryContext{
+		Name: "gcr.io/foo-staging",
+		Src:  true,
+	}
+	prodRC := RegistryContext{
+		Name: "us.gcr.io/some-prod",
+	}
+	mfests := []Manifest{
+		{
+			Registries: []RegistryContext{srcRC, prodRC},
+			Images: []Image{
+				{ImageName: "foo",
+					Dmap: DigestTags{
+						"sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa": {"1.0"},
+					},
+				},
+			},
+			filepath: "a/promoter-manifest.yaml"},
+		{
+			Registries: []RegistryContext{srcRC, prodRC},
+			Images: []Image{
+				{ImageName: "foo-bar",
+					Dmap: DigestTags{
+						"sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb": {"1.0"},
+					},
+				},
+			},
+			filepath: "b/promoter-manifest.yaml"},
+	}
+	index := MakeManifestIndex(mfests)
+
+	var tests = []struct {
+		name          string
+		gcrPayload    GCRPubSubPayload
+		expectedEntry ManifestIndexEntry
+		expectedFound bool
+	}{
+		{
+			"Digest only",
+			GCRPubSubPayload{
+				Action: "INSERT",
+				Digest: "us.gcr.io/some-prod/foo-bar@sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb",
+			},
+			ManifestIndexEntry{
+				ManifestFile: "b/promoter-manifest.yaml",
+				Registry:     "us.gcr.io/some-prod",
+				ImageName:    "foo-bar",
+				Digest:       "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb",
+			},
+			true,
+		},
+		{
+			"Digest and tag",
+			GCRPubSubPayload{
+				Action: "INSERT",
+				Digest: "us.gcr.io/some-prod/foo@sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+				Tag:    "us.gcr.io/some-prod/foo:1.0",
+			},
+			ManifestIndexEntry{
+				ManifestFile: "a/promoter-manifest.yaml",
+				Registry:     "us.gcr.io/some-prod",
+				ImageName:    "foo",
+				Digest:       "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+				Tag:          "1.0",
+			},
+			true,
+		},
+		{
+			"Digest of an image whose name is a substring of the payload's image",
+			GCRPubSubPayload{
+				Action: "INSERT",
+				Digest: "us.gcr.io/some-prod/foo-bar@sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+			},
+			ManifestIndexEntry{},
+			false,
+		},
+		{
+			"Tag points to the digest of another image",
+			GCRPubSubPayload{
+				Action: "INSERT",
+				Digest: "us.gcr.io/some-prod/foo@sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb",
+				Tag:    "us.gcr.io/some-prod/foo:1.0",
+			},
+			ManifestIndexEntry{},
+			false,
+		},
+		{
+			"Tag only",
+			GCRPubSubPayload{
+				Action: "INSERT",
+				Tag:    "us.gcr.io/some-prod/foo:1.0",
+			},
+			ManifestIndexEntry{},
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		entry, found := index.Lookup(test.gcrPayload)
+		errEqual := checkEqual(found, test.expectedFound)
+		checkError(t, errEqual, fmt.Sprintf("checkError: test %q (found)\n", test.name))
+		errEqual = checkEqual(entry, test.expectedEntry)
+		checkError(t, errEqual, fmt.Sprintf("checkError: test %q (entry)\n", test.name))
+	}
+}
+
 // Helper functions.
 
 func bazelTestPath(testName string, paths ...string) string {
@@ -3003,3 +3720,653 @@ func bazelTestPath(testName string, paths ...string) string {
 		testName}
 	return filepath.Join(append(prefix, paths...)...)
 }
+
+func TestTagSelectors(t *testing.T) {
+	tags := []Tag{
+		"latest", "v1.0.0", "1.2.0", "v1.2.3", "v1.2.3-rc.1", "v2.0.0",
+		"v1.2", "sha-abc",
+	}
+	var tests = []struct {
+		name          string
+		regex         string
+		semver        string
+		expected      []Tag
+		expectedError bool
+	}{
+		{
+			name:     "regex",
+			regex:    `^v[0-9.]+$`,
+			expected: []Tag{"v1.0.0", "v1.2.3", "v2.0.0", "v1.2"},
+		},
+		{
+			name:          "bad regex",
+			regex:         `(`,
+			expectedError: true,
+		},
+		{
+			name:     "range",
+			semver:   ">=1.2.0 <2.0.0",
+			expected: []Tag{"1.2.0", "v1.2.3", "v1.2.3-rc.1"},
+		},
+		{
+			name:     "exact or alternative",
+			semver:   "1.0.0 || >v1.2.3",
+			expected: []Tag{"v1.0.0", "v2.0.0"},
+		},
+		{
+			name:     "pre-releases",
+			semver:   ">1.2.0 !=1.2.3",
+			expected: []Tag{"v1.2.3-rc.1", "v2.0.0"},
+		},
+		{
+			name:          "bad version",
+			semver:        ">=1.2",
+			expectedError: true,
+		},
+		{
+			name:          "empty alternative",
+			semver:        ">=1.2.0 ||",
+			expectedError: true,
+		},
+	}
+	for _, test := range tests {
+		var selectTag TagSelector
+		var err error
+		if test.regex != "" {
+			selectTag, err = MkTagRegexSelector(test.regex)
+		} else {
+			selectTag, err = MkTagSemverSelector(test.semver)
+		}
+		if test.expectedError {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		checkError(t, err, fmt.Sprintf("%s: unexpected error\n", test.name))
+
+		var got []Tag
+		for _, tag := range tags {
+			if selectTag(tag) {
+				got = append(got, tag)
+			}
+		}
+		err = checkEqual(got, test.expected)
+		checkError(t, err, fmt.Sprintf("checkError: test: %v\n", test.name))
+	}
+}
+
+func TestSelectImages(t *testing.T) {
+	rii := RegInvImage{
+		"foo": DigestTags{
+			"sha256:000": TagSlice{"v1.1", "latest", "v1.0"},
+			"sha256:111": TagSlice{},
+			"sha256:222": TagSlice{"latest-dev"},
+		},
+		"foo/bar": DigestTags{
+			"sha256:333": TagSlice{"v2.0"},
+		},
+		"baz": DigestTags{
+			"sha256:444": TagSlice{"v3.0"},
+		},
+	}
+	selectTag, err := MkTagRegexSelector(`^v`)
+	checkError(t, err, "unexpected error\n")
+
+	got, err := SelectImages(rii, "", selectTag)
+	checkError(t, err, "unexpected error\n")
+	expected := Images{
+		{ImageName: "baz", Dmap: DigestTags{"sha256:444": {"v3.0"}}},
+		{ImageName: "foo", Dmap: DigestTags{"sha256:000": {"v1.0", "v1.1"}}},
+		{ImageName: "foo/bar", Dmap: DigestTags{"sha256:333": {"v2.0"}}},
+	}
+	checkError(t, checkEqual(got, expected), "all images\n")
+
+	got, err = SelectImages(rii, "foo/*", selectTag)
+	checkError(t, err, "unexpected error\n")
+	checkError(t, checkEqual(got, expected[2:]), "image glob\n")
+
+	if _, err := SelectImages(rii, "[", selectTag); err == nil {
+		t.Errorf("expected an error for an invalid glob")
+	}
+}
+
+func TestMergeImages(t *testing.T) {
+	existing := OrderedImages{
+		{name: "zzz", digests: []digest{
+			{hash: "sha256:000", tags: []string{"v1.0", "stable"}},
+		}},
+		{name: "aaa", digests: []digest{
+			{hash: "sha256:555", tags: []string{"v0.9"}},
+			{hash: "sha256:111", tags: []string{"v1.0"}},
+		}},
+	}
+	generated := Images{
+		{ImageName: "aaa", Dmap: DigestTags{
+			"sha256:111": {"v1.0", "v1.0.0"},
+			"sha256:222": {"v1.1"},
+		}},
+		{ImageName: "mmm", Dmap: DigestTags{
+			"sha256:333": {"v0.1"},
+		}},
+		{ImageName: "zzz", Dmap: DigestTags{
+			"sha256:000": {"v1.0"},
+		}},
+	}
+
+	got, err := MergeImages(existing, generated)
+	checkError(t, err, "unexpected error\n")
+	expected := OrderedImages{
+		{name: "zzz", digests: []digest{
+			{hash: "sha256:000", tags: []string{"v1.0", "stable"}},
+		}},
+		{name: "aaa", digests: []digest{
+			{hash: "sha256:555", tags: []string{"v0.9"}},
+			{hash: "sha256:111", tags: []string{"v1.0", "v1.0.0"}},
+			{hash: "sha256:222", tags: []string{"v1.1"}},
+		}},
+		{name: "mmm", digests: []digest{
+			{hash: "sha256:333", tags: []string{"v0.1"}},
+		}},
+	}
+	checkError(t, checkEqual(got, expected), "merge\n")
+
+	// The existing images must not be modified.
+	checkError(t,
+		checkEqual(existing[1].digests[1].tags, []string{"v1.0"}),
+		"existing images were modified\n")
+
+	// Tags must not be retargeted.
+	retarget := Images{
+		{ImageName: "zzz", Dmap: DigestTags{
+			"sha256:444": {"v1.0", "v2.0"},
+		}},
+	}
+	_, err = MergeImages(existing, retarget)
+	if err == nil {
+		t.Fatalf("expected an error when retargeting a tag")
+	}
+	expectedError := "cannot merge images:\n" +
+		"zzz:v1.0 points to sha256:000, refusing to retarget it to sha256:444"
+	checkError(t, checkEqual(err.Error(), expectedError), "retarget\n")
+}
+
+func TestOrderedImagesYAML(t *testing.T) {
+	input := `- name: foo
+  dmap:
+    sha256:fff:
+    - "0.9"
+    - "0.5"
+    sha256:abc: []
+- name: bar
+  dmap:
+    sha256:000:
+    - "0.8"
+`
+	images, err := ParseOrderedImagesYAML([]byte(input))
+	checkError(t, err, "unexpected error\n")
+	expected := OrderedImages{
+		{name: "foo", digests: []digest{
+			{hash: "sha256:fff", tags: []string{"0.9", "0.5"}},
+			{hash: "sha256:abc"},
+		}},
+		{name: "bar", digests: []digest{
+			{hash: "sha256:000", tags: []string{"0.8"}},
+		}},
+	}
+	checkError(t, checkEqual(images, expected), "parse\n")
+
+	// The images, digests and tags are written in their order, in the same
+	// format as RegInvImage.ToYAML().
+	expectedYAML := `- name: foo
+  dmap:
+    sha256:fff:
+    - 0.9
+    - 0.5
+    sha256:abc: []
+- name: bar
+  dmap:
+    sha256:000:
+    - 0.8
+`
+	checkError(t, checkEqual(images.ToYAML(), expectedYAML), "ToYAML\n")
+
+	// The output can be read back.
+	parsed, err := ParseOrderedImagesYAML([]byte(expectedYAML))
+	checkError(t, err, "unexpected error\n")
+	checkError(t, checkEqual(parsed, images), "round trip\n")
+
+	_, err = ParseOrderedImagesYAML([]byte("- name: foo\n  bogus: true\n"))
+	if err == nil {
+		t.Errorf("expected an error for an unknown field")
+	}
+}
+
+func TestSnapshotJSON(t *testing.T) {
+	rii := RegInvImage{
+		"foo": DigestTags{
+			"sha256:111": TagSlice{"1.0", "latest"},
+			"sha256:aaa": TagSlice{},
+			"sha256:bbb": TagSlice{},
+		},
+		"bar": DigestTags{
+			"sha256:000": TagSlice{"0.1"},
+		},
+	}
+	parents := ManifestListParents{
+		{ImageName: "foo", Digest: "sha256:bbb"}: {"sha256:111": true},
+		{ImageName: "foo", Digest: "sha256:aaa"}: {"sha256:111": true},
+		// A manifest list of another image with the same digest is not a
+		// parent of "foo".
+		{ImageName: "baz", Digest: "sha256:aaa"}: {"sha256:000": true},
+	}
+
+	created, err := ParseSnapshotTime("2020-01-02T03:04:05Z")
+	checkError(t, err, "unexpected error\n")
+	info := RegInvDigestInfo{
+		{ImageName: "foo", Digest: "sha256:111"}: DigestInfo{
+			MediaType: cr.DockerManifestList,
+		},
+		{ImageName: "foo", Digest: "sha256:aaa"}: DigestInfo{
+			MediaType: cr.DockerManifestSchema2,
+			Size:      739,
+		},
+		{ImageName: "foo", Digest: "sha256:bbb"}: DigestInfo{
+			MediaType: cr.DockerManifestSchema2,
+			Size:      739,
+		},
+		{ImageName: "bar", Digest: "sha256:000"}: DigestInfo{
+			MediaType: cr.DockerManifestSchema2,
+			Size:      12875324,
+			Created:   created,
+			Uploaded:  created.Add(time.Hour),
+		},
+	}
+
+	got, err := rii.ToJSON(info, parents)
+	checkError(t, err, "unexpected error\n")
+	expected := `[
+  {
+    "name": "bar",
+    "digests": [
+      {
+        "digest": "sha256:000",
+        "tags": [
+          "0.1"
+        ],
+        "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+        "size": 12875324,
+        "created": "2020-01-02T03:04:05Z",
+        "uploaded": "2020-01-02T04:04:05Z"
+      }
+    ]
+  },
+  {
+    "name": "foo",
+    "digests": [
+      {
+        "digest": "sha256:111",
+        "tags": [
+          "1.0",
+          "latest"
+        ],
+        "mediaType": "application/vnd.docker.distribution.manifest.list.v2+json",
+        "children": [
+          "sha256:aaa",
+          "sha256:bbb"
+        ]
+      },
+      {
+        "digest": "sha256:aaa",
+        "tags": [],
+        "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+        "size": 739,
+        "parents": [
+          "sha256:111"
+        ]
+      },
+      {
+        "digest": "sha256:bbb",
+        "tags": [],
+        "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+        "size": 739,
+        "parents": [
+          "sha256:111"
+        ]
+      }
+    ]
+  }
+]
+`
+	checkError(t, checkEqual(got, expected), "ToJSON\n")
+
+	// Without any annotations.
+	empty := RegInvImage{}
+	got, err = empty.ToJSON(nil, nil)
+	checkError(t, err, "unexpected error\n")
+	checkError(t, checkEqual(got, "[]\n"), "ToJSON (empty)\n")
+}
+
+func TestSnapshotFilter(t *testing.T) {
+	day := func(s string) time.Time {
+		t, err := ParseSnapshotTime(s)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	rii := RegInvImage{
+		"foo": DigestTags{
+			"sha256:111": TagSlice{"1.0", "latest"},
+			"sha256:222": TagSlice{"2.0-rc.1"},
+			"sha256:333": TagSlice{},
+		},
+		"foo/bar": DigestTags{
+			"sha256:444": TagSlice{"1.0"},
+		},
+		"baz": DigestTags{
+			"sha256:555": TagSlice{"1.0"},
+		},
+	}
+	info := RegInvDigestInfo{
+		{ImageName: "foo", Digest: "sha256:111"}: DigestInfo{
+			Created:  day("2020-01-01"),
+			Uploaded: day("2020-03-01"),
+		},
+		{ImageName: "foo", Digest: "sha256:222"}: DigestInfo{
+			Created:  day("2020-02-01"),
+			Uploaded: day("2020-02-01"),
+		},
+		{ImageName: "foo", Digest: "sha256:333"}: DigestInfo{
+			Created:  day("2020-03-01"),
+			Uploaded: day("2020-03-01"),
+		},
+		// "foo/bar" has no timestamps.
+		{ImageName: "baz", Digest: "sha256:555"}: DigestInfo{
+			Created:  day("2019-01-01"),
+			Uploaded: day("2019-01-01"),
+		},
+	}
+
+	var tests = []struct {
+		name     string
+		filter   SnapshotFilter
+		expected RegInvImage
+	}{
+		{
+			"No filter",
+			SnapshotFilter{},
+			rii,
+		},
+		{
+			"Image glob (with child images)",
+			SnapshotFilter{ImageGlob: "fo?"},
+			RegInvImage{"foo": rii["foo"], "foo/bar": rii["foo/bar"]},
+		},
+		{
+			"Image glob (child images only)",
+			SnapshotFilter{ImageGlob: "foo/*"},
+			RegInvImage{"foo/bar": rii["foo/bar"]},
+		},
+		{
+			"Image regex",
+			SnapshotFilter{ImageRegex: regexp.MustCompile("^ba")},
+			RegInvImage{"baz": rii["baz"]},
+		},
+		{
+			"Tag regex",
+			SnapshotFilter{TagRegex: regexp.MustCompile(`^[0-9.]+$`)},
+			RegInvImage{
+				"foo": DigestTags{
+					"sha256:111": TagSlice{"1.0"},
+				},
+				"foo/bar": rii["foo/bar"],
+				"baz":     rii["baz"],
+			},
+		},
+		{
+			"Created after",
+			SnapshotFilter{CreatedAfter: day("2020-01-01")},
+			RegInvImage{
+				"foo": DigestTags{
+					"sha256:222": TagSlice{"2.0-rc.1"},
+					"sha256:333": TagSlice{},
+				},
+			},
+		},
+		{
+			"Uploaded after, with an image glob",
+			SnapshotFilter{
+				ImageGlob:     "foo",
+				UploadedAfter: day("2020-02-15T00:00:00Z"),
+			},
+			RegInvImage{
+				"foo": DigestTags{
+					"sha256:111": TagSlice{"1.0", "latest"},
+					"sha256:333": TagSlice{},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		got, err := test.filter.Apply(rii, info)
+		checkError(t, err, fmt.Sprintf("Test: %v\n", test.name))
+		checkError(t, checkEqual(got, test.expected),
+			fmt.Sprintf("Test: %v\n", test.name))
+	}
+
+	bad := SnapshotFilter{ImageGlob: "["}
+	if _, err := bad.Apply(rii, info); err == nil {
+		t.Error("expected an error for an invalid image glob")
+	}
+
+	if _, err := ParseSnapshotTime("01/02/2020"); err == nil {
+		t.Error("expected an error for an invalid time")
+	}
+}
+
+func TestWriteThinManifest(t *testing.T) {
+	if got := ThinManifestNameFor("gcr.io/k8s-staging-foo"); got != "foo" {
+		t.Errorf("unexpected thin manifest name %q", got)
+	}
+	if got := ThinManifestNameFor("gcr.io/bar/baz"); got != "baz" {
+		t.Errorf("unexpected thin manifest name %q", got)
+	}
+
+	dir, err := ioutil.TempDir("", "thin-manifest")
+	checkError(t, err, "unexpected error\n")
+	defer os.RemoveAll(dir)
+
+	rcs := []RegistryContext{
+		{
+			Name:           "gcr.io/k8s-staging-foo",
+			ServiceAccount: "robot",
+			Src:            true,
+		},
+		{
+			Name:           "us.gcr.io/k8s-artifacts-prod/foo",
+			ServiceAccount: "prod-robot",
+		},
+	}
+	digest := Digest("sha256:" + strings.Repeat("0", 64))
+	rii := RegInvImage{
+		"foo": DigestTags{digest: TagSlice{"1.0"}},
+	}
+	err = WriteThinManifest(dir, "foo", rcs, rii)
+	checkError(t, err, "unexpected error\n")
+
+	mfests, err := ParseThinManifestsFromDir(dir)
+	checkError(t, err, "unexpected error\n")
+	if len(mfests) != 1 {
+		t.Fatalf("expected 1 manifest, got %d", len(mfests))
+	}
+	checkError(t, checkEqual(mfests[0].Registries, rcs), "registries\n")
+	expectedImages := []Image{
+		{ImageName: "foo", Dmap: DigestTags{digest: TagSlice{"1.0"}}},
+	}
+	checkError(t, checkEqual(mfests[0].Images, expectedImages), "images\n")
+
+	// Existing thin manifests are not overwritten.
+	err = WriteThinManifest(dir, "foo", rcs, rii)
+	if err == nil || !strings.Contains(err.Error(), "refusing to overwrite") {
+		t.Errorf("expected an error when overwriting, got %v", err)
+	}
+
+	err = WriteThinManifest(dir, "../foo", rcs, rii)
+	if err == nil {
+		t.Errorf("expected an error for an invalid name")
+	}
+
+	// A thin manifest without destinations would not promote anything.
+	err = WriteThinManifest(dir, "bar", rcs[:1], rii)
+	if err == nil || !strings.Contains(err.Error(), "no destination") {
+		t.Errorf("expected an error without destinations, got %v", err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	left := RegInvImage{
+		"same": DigestTags{
+			"sha256:000": TagSlice{"1.0"},
+		},
+		"changed": DigestTags{
+			"sha256:111": TagSlice{"1.0", "latest"},
+			"sha256:222": TagSlice{"0.9"},
+			"sha256:333": TagSlice{},
+		},
+		"only-left": DigestTags{
+			"sha256:444": TagSlice{"1.0"},
+		},
+	}
+	right := RegInvImage{
+		"same": DigestTags{
+			"sha256:000": TagSlice{"1.0"},
+		},
+		"changed": DigestTags{
+			"sha256:111": TagSlice{"1.0"},
+			"sha256:555": TagSlice{"latest", "2.0"},
+		},
+		"only-right": DigestTags{
+			"sha256:666": TagSlice{"1.0"},
+		},
+	}
+
+	d := Diff("left", "right", left, right)
+	expected := RegistryDiff{
+		Left:          "left",
+		Right:         "right",
+		MissingImages: []ImageName{"only-right"},
+		ExtraImages:   []ImageName{"only-left"},
+		MissingDigests: []DiffDigest{
+			{Image: "changed", Digest: "sha256:555", Tags: []Tag{"2.0", "latest"}},
+		},
+		ExtraDigests: []DiffDigest{
+			{Image: "changed", Digest: "sha256:222", Tags: []Tag{"0.9"}},
+			{Image: "changed", Digest: "sha256:333"},
+		},
+		MissingTags: []DiffTag{
+			{Image: "changed", Tag: "2.0", RightDigest: "sha256:555"},
+		},
+		ExtraTags: []DiffTag{
+			{Image: "changed", Tag: "0.9", LeftDigest: "sha256:222"},
+		},
+		DifferentTags: []DiffTag{
+			{
+				Image:       "changed",
+				Tag:         "latest",
+				LeftDigest:  "sha256:111",
+				RightDigest: "sha256:555",
+			},
+		},
+	}
+	checkError(t, checkEqual(d, expected), "Diff\n")
+	if d.IsEmpty() {
+		t.Errorf("expected differences")
+	}
+
+	gotYAML, err := d.ToYAML()
+	checkError(t, err, "unexpected error\n")
+	expectedYAML := `left: left
+right: right
+missingImages:
+- only-right
+extraImages:
+- only-left
+missingDigests:
+- image: changed
+  digest: sha256:555
+  tags:
+  - "2.0"
+  - latest
+extraDigests:
+- image: changed
+  digest: sha256:222
+  tags:
+  - "0.9"
+- image: changed
+  digest: sha256:333
+missingTags:
+- image: changed
+  tag: "2.0"
+  rightDigest: sha256:555
+extraTags:
+- image: changed
+  tag: "0.9"
+  leftDigest: sha256:222
+differentTags:
+- image: changed
+  tag: latest
+  leftDigest: sha256:111
+  rightDigest: sha256:555
+`
+	checkError(t, checkEqual(gotYAML, expectedYAML), "ToYAML\n")
+
+	uploaded, err := ParseSnapshotTime("2020-01-02")
+	checkError(t, err, "unexpected error\n")
+	d.AddDigestInfo(
+		RegInvDigestInfo{
+			{ImageName: "changed", Digest: "sha256:222"}: DigestInfo{
+				MediaType: cr.DockerManifestSchema2,
+				Size:      1234,
+				Uploaded:  uploaded}},
+		RegInvDigestInfo{
+			{ImageName: "changed", Digest: "sha256:555"}: DigestInfo{
+				MediaType: cr.DockerManifestList},
+			// Only ExtraDigests are annotated from the left side.
+			{ImageName: "changed", Digest: "sha256:333"}: DigestInfo{
+				Size: 1}})
+	expectedDigests := []DiffDigest{
+		{
+			Image:     "changed",
+			Digest:    "sha256:222",
+			Tags:      []Tag{"0.9"},
+			MediaType: string(cr.DockerManifestSchema2),
+			Size:      1234,
+			Uploaded:  "2020-01-02T00:00:00Z",
+		},
+		{
+			Image:  "changed",
+			Digest: "sha256:333",
+		},
+	}
+	checkError(t, checkEqual(d.ExtraDigests, expectedDigests),
+		"AddDigestInfo (left)\n")
+	if d.MissingDigests[0].MediaType != string(cr.DockerManifestList) {
+		t.Errorf("unexpected MissingDigests %v", d.MissingDigests)
+	}
+
+	same := Diff("left", "right", left, left)
+	if !same.IsEmpty() {
+		t.Errorf("expected no differences, got %v", same)
+	}
+	gotJSON, err := same.ToJSON()
+	checkError(t, err, "unexpected error\n")
+	expectedJSON := `{
+  "left": "left",
+  "right": "right"
+}
+`
+	checkError(t, checkEqual(gotJSON, expectedJSON), "ToJSON\n")
+}
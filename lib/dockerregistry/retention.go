@@ -0,0 +1,146 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"sort"
+	"time"
+
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+)
+
+// RetentionPolicy describes which digests of a (staging) registry to delete.
+// Digests whose upload time is unknown are never deleted.
+type RetentionPolicy struct {
+	// KeepTagged is the number of tagged digests to keep per image (the most
+	// recently uploaded ones); the older tagged digests are deleted, along
+	// with their tags. If it is 0, tagged digests are never deleted.
+	KeepTagged int
+
+	// UntaggedMaxAge is the age after which untagged digests are deleted. If
+	// it is 0, untagged digests are never deleted.
+	UntaggedMaxAge time.Duration
+}
+
+// ReferencedDigests returns all the digests that the given manifests
+// promote, in any image.
+func ReferencedDigests(mfests []Manifest) map[Digest]bool {
+	referenced := make(map[Digest]bool)
+	for _, mfest := range mfests {
+		for _, image := range mfest.Images {
+			for digest := range image.Dmap {
+				referenced[digest] = true
+			}
+		}
+	}
+	return referenced
+}
+
+// SelectForRetention returns the digests of rii (sorted by image and digest)
+// that policy deletes as of now, according to their DigestInfo in info.
+// Digests in referenced (see ReferencedDigests()) are never deleted, whatever
+// image they are in, and neither are the children (see ManifestListParents)
+// of the manifest lists that are kept: a child that several manifest lists
+// share is only deleted along with all of them.
+func SelectForRetention(
+	rii RegInvImage,
+	info RegInvDigestInfo,
+	parents ManifestListParents,
+	referenced map[Digest]bool,
+	policy RetentionPolicy,
+	now time.Time) []ImageDigest {
+
+	deleted := make(map[ImageDigest]bool)
+	for imageName, digestTags := range rii {
+		var tagged []ImageDigest
+		for digest, tags := range digestTags {
+			imageDigest := ImageDigest{ImageName: imageName, Digest: digest}
+			uploaded := info[imageDigest].Uploaded
+			if uploaded.IsZero() {
+				continue
+			}
+
+			if len(tags) > 0 {
+				tagged = append(tagged, imageDigest)
+			} else if policy.UntaggedMaxAge > 0 &&
+				now.Sub(uploaded) > policy.UntaggedMaxAge {
+				deleted[imageDigest] = true
+			}
+		}
+
+		if policy.KeepTagged <= 0 || len(tagged) <= policy.KeepTagged {
+			continue
+		}
+		// Most recently uploaded first (by digest for determinism).
+		sort.Slice(tagged, func(i, j int) bool {
+			ui, uj := info[tagged[i]].Uploaded, info[tagged[j]].Uploaded
+			if !ui.Equal(uj) {
+				return ui.After(uj)
+			}
+			return tagged[i].Digest < tagged[j].Digest
+		})
+		for _, imageDigest := range tagged[policy.KeepTagged:] {
+			deleted[imageDigest] = true
+		}
+	}
+
+	for imageDigest := range deleted {
+		if referenced[imageDigest.Digest] {
+			delete(deleted, imageDigest)
+		}
+	}
+	for imageDigest := range deleted {
+		for parent := range parents[imageDigest] {
+			parentImageDigest := ImageDigest{
+				ImageName: imageDigest.ImageName,
+				Digest:    parent,
+			}
+			if !deleted[parentImageDigest] {
+				delete(deleted, imageDigest)
+				break
+			}
+		}
+	}
+
+	deletions := make([]ImageDigest, 0, len(deleted))
+	for imageDigest := range deleted {
+		deletions = append(deletions, imageDigest)
+	}
+	sort.Slice(deletions, func(i, j int) bool {
+		if deletions[i].ImageName != deletions[j].ImageName {
+			return deletions[i].ImageName < deletions[j].ImageName
+		}
+		return deletions[i].Digest < deletions[j].Digest
+	})
+	return deletions
+}
+
+// ApplyRetention deletes the given digests (see SelectForRetention()) from the
+// registry rc, manifest lists first. With DryRun, the deletions are only
+// printed.
+func (sc *SyncContext) ApplyRetention(
+	rc RegistryContext,
+	deletions []ImageDigest,
+	mkProducer func(RegistryContext, ImageName, Digest) stream.Producer,
+	customProcessRequest *ProcessRequest) {
+
+	sc.deleteImageDigests(
+		"",
+		map[RegistryContext][]ImageDigest{rc: deletions},
+		mkProducer,
+		customProcessRequest)
+}
@@ -122,6 +122,14 @@ func (a RegInvImage) Minus(b RegInvImage) RegInvImage {
 	return toRegistryInventory(cSet)
 }
 
+// Intersection is a set operation.
+func (a RegInvImage) Intersection(b RegInvImage) RegInvImage {
+	aSet := a.ToSet()
+	bSet := b.ToSet()
+	cSet := aSet.Intersection(bSet)
+	return toRegistryInventory(cSet)
+}
+
 // Union is a set operation.
 func (a RegInvImage) Union(b RegInvImage) RegInvImage {
 	aSet := a.ToSet()
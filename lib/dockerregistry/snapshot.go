@@ -0,0 +1,324 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// SnapshotImage is an image in a JSON snapshot (see RegInvImage.ToJSON()).
+type SnapshotImage struct {
+	Name    ImageName        `json:"name"`
+	Digests []SnapshotDigest `json:"digests"`
+}
+
+// SnapshotDigest is a digest of a SnapshotImage, along with what the registry
+// reports about it (see DigestInfo) and its relationships with manifest lists.
+type SnapshotDigest struct {
+	Digest    Digest   `json:"digest"`
+	Tags      []Tag    `json:"tags"`
+	MediaType string   `json:"mediaType,omitempty"`
+	Size      uint64   `json:"size,omitempty"`
+	Created   string   `json:"created,omitempty"`
+	Uploaded  string   `json:"uploaded,omitempty"`
+	Parents   []Digest `json:"parents,omitempty"`
+	Children  []Digest `json:"children,omitempty"`
+}
+
+// ToJSON displays a RegInvImage as JSON, sorted like ToYAML(). Each digest is
+// annotated with its media type, size, and creation and upload times (in RFC
+// 3339 format) from info and, if it is part of manifest lists, its parents
+// (from parents); manifest lists are annotated with their children. Either map
+// may be nil, in which case there are no annotations of that kind.
+func (rii *RegInvImage) ToJSON(
+	info RegInvDigestInfo,
+	parents ManifestListParents) (string, error) {
+
+	children := make(map[ImageDigest][]Digest)
+	for child, childParents := range parents {
+		for parent := range childParents {
+			imageDigest := ImageDigest{ImageName: child.ImageName, Digest: parent}
+			children[imageDigest] = append(children[imageDigest], child.Digest)
+		}
+	}
+
+	images := make([]SnapshotImage, 0)
+	for _, image := range rii.ToSorted() {
+		snapshotImage := SnapshotImage{
+			Name:    ImageName(image.name),
+			Digests: make([]SnapshotDigest, 0, len(image.digests)),
+		}
+		for _, digestEntry := range image.digests {
+			digest := Digest(digestEntry.hash)
+			imageDigest := ImageDigest{
+				ImageName: ImageName(image.name),
+				Digest:    digest,
+			}
+			digestInfo := info[imageDigest]
+			snapshotDigest := SnapshotDigest{
+				Digest:    digest,
+				Tags:      make([]Tag, 0, len(digestEntry.tags)),
+				MediaType: string(digestInfo.MediaType),
+				Size:      digestInfo.Size,
+				Created:   formatSnapshotTime(digestInfo.Created),
+				Uploaded:  formatSnapshotTime(digestInfo.Uploaded),
+				Children:  children[imageDigest],
+			}
+			for _, tag := range digestEntry.tags {
+				snapshotDigest.Tags = append(snapshotDigest.Tags, Tag(tag))
+			}
+			for parent := range parents[imageDigest] {
+				snapshotDigest.Parents = append(snapshotDigest.Parents, parent)
+			}
+			sort.Slice(snapshotDigest.Parents, func(i, j int) bool {
+				return snapshotDigest.Parents[i] < snapshotDigest.Parents[j]
+			})
+			sort.Slice(snapshotDigest.Children, func(i, j int) bool {
+				return snapshotDigest.Children[i] < snapshotDigest.Children[j]
+			})
+			snapshotImage.Digests = append(snapshotImage.Digests, snapshotDigest)
+		}
+		images = append(images, snapshotImage)
+	}
+
+	b, err := json.MarshalIndent(images, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b) + "\n", nil
+}
+
+func formatSnapshotTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// SnapshotFilter selects the images, tags and digests that go into a
+// snapshot. The zero value selects everything; each field that is set
+// narrows the selection further.
+type SnapshotFilter struct {
+	// ImageGlob selects the images whose name, or one of whose parent paths,
+	// matches the glob (like path.Match), so that "foo" selects "foo/bar".
+	ImageGlob string
+	// ImageRegex selects the images whose name matches the (unanchored)
+	// regular expression.
+	ImageRegex *regexp.Regexp
+	// TagRegex selects the tags that match the (unanchored) regular
+	// expression; digests left without any tag are dropped.
+	TagRegex *regexp.Regexp
+	// CreatedAfter selects the digests created after the given time.
+	CreatedAfter time.Time
+	// UploadedAfter selects the digests uploaded after the given time.
+	UploadedAfter time.Time
+}
+
+// Validate checks that the filter can be applied.
+func (f *SnapshotFilter) Validate() error {
+	if _, err := path.Match(f.ImageGlob, ""); err != nil {
+		return fmt.Errorf("invalid image glob %q: %v", f.ImageGlob, err)
+	}
+	return nil
+}
+
+func (f *SnapshotFilter) selectsImage(imageName ImageName) bool {
+	if f.ImageGlob != "" {
+		matched := false
+		p := string(imageName)
+		for ; p != "." && p != "/"; p = path.Dir(p) {
+			// nolint[errcheck]
+			if matched, _ = path.Match(f.ImageGlob, p); matched {
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if f.ImageRegex != nil && !f.ImageRegex.MatchString(string(imageName)) {
+		return false
+	}
+	return true
+}
+
+func (f *SnapshotFilter) selectsDigest(info DigestInfo) bool {
+	if !f.CreatedAfter.IsZero() && !info.Created.After(f.CreatedAfter) {
+		return false
+	}
+	if !f.UploadedAfter.IsZero() && !info.Uploaded.After(f.UploadedAfter) {
+		return false
+	}
+	return true
+}
+
+// Apply returns the part of rii selected by the filter. The creation and
+// upload times of the digests are looked up in info; digests without any are
+// never selected by a date filter.
+func (f *SnapshotFilter) Apply(
+	rii RegInvImage,
+	info RegInvDigestInfo) (RegInvImage, error) {
+
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+
+	filtered := make(RegInvImage)
+	for imageName, digestTags := range rii {
+		if !f.selectsImage(imageName) {
+			continue
+		}
+
+		dmap := make(DigestTags)
+		for digest, tags := range digestTags {
+			imageDigest := ImageDigest{ImageName: imageName, Digest: digest}
+			if !f.selectsDigest(info[imageDigest]) {
+				continue
+			}
+
+			if f.TagRegex == nil {
+				dmap[digest] = tags
+				continue
+			}
+			var selected TagSlice
+			for _, tag := range tags {
+				if f.TagRegex.MatchString(string(tag)) {
+					selected = append(selected, tag)
+				}
+			}
+			if len(selected) > 0 {
+				dmap[digest] = selected
+			}
+		}
+		if len(dmap) > 0 {
+			filtered[imageName] = dmap
+		}
+	}
+
+	return filtered, nil
+}
+
+// ParseSnapshotTime parses the time given to a date filter of a snapshot,
+// either in RFC 3339 format or as a date (YYYY-MM-DD, at midnight UTC).
+func ParseSnapshotTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf(
+			"invalid time %q (expected YYYY-MM-DD or RFC 3339)", s)
+	}
+	return t, nil
+}
+
+// ThinManifestNameFor derives the name of a thin manifest (the <name> in
+// manifests/<name>/promoter-manifest.yaml) from a registry name, e.g.
+// "gcr.io/k8s-staging-foo" becomes "foo".
+func ThinManifestNameFor(registryName RegistryName) string {
+	name := string(registryName)
+	name = name[strings.LastIndex(name, "/")+1:]
+	return strings.TrimPrefix(name, "k8s-staging-")
+}
+
+// WriteThinManifest writes a thin manifest named name into the thin manifest
+// directory dir: manifests/<name>/promoter-manifest.yaml lists the registries
+// in rcs (a source and at least one destination), and images/<name>/images.yaml
+// has the images in rii. Existing files are never overwritten. The new manifest
+// is parsed back, so that it is known to be valid.
+func WriteThinManifest(
+	dir, name string,
+	rcs []RegistryContext,
+	rii RegInvImage) error {
+
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		return fmt.Errorf("invalid thin manifest name %q", name)
+	}
+	hasDest := false
+	for _, rc := range rcs {
+		if !rc.Src {
+			hasDest = true
+		}
+	}
+	if !hasDest {
+		return fmt.Errorf(
+			"thin manifest %q has no destination registries", name)
+	}
+
+	thinManifest := ThinManifest{Registries: rcs}
+	manifestYAML, err := yaml.Marshal(thinManifest)
+	if err != nil {
+		return err
+	}
+
+	manifestPath := filepath.Join(dir, "manifests", name, "promoter-manifest.yaml")
+	imagesPath := filepath.Join(dir, "images", name, "images.yaml")
+	files := []struct {
+		path    string
+		content string
+	}{
+		{manifestPath, string(manifestYAML)},
+		{imagesPath, rii.ToYAML()},
+	}
+	for _, f := range files {
+		if _, err := os.Stat(f.path); err == nil {
+			return fmt.Errorf("refusing to overwrite %q", f.path)
+		}
+	}
+	for _, f := range files {
+		if err := writeNewFile(f.path, f.content); err != nil {
+			return err
+		}
+	}
+
+	if _, err := ParseThinManifestFromFile(manifestPath); err != nil {
+		return fmt.Errorf("generated thin manifest %q is invalid: %v",
+			manifestPath, err)
+	}
+
+	return nil
+}
+
+// writeNewFile writes content to a file that must not exist yet, creating
+// its directory if needed.
+func writeNewFile(p, content string) error {
+	// nolint[gomnd]
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	// nolint[gomnd]
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(content); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -18,6 +18,7 @@ package inventory
 
 import (
 	"sync"
+	"time"
 
 	cr "github.com/google/go-containerregistry/pkg/v1/types"
 
@@ -56,8 +57,12 @@ type SyncContext struct {
 	RegistryContexts  []RegistryContext
 	SrcRegistry       *RegistryContext
 	Tokens            map[RootRepo]gcloud.Token
-	DigestMediaType   DigestMediaType
-	ParentDigest      ParentDigest
+	DigestInfo        MasterDigestInfo
+	// ManifestListParents is populated by ReadGCRManifestLists(), by registry.
+	ManifestListParents map[RegistryName]ManifestListParents
+	// UnreadManifestLists holds the manifest lists that ReadGCRManifestLists()
+	// could not read; the parents of their children are unknown.
+	UnreadManifestLists []GCRManifestListContext
 }
 
 // PromotionEdge represents a promotion "link" of an image repository between 2
@@ -291,12 +296,30 @@ type RegistryName string
 // ("foo/bar/baz/quux" in "gcr.io/hello/foo/bar/baz/quux").
 type ImageName string
 
-// DigestMediaType holds media information about a Digest.
-type DigestMediaType map[Digest]cr.MediaType
+// ManifestListParents maps the children of the manifest lists of a registry
+// (by image) to all the manifest lists of the same image that reference them.
+// It is a reverse mapping of ManifestLists, which point to all the child
+// manifests; a child that several manifest lists share keeps every parent.
+type ManifestListParents map[ImageDigest]map[Digest]bool
+
+// DigestInfo holds what the registry reports about a digest of an image,
+// besides its tags.
+type DigestInfo struct {
+	MediaType cr.MediaType
+	// Size is the size of the image in bytes, as reported by the registry (it
+	// is 0 for manifest lists).
+	Size     uint64
+	Created  time.Time
+	Uploaded time.Time
+}
+
+// RegInvDigestInfo holds the DigestInfo of every digest of every image in a
+// registry. It is keyed by image and digest, because the same digest can be
+// pushed to several images at different times.
+type RegInvDigestInfo map[ImageDigest]DigestInfo
 
-// ParentDigest holds a map of the digests of children to parent digests. It is
-// a reverse mapping of ManifestLists, which point to all the child manifests.
-type ParentDigest map[Digest]Digest
+// MasterDigestInfo is the DigestInfo counterpart of MasterInventory.
+type MasterDigestInfo map[RegistryName]RegInvDigestInfo
 
 // Digest is a string that contains the SHA256 hash of a Docker container image.
 type Digest string
@@ -373,6 +396,51 @@ type GCRPubSubPayload struct {
 	Tag string `json:"tag,omitempty"`
 }
 
+// ManifestIndex is a lookup-optimized view of the destination images in a set
+// of Manifests. It is keyed by exact FQINs and PQINs, so that a lookup does not
+// have to scan through every registry and image of every Manifest.
+type ManifestIndex struct {
+	fqins map[string]ManifestIndexEntry
+	// A PQIN can be claimed by more than one Manifest, each with a different
+	// digest (this is caught by checkOverlappingEdges() during promotion, but
+	// the index must still be able to represent it).
+	pqins map[string][]ManifestIndexEntry
+}
+
+// ManifestIndexEntry describes where a destination image comes from in the
+// promoter manifests.
+type ManifestIndexEntry struct {
+	// ManifestFile is the path of the Manifest that mentions the image.
+	ManifestFile string
+	Registry     RegistryName
+	ImageName    ImageName
+	Digest       Digest
+	Tag          Tag
+}
+
+// ReconciliationReport describes how the actual contents of a destination
+// registry differ from the intent of the promoter manifests. It is the result
+// of a full reconciliation sweep (as opposed to the per-event checks done by
+// the auditor).
+type ReconciliationReport struct {
+	Registry RegistryName
+	// UnexpectedDigests are digests found in the registry that no manifest
+	// wants to have promoted there.
+	UnexpectedDigests RegInvImageDigest
+	// UnexpectedTags are tags found in the registry that no manifest mentions.
+	UnexpectedTags RegInvImageTag
+	// TagDrift holds tags that are mentioned in the manifests, but which point
+	// to a different digest in the registry. The value is the digest found in
+	// the registry.
+	TagDrift RegInvImageTag
+	// Pending are promotions that have not happened yet, but which can still
+	// happen because the digest exists in the source registry.
+	Pending []PromotionEdge
+	// Lost are promotions that have not happened yet, and which cannot happen
+	// because the digest is missing from the source registry as well.
+	Lost []PromotionEdge
+}
+
 // Various conversion functions.
 
 // ToRegInvImageDigest converts a Manifest to a RegInvImageDigest.
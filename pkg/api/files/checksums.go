@@ -0,0 +1,103 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesapi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ChecksumsSHA256Sums is the format of checksum files written by sha256sum,
+// with one "<hex-encoded sha256>  <name>" line per file (a "*" instead of the
+// second space marks binary mode, which makes no difference to us).
+const ChecksumsSHA256Sums = "sha256sums"
+
+// ParseSHA256Sums parses the content of a checksum file in the
+// ChecksumsSHA256Sums format. The names in a checksum file are relative to
+// the directory it is in, which is given as dir (relative to the filestore
+// base); they must not point outside of it. A leading "./" (as written by
+// "sha256sum ./*") is ignored.
+func ParseSHA256Sums(b []byte, dir string) ([]File, error) {
+	// nolint[prealloc]
+	var files []File
+
+	lineNum := 0
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		// sha256sum escapes names with backslashes or newlines, and marks
+		// such lines with a leading backslash.
+		if strings.HasPrefix(line, "\\") {
+			return nil, fmt.Errorf(
+				"line %d: escaped names are not supported", lineNum)
+		}
+
+		// nolint[gomnd]
+		if len(line) < 67 || (line[64:66] != "  " && line[64:66] != " *") {
+			return nil, fmt.Errorf(
+				"line %d: expected \"<sha256>  <name>\"", lineNum)
+		}
+		sha256 := line[:64]
+		name := strings.TrimPrefix(line[66:], "./")
+
+		if _, err := hex.DecodeString(sha256); err != nil {
+			return nil, fmt.Errorf(
+				"line %d: sha256 was not valid (not hex): %q",
+				lineNum, sha256)
+		}
+
+		if !isCleanRelativePath(name) {
+			return nil, fmt.Errorf(
+				"line %d: name %q must be a clean, relative path",
+				lineNum, name)
+		}
+
+		files = append(files, File{
+			Name:   path.Join(dir, name),
+			SHA256: strings.ToLower(sha256),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// FormatSHA256Sums formats files in the ChecksumsSHA256Sums format, so that
+// they can be checked with "sha256sum --check" (and parsed by
+// ParseSHA256Sums). Names that sha256sum would need to escape are rejected.
+func FormatSHA256Sums(files []File) ([]byte, error) {
+	var b bytes.Buffer
+	for _, f := range files {
+		if strings.ContainsAny(f.Name, "\\\n\r") {
+			return nil, fmt.Errorf(
+				"file name %q cannot be written to a checksum file", f.Name)
+		}
+		fmt.Fprintf(&b, "%s  %s\n", strings.ToLower(f.SHA256), f.Name)
+	}
+	return b.Bytes(), nil
+}
@@ -31,6 +31,29 @@ type Filestore struct {
 	Base           string `json:"base,omitempty"`
 	ServiceAccount string `json:"service-account,omitempty"`
 	Src            bool   `json:"src,omitempty"`
+
+	// Endpoint is the URL of the S3 API to use for s3:// filestores, e.g.
+	// "http://localhost:9000" for a local MinIO. It defaults to the AWS
+	// endpoint for the Region.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Region is the region of an s3:// filestore (default: us-east-1).
+	Region string `json:"region,omitempty"`
+	// CredentialsFile is the path to a YAML file holding the accessKeyID,
+	// secretAccessKey and (optionally) sessionToken for an s3:// filestore.
+	// If not set, the standard AWS_* environment variables are used. Like
+	// ServiceAccount, it is only used if service accounts are enabled.
+	CredentialsFile string `json:"credentials-file,omitempty"`
+
+	// Sidecars lists the checksum files to write next to every promoted file
+	// in a destination filestore. Supported values are "sha256" and "sha512";
+	// e.g. with "sha256", "foo.tar.gz" gets a "foo.tar.gz.sha256" holding its
+	// hex-encoded SHA256.
+	Sidecars []string `json:"sidecars,omitempty"`
+
+	// Immutable makes it an error for a file in this (destination) filestore
+	// to have different content than the file in the manifest; by default,
+	// the file is overwritten. This can be overridden with -allow-overwrite.
+	Immutable bool `json:"immutable,omitempty"`
 }
 
 // File holds information about a file artifact.
@@ -40,6 +63,13 @@ type File struct {
 	Name string `json:"name"`
 	// SHA256 holds the SHA256 hash of the specified file (hex encoded)
 	SHA256 string `json:"sha256,omitempty"`
+
+	// Checksums marks the file as a checksum file, in the given format
+	// (ChecksumsSHA256Sums is the only one supported). Besides being promoted
+	// itself, the file is read from the source filestore (and verified
+	// against SHA256), and every file that it lists is promoted too, just as
+	// if it had been listed in the manifest.
+	Checksums string `json:"checksums,omitempty"`
 }
 
 // Manifest stores the information in a manifest file (describing the
@@ -47,8 +77,8 @@ type File struct {
 type Manifest struct {
 	// Filestores contains the source and destination (Src/Dest) filestores.
 	// Filestores are (for example) GCS or S3 buckets.
-	// It is possible that in the future, we support promoting to multiple
-	// filestores, in which case we would have more than just Src/Dest.
+	// There is exactly one source, but there may be any number of
+	// destinations; each file is downloaded once and copied to all of them.
 	Filestores []Filestore `json:"filestores,omitempty"`
 	Files      []File      `json:"files,omitempty"`
 }
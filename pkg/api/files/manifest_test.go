@@ -18,6 +18,10 @@ package filesapi
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -73,10 +77,88 @@ func TestValidateFilestores(t *testing.T) {
 		{
 			filestores: []Filestore{
 				{Src: true, Base: "gs://src"},
-				{Base: "s3://dest"},
+				{Base: "ftp://dest"},
 			},
 			expectedError: "unsupported scheme in base",
 		},
+		{
+			filestores: []Filestore{
+				{Src: true, Base: "gs://src"},
+				{Base: "s3://dest"},
+			},
+		},
+		{
+			filestores: []Filestore{
+				{Src: true, Base: "gs://src"},
+				{
+					Base:            "s3://dest/prefix",
+					Endpoint:        "http://localhost:9000",
+					Region:          "eu-west-1",
+					CredentialsFile: "/etc/promoter/s3.yaml",
+				},
+			},
+		},
+		{
+			filestores: []Filestore{
+				{Src: true, Base: "file:///srv/staging"},
+				{Base: "file:///srv/mirror"},
+			},
+		},
+		{
+			filestores: []Filestore{
+				{Src: true, Base: "file://staging"},
+				{Base: "file:///srv/mirror"},
+			},
+			expectedError: "must have an absolute path",
+		},
+		{
+			filestores: []Filestore{
+				{Src: true, Base: "gs://src", Region: "eu-west-1"},
+				{Base: "s3://dest"},
+			},
+			expectedError: "only supported for s3:// filestores",
+		},
+		{
+			filestores: []Filestore{
+				{Src: true, Base: "gs://src"},
+				{Base: "s3://dest", Endpoint: "localhost:9000"},
+			},
+			expectedError: "must be http:// or https://",
+		},
+		{
+			filestores: []Filestore{
+				{Src: true, Base: "gs://src"},
+				{Base: "s3://dest", Endpoint: "https://example.com/bucket"},
+			},
+			expectedError: "must be of the form scheme://host[:port]",
+		},
+		{
+			filestores: []Filestore{
+				{Src: true, Base: "gs://src"},
+				{Base: "gs://dest", Sidecars: []string{"sha256", "sha512"}},
+			},
+		},
+		{
+			filestores: []Filestore{
+				{Src: true, Base: "gs://src"},
+				{Base: "gs://dest", Sidecars: []string{"md5"}},
+			},
+			expectedError: "unsupported sidecar",
+		},
+		{
+			filestores: []Filestore{
+				{Src: true, Base: "gs://src"},
+				{Base: "gs://dest", Sidecars: []string{"sha256", "sha256"}},
+			},
+			expectedError: "duplicate sidecar",
+		},
+		{
+			filestores: []Filestore{
+				{Src: true, Base: "gs://src", Sidecars: []string{"sha256"}},
+				{Base: "gs://dest"},
+			},
+			expectedError: "not supported for the source filestore",
+		},
 	}
 	for _, test := range tests {
 		err := validateFilestores(test.filestores)
@@ -113,6 +195,35 @@ func TestValidateFiles(t *testing.T) {
 			},
 			expectedError: "name is required for file",
 		},
+		{
+			files: []File{
+				{Name: "dir/foo", SHA256: oksha},
+			},
+		},
+		{
+			files: []File{
+				{Name: "../foo", SHA256: oksha},
+			},
+			expectedError: "must be a clean relative path",
+		},
+		{
+			files: []File{
+				{Name: "dir/../../foo", SHA256: oksha},
+			},
+			expectedError: "must be a clean relative path",
+		},
+		{
+			files: []File{
+				{Name: "/etc/passwd", SHA256: oksha},
+			},
+			expectedError: "must be a clean relative path",
+		},
+		{
+			files: []File{
+				{Name: "./foo", SHA256: oksha},
+			},
+			expectedError: "must be a clean relative path",
+		},
 		{
 			files: []File{
 				{Name: "foo", SHA256: "bad"},
@@ -131,6 +242,17 @@ func TestValidateFiles(t *testing.T) {
 			},
 			expectedError: "sha256 was not valid (bad length)",
 		},
+		{
+			files: []File{
+				{Name: "SHA256SUMS", SHA256: oksha, Checksums: "sha256sums"},
+			},
+		},
+		{
+			files: []File{
+				{Name: "MD5SUMS", SHA256: oksha, Checksums: "md5sums"},
+			},
+			expectedError: "unsupported checksums format",
+		},
 	}
 	for _, test := range tests {
 		err := validateFiles(test.files)
@@ -138,6 +260,202 @@ func TestValidateFiles(t *testing.T) {
 	}
 }
 
+func TestParseSHA256Sums(t *testing.T) {
+	oksha := "4f2f040fa2bfe9bea64911a2a756e8a1727a8bfd757c5e031631a6e699fcf246"
+
+	var tests = []struct {
+		content       string
+		dir           string
+		expected      []File
+		expectedError string
+	}{
+		{
+			content: oksha + "  foo\n\n" +
+				strings.ToUpper(oksha) + " *bin/bar\r\n",
+			dir: "v1.0",
+			expected: []File{
+				{Name: "v1.0/foo", SHA256: oksha},
+				{Name: "v1.0/bin/bar", SHA256: oksha},
+			},
+		},
+		{
+			content:  oksha + "  foo",
+			dir:      ".",
+			expected: []File{{Name: "foo", SHA256: oksha}},
+		},
+		{
+			content:  oksha + "  ./foo\n" + oksha + " *./bin/bar\n",
+			dir:      "v1.0",
+			expected: []File{
+				{Name: "v1.0/foo", SHA256: oksha},
+				{Name: "v1.0/bin/bar", SHA256: oksha},
+			},
+		},
+		{
+			content:       oksha + " foo\n",
+			expectedError: "line 1: expected",
+		},
+		{
+			content:       "\\" + oksha + "  foo\\nbar\n",
+			expectedError: "escaped names are not supported",
+		},
+		{
+			content:       strings.Repeat("x", 64) + "  foo\n",
+			expectedError: "not hex",
+		},
+		{
+			content:       oksha + "  ../foo\n",
+			expectedError: "must be a clean, relative path",
+		},
+		{
+			content:       oksha + "  /foo\n",
+			expectedError: "must be a clean, relative path",
+		},
+		{
+			content:       oksha + "  foo/./bar\n",
+			expectedError: "must be a clean, relative path",
+		},
+	}
+	for _, test := range tests {
+		files, err := ParseSHA256Sums([]byte(test.content), test.dir)
+		checkErrorMatchesExpected(t, err, test.expectedError)
+		if !reflect.DeepEqual(files, test.expected) {
+			t.Errorf("got %v, want %v", files, test.expected)
+		}
+	}
+}
+
+func TestFormatSHA256Sums(t *testing.T) {
+	oksha := "4f2f040fa2bfe9bea64911a2a756e8a1727a8bfd757c5e031631a6e699fcf246"
+
+	files := []File{
+		{Name: "foo", SHA256: oksha},
+		{Name: "bin/bar baz", SHA256: strings.ToUpper(oksha)},
+	}
+	b, err := FormatSHA256Sums(files)
+	if err != nil {
+		t.Fatalf("error formatting files: %v", err)
+	}
+	expected := oksha + "  foo\n" + oksha + "  bin/bar baz\n"
+	if string(b) != expected {
+		t.Errorf("got %q, want %q", b, expected)
+	}
+
+	parsed, err := ParseSHA256Sums(b, ".")
+	if err != nil {
+		t.Fatalf("error parsing formatted files: %v", err)
+	}
+	files[1].SHA256 = oksha
+	if !reflect.DeepEqual(parsed, files) {
+		t.Errorf("round trip: got %v, want %v", parsed, files)
+	}
+
+	_, err = FormatSHA256Sums([]File{{Name: "foo\nbar", SHA256: oksha}})
+	checkErrorMatchesExpected(t, err, "cannot be written to a checksum file")
+}
+
+func TestParseThinManifestsFromDir(t *testing.T) {
+	oksha := "4f2f040fa2bfe9bea64911a2a756e8a1727a8bfd757c5e031631a6e699fcf246"
+	filestores := "filestores:\n" +
+		"- base: gs://staging\n" +
+		"  src: true\n" +
+		"- base: gs://prod\n"
+	files := "files:\n" +
+		"- name: foo\n" +
+		"  sha256: " + oksha + "\n"
+
+	var tests = []struct {
+		name          string
+		files         map[string]string
+		expectedCount int
+		expectedError string
+	}{
+		{
+			name: "two projects",
+			files: map[string]string{
+				"filestores/a/filestores.yaml": filestores,
+				"files/a/files.yaml":           files,
+				"filestores/b/filestores.yaml": filestores,
+				"files/b/files.yaml":           files,
+				// Directories without filestores are ignored.
+				"filestores/c/README.md": "",
+			},
+			expectedCount: 2,
+		},
+		{
+			name: "no files directory",
+			files: map[string]string{
+				"filestores/a/filestores.yaml": filestores,
+			},
+			expectedError: "no such file or directory",
+		},
+		{
+			name: "missing files",
+			files: map[string]string{
+				"filestores/a/filestores.yaml": filestores,
+				"files/b/files.yaml":           files,
+			},
+			expectedError: "files/a/files.yaml\" does not exist",
+		},
+		{
+			name: "files in filestores",
+			files: map[string]string{
+				"filestores/a/filestores.yaml": filestores + files,
+				"files/a/files.yaml":           files,
+			},
+			expectedError: "files should not be present",
+		},
+		{
+			name: "filestores in files",
+			files: map[string]string{
+				"filestores/a/filestores.yaml": filestores,
+				"files/a/files.yaml":           filestores + files,
+			},
+			expectedError: "filestores should not be present",
+		},
+		{
+			name: "invalid manifest",
+			files: map[string]string{
+				"filestores/a/filestores.yaml": "filestores: []\n",
+				"files/a/files.yaml":           files,
+			},
+			expectedError: "error validating manifest of project \"a\"",
+		},
+		{
+			name: "no projects",
+			files: map[string]string{
+				"filestores/README.md": "",
+				"files/README.md":      "",
+			},
+			expectedError: "no manifests found",
+		},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "thin-manifests")
+		if err != nil {
+			t.Fatalf("error creating temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		for name, content := range test.files {
+			p := filepath.Join(dir, name)
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				t.Fatalf("error creating dir: %v", err)
+			}
+			if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+				t.Fatalf("error writing %q: %v", p, err)
+			}
+		}
+
+		manifests, err := ParseThinManifestsFromDir(dir)
+		checkErrorMatchesExpected(t, err, test.expectedError)
+		if len(manifests) != test.expectedCount {
+			t.Errorf("%s: expected %d manifests, got %d",
+				test.name, test.expectedCount, len(manifests))
+		}
+	}
+}
+
 func checkErrorMatchesExpected(t *testing.T, err error, expected string) {
 	if err != nil && expected == "" {
 		t.Errorf("unexpected error: %v", err)
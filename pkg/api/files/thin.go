@@ -0,0 +1,191 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesapi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"k8s.io/klog"
+)
+
+// The layout of a thin manifest directory for files. Every project <proj>
+// has its filestores in "filestores/<proj>/filestores.yaml", and its files in
+// "files/<proj>/files.yaml". Keeping the filestores apart from the files
+// allows stricter ACLs (e.g. via OWNERS files) on the filestores, which
+// decide where files are written, than on the lists of files.
+const (
+	ThinFilestoresDir      = "filestores"
+	ThinFilestoresFileName = "filestores.yaml"
+	ThinFilesDir           = "files"
+	ThinFilesFileName      = "files.yaml"
+)
+
+// ParseThinManifestsFromDir reads the manifests of all projects in a thin
+// manifest directory, in the order of the project names. Each manifest is
+// validated.
+func ParseThinManifestsFromDir(dir string) ([]Manifest, error) {
+	projects, err := ValidateThinManifestDirectoryStructure(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := make([]Manifest, 0, len(projects))
+	for _, project := range projects {
+		manifest, err := parseThinManifest(dir, project)
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, *manifest)
+	}
+
+	if len(manifests) == 0 {
+		return nil, fmt.Errorf("no manifests found in dir: %s", dir)
+	}
+
+	return manifests, nil
+}
+
+// parseThinManifest reads and validates the manifest of a single project.
+func parseThinManifest(dir, project string) (*Manifest, error) {
+	filestoresPath := filepath.Join(
+		dir, ThinFilestoresDir, project, ThinFilestoresFileName)
+	filestores, err := parseManifestFile(filestoresPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(filestores.Files) != 0 {
+		return nil, fmt.Errorf(
+			"files should not be present in filestore manifest %q",
+			filestoresPath)
+	}
+
+	filesPath := filepath.Join(dir, ThinFilesDir, project, ThinFilesFileName)
+	files, err := parseManifestFile(filesPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(files.Filestores) != 0 {
+		return nil, fmt.Errorf(
+			"filestores should not be present in manifest %q",
+			filesPath)
+	}
+
+	manifest := &Manifest{
+		Filestores: filestores.Filestores,
+		Files:      files.Files,
+	}
+	if err := manifest.Validate(); err != nil {
+		return nil, fmt.Errorf(
+			"error validating manifest of project %q: %v", project, err)
+	}
+	return manifest, nil
+}
+
+func parseManifestFile(p string) (*Manifest, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest %q: %v", p, err)
+	}
+
+	manifest, err := ParseManifest(b)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing manifest %q: %v", p, err)
+	}
+	return manifest, nil
+}
+
+// ValidateThinManifestDirectoryStructure enforces the directory structure of
+// thin manifests for files (see ThinFilestoresDir), and returns the names of
+// the projects in it. Most importantly, it requires that if a file named
+// "foo/filestores/bar/filestores.yaml" exists, a corresponding file named
+// "foo/files/bar/files.yaml" must also exist.
+func ValidateThinManifestDirectoryStructure(dir string) ([]string, error) {
+	if err := validateIsDirectory(filepath.Join(dir, ThinFilesDir)); err != nil {
+		return nil, err
+	}
+
+	filestoresDir := filepath.Join(dir, ThinFilestoresDir)
+	if err := validateIsDirectory(filestoresDir); err != nil {
+		return nil, err
+	}
+
+	// ReadDir sorts the entries by name.
+	entries, err := ioutil.ReadDir(filestoresDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var projects []string
+	for _, entry := range entries {
+		p, err := os.Stat(filepath.Join(filestoresDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		// Skip non-directory sub-paths.
+		if !p.IsDir() {
+			continue
+		}
+
+		filestoresInfo, err := os.Stat(
+			filepath.Join(filestoresDir, entry.Name(), ThinFilestoresFileName))
+		if err != nil {
+			klog.Warningln(err)
+			continue
+		}
+		if !filestoresInfo.Mode().IsRegular() {
+			klog.Warningf("ignoring irregular file %q", filestoresInfo.Name())
+			continue
+		}
+
+		// The filestores exist, so the corresponding files MUST exist too.
+		filesPath := filepath.Join(
+			dir, ThinFilesDir, entry.Name(), ThinFilesFileName)
+		filesInfo, err := os.Stat(filesPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf(
+					"corresponding file %q does not exist", filesPath)
+			}
+			return nil, err
+		}
+		if !filesInfo.Mode().IsRegular() {
+			return nil, fmt.Errorf(
+				"corresponding file %q is not a regular file", filesPath)
+		}
+
+		projects = append(projects, entry.Name())
+	}
+
+	return projects, nil
+}
+
+// validateIsDirectory returns nil if dir is a directory, otherwise a non-nil
+// error.
+func validateIsDirectory(dir string) error {
+	p, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !p.IsDir() {
+		return fmt.Errorf("%q is not a directory", dir)
+	}
+	return nil
+}
@@ -19,6 +19,8 @@ package filesapi
 import (
 	"encoding/hex"
 	"fmt"
+	"net/url"
+	"path"
 	"strings"
 )
 
@@ -50,13 +52,35 @@ func validateFilestores(filestores []Filestore) error {
 			return fmt.Errorf("filestore did not have base set")
 		}
 
-		// Currently the only backend supported is GCS
-		if !strings.HasPrefix(filestore.Base, "gs://") {
+		switch {
+		case strings.HasPrefix(filestore.Base, "gs://"),
+			strings.HasPrefix(filestore.Base, "file://"):
+			if filestore.Endpoint != "" || filestore.Region != "" ||
+				filestore.CredentialsFile != "" {
+				return fmt.Errorf(
+					"endpoint, region and credentials-file are only supported for s3:// filestores (%q)",
+					filestore.Base)
+			}
+			if strings.HasPrefix(filestore.Base, "file://") &&
+				!strings.HasPrefix(filestore.Base, "file:///") {
+				return fmt.Errorf(
+					"file:// filestore must have an absolute path (%q)",
+					filestore.Base)
+			}
+		case strings.HasPrefix(filestore.Base, "s3://"):
+			if err := validateEndpoint(filestore.Endpoint); err != nil {
+				return err
+			}
+		default:
 			return fmt.Errorf(
 				"filestore has unsupported scheme in base %q",
 				filestore.Base)
 		}
 
+		if err := validateSidecars(filestore); err != nil {
+			return err
+		}
+
 		if filestore.Src {
 			if source != nil {
 				return fmt.Errorf("found multiple source filestores")
@@ -77,6 +101,61 @@ func validateFilestores(filestores []Filestore) error {
 	return nil
 }
 
+// validateSidecars checks that only supported sidecars are requested, and
+// only for destination filestores.
+func validateSidecars(filestore *Filestore) error {
+	if len(filestore.Sidecars) == 0 {
+		return nil
+	}
+	if filestore.Src {
+		return fmt.Errorf(
+			"sidecars are not supported for the source filestore (%q)",
+			filestore.Base)
+	}
+
+	seen := make(map[string]bool)
+	for _, sidecar := range filestore.Sidecars {
+		switch sidecar {
+		case "sha256", "sha512":
+		default:
+			return fmt.Errorf(
+				"unsupported sidecar %q for filestore %q"+
+					" (supported sidecars: sha256, sha512)",
+				sidecar, filestore.Base)
+		}
+		if seen[sidecar] {
+			return fmt.Errorf(
+				"duplicate sidecar %q for filestore %q",
+				sidecar, filestore.Base)
+		}
+		seen[sidecar] = true
+	}
+
+	return nil
+}
+
+// validateEndpoint checks that the endpoint of a filestore (if any) is an
+// http:// or https:// URL without a path.
+func validateEndpoint(endpoint string) error {
+	if endpoint == "" {
+		return nil
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("endpoint %q was not valid: %v", endpoint, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("endpoint %q must be http:// or https://", endpoint)
+	}
+	if u.Host == "" || strings.Trim(u.Path, "/") != "" {
+		return fmt.Errorf(
+			"endpoint %q must be of the form scheme://host[:port]", endpoint)
+	}
+
+	return nil
+}
+
 // validateFiles validates the Files field of the manifest
 func validateFiles(files []File) error {
 	if len(files) == 0 {
@@ -90,6 +169,12 @@ func validateFiles(files []File) error {
 			return fmt.Errorf("name is required for file")
 		}
 
+		if !isCleanRelativePath(f.Name) {
+			return fmt.Errorf(
+				"name %q must be a clean relative path (without \"..\")",
+				f.Name)
+		}
+
 		if f.SHA256 == "" {
 			return fmt.Errorf("sha256 is required for file")
 		}
@@ -103,7 +188,24 @@ func validateFiles(files []File) error {
 		if len(sha256) != 32 {
 			return fmt.Errorf("sha256 was not valid (bad length): %q", f.SHA256)
 		}
+
+		if f.Checksums != "" && f.Checksums != ChecksumsSHA256Sums {
+			return fmt.Errorf(
+				"unsupported checksums format %q for file %q"+
+					" (supported formats: %s)",
+				f.Checksums, f.Name, ChecksumsSHA256Sums)
+		}
 	}
 
 	return nil
 }
+
+// isCleanRelativePath reports whether name is a relative, slash-separated path
+// that stays within the directory it is relative to.
+func isCleanRelativePath(name string) bool {
+	return path.Clean(name) == name &&
+		!path.IsAbs(name) &&
+		name != "." &&
+		name != ".." &&
+		!strings.HasPrefix(name, "../")
+}
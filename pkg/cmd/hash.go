@@ -18,7 +18,9 @@ package cmd
 
 import (
 	"context"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -31,51 +33,139 @@ import (
 type GenerateManifestOptions struct {
 	// BaseDir is the directory containing the files to hash
 	BaseDir string
+
+	// Src is the base of a filestore (e.g. gs://bucket/prefix) containing the
+	// files to hash; it is an alternative to BaseDir.
+	Src string
+
+	// UseServiceAccount allows the use of service-accounts to read Src
+	UseServiceAccount bool
+
+	// Include holds globs of the files to hash (all files, if empty)
+	Include []string
+
+	// Exclude holds globs of files not to hash, even if included
+	Exclude []string
+
+	// Threads is the number of files to hash concurrently
+	Threads int
 }
 
 // PopulateDefaults sets the default values for GenerateManifestOptions
 func (o *GenerateManifestOptions) PopulateDefaults() {
-	// There are no fields with non-empty default values
-	// (but we still want to follow the PopulateDefaults pattern)
+	o.Threads = 10
 }
 
-// GenerateManifest generates a manifest containing the files in options.BaseDir
+// GenerateManifest generates a manifest containing the files in
+// options.BaseDir (or options.Src), sorted by name.
+//
+// The globs in options.Include and options.Exclude are matched (like
+// path.Match) against the path of each file relative to the base, and
+// against each of its parent directories; so "*.txt" matches only files at
+// the top level, and "docs" matches everything under docs/.
 // nolint[lll]
 func GenerateManifest(ctx context.Context, options GenerateManifestOptions) (*api.Manifest, error) {
 	manifest := &api.Manifest{}
 
-	if options.BaseDir == "" {
-		return nil, xerrors.New("must specify BaseDir")
-	}
+	src := options.Src
+	if options.BaseDir != "" {
+		if src != "" {
+			return nil, xerrors.New("cannot specify both BaseDir and Src")
+		}
 
-	basedir := options.BaseDir
-	if !strings.HasSuffix(basedir, "/") {
-		basedir += "/"
-	}
+		info, err := os.Stat(options.BaseDir)
+		if err != nil {
+			return nil, xerrors.Errorf("error reading %q: %w", options.BaseDir, err)
+		}
+		if !info.IsDir() {
+			return nil, xerrors.Errorf("%q is not a directory", options.BaseDir)
+		}
 
-	if err := filepath.Walk(basedir, func(p string, info os.FileInfo, err error) error {
+		basedir, err := filepath.Abs(options.BaseDir)
 		if err != nil {
-			return err
+			return nil, xerrors.Errorf("cannot resolve %q to absolute path: %w", options.BaseDir, err)
 		}
-		if !strings.HasPrefix(p, basedir) {
-			return xerrors.Errorf("expected path %q to have prefix %q", p, basedir)
+		src = (&url.URL{Scheme: "file", Path: filepath.ToSlash(basedir)}).String()
+	}
+	if src == "" {
+		return nil, xerrors.New("must specify BaseDir or Src")
+	}
+
+	for _, pattern := range append(options.Include, options.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, xerrors.Errorf("invalid glob %q: %w", pattern, err)
+		}
+	}
+	include := func(name string) bool {
+		if len(options.Include) != 0 && !matchesAnyGlob(options.Include, name) {
+			return false
 		}
+		return !matchesAnyGlob(options.Exclude, name)
+	}
 
-		if !info.IsDir() {
-			relativePath := strings.TrimPrefix(p, basedir)
-			sha256, err := filepromoter.ComputeSHA256ForFile(p)
-			if err != nil {
-				return xerrors.Errorf("error hashing file %q: %w", p, err)
+	filestore := &api.Filestore{Base: src, Src: true}
+	files, err := filepromoter.HashFilestore(ctx, filestore, options.UseServiceAccount, include, options.Threads)
+	if err != nil {
+		return nil, xerrors.Errorf("error hashing files in %q: %w", src, err)
+	}
+	manifest.Files = files
+
+	return manifest, nil
+}
+
+// matchesAnyGlob returns true if one of the (already validated) patterns
+// matches name, or one of the parent directories of name.
+func matchesAnyGlob(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		for p := name; p != "." && p != "/"; p = path.Dir(p) {
+			if matched, _ := path.Match(pattern, p); matched {
+				return true
 			}
-			manifest.Files = append(manifest.Files, api.File{
-				Name:   relativePath,
-				SHA256: sha256,
+		}
+	}
+	return false
+}
+
+// ChangedFile is a file whose sha256 in a generated manifest is not the one
+// in the manifest it is merged into.
+type ChangedFile struct {
+	Name      string
+	OldSHA256 string
+	NewSHA256 string
+}
+
+// MergeManifest merges the files of a generated manifest into an existing
+// one. The existing files are kept as they are (in the same order, and with
+// their sha256 even if it changed), and the files that are new are appended
+// in the order of the generated manifest. Files whose sha256 changed are
+// returned, so that they can be flagged for review: a promoted file should
+// never change.
+func MergeManifest(existing, generated *api.Manifest) (*api.Manifest, []ChangedFile) {
+	merged := &api.Manifest{
+		Filestores: existing.Filestores,
+	}
+	merged.Files = append(merged.Files, existing.Files...)
+
+	known := make(map[string]string)
+	for _, f := range existing.Files {
+		known[f.Name] = f.SHA256
+	}
+
+	var changed []ChangedFile
+	for _, f := range generated.Files {
+		sha256, found := known[f.Name]
+		if !found {
+			merged.Files = append(merged.Files, f)
+			continue
+		}
+		if !strings.EqualFold(sha256, f.SHA256) {
+			changed = append(changed, ChangedFile{
+				Name:      f.Name,
+				OldSHA256: sha256,
+				NewSHA256: f.SHA256,
 			})
 		}
-		return nil
-	}); err != nil {
-		return nil, xerrors.Errorf("error walking path %q: %w", options.BaseDir, err)
 	}
 
-	return manifest, nil
+	return merged, changed
 }
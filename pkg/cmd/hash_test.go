@@ -2,11 +2,19 @@ package cmd
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 
 	"k8s.io/utils/diff"
+	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
 	"sigs.k8s.io/yaml"
 )
 
@@ -31,6 +39,205 @@ func TestHash(t *testing.T) {
 	AssertMatchesFile(t, string(manifestYAML), "testdata/files-manifest.yaml")
 }
 
+func TestGenerateManifestFilters(t *testing.T) {
+	ctx := context.Background()
+
+	srcDir, err := filepath.Abs("testdata/files")
+	if err != nil {
+		t.Fatalf("error getting absolute path: %v", err)
+	}
+
+	var tests = []struct {
+		include       []string
+		exclude       []string
+		expected      []string
+		expectedError string
+	}{
+		{
+			expected: []string{"blue.png", "green.png", "red.png"},
+		},
+		{
+			include:  []string{"blue.*", "r*"},
+			expected: []string{"blue.png", "red.png"},
+		},
+		{
+			exclude:  []string{"g*"},
+			expected: []string{"blue.png", "red.png"},
+		},
+		{
+			include:  []string{"*.png"},
+			exclude:  []string{"red.png"},
+			expected: []string{"blue.png", "green.png"},
+		},
+		{
+			exclude:       []string{"[-"},
+			expectedError: "invalid glob",
+		},
+	}
+	for _, test := range tests {
+		var opt GenerateManifestOptions
+		opt.PopulateDefaults()
+		opt.Src = "file://" + filepath.ToSlash(srcDir)
+		opt.Include = test.include
+		opt.Exclude = test.exclude
+
+		manifest, err := GenerateManifest(ctx, opt)
+		if test.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+				t.Errorf("expected error %q, got %v", test.expectedError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("failed to generate manifest: %v", err)
+		}
+
+		var names []string
+		for _, f := range manifest.Files {
+			names = append(names, f.Name)
+		}
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("include=%v exclude=%v: got %v, want %v",
+				test.include, test.exclude, names, test.expected)
+		}
+	}
+}
+
+func TestGenerateManifestParallel(t *testing.T) {
+	ctx := context.Background()
+
+	tempDir, err := ioutil.TempDir("", "hash")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var expected []api.File
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("dir%d/file%02d", i%3, i)
+		content := []byte(strings.Repeat(name, i))
+		p := filepath.Join(tempDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("error creating dir: %v", err)
+		}
+		if err := ioutil.WriteFile(p, content, 0644); err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+		sum := sha256.Sum256(content)
+		expected = append(expected, api.File{
+			Name:   name,
+			SHA256: hex.EncodeToString(sum[:]),
+		})
+	}
+	sort.Slice(expected, func(i, j int) bool {
+		return expected[i].Name < expected[j].Name
+	})
+
+	for _, threads := range []int{1, 4, 100} {
+		var opt GenerateManifestOptions
+		opt.PopulateDefaults()
+		opt.BaseDir = tempDir
+		opt.Threads = threads
+
+		manifest, err := GenerateManifest(ctx, opt)
+		if err != nil {
+			t.Fatalf("failed to generate manifest: %v", err)
+		}
+		if !reflect.DeepEqual(manifest.Files, expected) {
+			t.Errorf("threads=%d: unexpected files %v", threads, manifest.Files)
+		}
+	}
+}
+
+func TestGenerateManifestBaseDirURL(t *testing.T) {
+	ctx := context.Background()
+
+	// These characters would end the path (or be unescaped) if the base
+	// directory were not escaped in the file:// URL.
+	tempDir, err := ioutil.TempDir("", "hash#?%")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	content := []byte("hello")
+	if err := ioutil.WriteFile(filepath.Join(tempDir, "a"), content, 0644); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	sum := sha256.Sum256(content)
+
+	var opt GenerateManifestOptions
+	opt.PopulateDefaults()
+	opt.BaseDir = tempDir
+
+	manifest, err := GenerateManifest(ctx, opt)
+	if err != nil {
+		t.Fatalf("failed to generate manifest: %v", err)
+	}
+	expected := []api.File{{Name: "a", SHA256: hex.EncodeToString(sum[:])}}
+	if !reflect.DeepEqual(manifest.Files, expected) {
+		t.Errorf("unexpected files %v", manifest.Files)
+	}
+}
+
+func TestMatchesAnyGlob(t *testing.T) {
+	var tests = []struct {
+		patterns []string
+		name     string
+		expected bool
+	}{
+		{[]string{"*.txt"}, "a.txt", true},
+		{[]string{"*.txt"}, "dir/a.txt", false},
+		{[]string{"*/*.txt"}, "dir/a.txt", true},
+		{[]string{"dir"}, "dir/sub/a.txt", true},
+		{[]string{"dir/sub"}, "dir/sub/a.txt", true},
+		{[]string{"sub"}, "dir/sub/a.txt", false},
+		{nil, "a.txt", false},
+	}
+	for _, test := range tests {
+		actual := matchesAnyGlob(test.patterns, test.name)
+		if actual != test.expected {
+			t.Errorf("matchesAnyGlob(%v, %q) = %v, want %v",
+				test.patterns, test.name, actual, test.expected)
+		}
+	}
+}
+
+func TestMergeManifest(t *testing.T) {
+	existing := &api.Manifest{
+		Files: []api.File{
+			{Name: "z", SHA256: "aaaa"},
+			{Name: "a", SHA256: "BBBB"},
+			{Name: "gone", SHA256: "cccc"},
+		},
+	}
+	generated := &api.Manifest{
+		Files: []api.File{
+			{Name: "a", SHA256: "bbbb"},
+			{Name: "new", SHA256: "dddd"},
+			{Name: "z", SHA256: "eeee"},
+		},
+	}
+
+	merged, changed := MergeManifest(existing, generated)
+
+	expected := []api.File{
+		{Name: "z", SHA256: "aaaa"},
+		{Name: "a", SHA256: "BBBB"},
+		{Name: "gone", SHA256: "cccc"},
+		{Name: "new", SHA256: "dddd"},
+	}
+	if !reflect.DeepEqual(merged.Files, expected) {
+		t.Errorf("unexpected merged files: %v", merged.Files)
+	}
+	expectedChanged := []ChangedFile{
+		{Name: "z", OldSHA256: "aaaa", NewSHA256: "eeee"},
+	}
+	if !reflect.DeepEqual(changed, expectedChanged) {
+		t.Errorf("unexpected changed files: %v", changed)
+	}
+}
+
 // AssertMatchesFile verifies that the contents of p match actual.
 //
 //  We break this out into a file because we also support the
@@ -0,0 +1,116 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"golang.org/x/xerrors"
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+)
+
+// GenerateImagesOptions holds the parameters for generating the images of a
+// (thin) promoter manifest from a staging registry.
+type GenerateImagesOptions struct {
+	// Registry is the staging registry to read, e.g. gcr.io/k8s-staging-foo
+	Registry string
+
+	// ServiceAccount is the service account used to read Registry
+	ServiceAccount string
+
+	// UseServiceAccount allows the use of service-accounts to read Registry
+	UseServiceAccount bool
+
+	// Threads is the number of concurrent requests to the registry
+	Threads int
+
+	// ImageGlob selects the images (all of them, if empty)
+	ImageGlob string
+
+	// TagRegex selects the tags matching a regular expression
+	TagRegex string
+
+	// TagSemver selects the tags within a semver range, e.g. ">=1.2.0"
+	TagSemver string
+
+	// MergeWith is the path to an existing images.yaml to add the images to
+	MergeWith string
+}
+
+// PopulateDefaults sets the default values for GenerateImagesOptions
+func (o *GenerateImagesOptions) PopulateDefaults() {
+	o.Threads = 10
+}
+
+// GenerateImages reads the staging registry options.Registry and returns the
+// images (and tags) that it selects, merged into options.MergeWith if set.
+// mkProducer reads a repository of the registry (it is
+// reg.MkReadRepositoryCmdReal, except in tests).
+// nolint[lll]
+func GenerateImages(
+	options GenerateImagesOptions,
+	mkProducer func(*reg.SyncContext, reg.RegistryContext) stream.Producer) (reg.OrderedImages, error) {
+	if options.Registry == "" {
+		return nil, xerrors.New("must specify Registry")
+	}
+
+	var selectTag reg.TagSelector
+	var err error
+	switch {
+	case options.TagRegex != "" && options.TagSemver != "":
+		return nil, xerrors.New("cannot specify both TagRegex and TagSemver")
+	case options.TagRegex != "":
+		selectTag, err = reg.MkTagRegexSelector(options.TagRegex)
+	case options.TagSemver != "":
+		selectTag, err = reg.MkTagSemverSelector(options.TagSemver)
+	default:
+		return nil, xerrors.New("must specify TagRegex or TagSemver")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var existing reg.OrderedImages
+	if options.MergeWith != "" {
+		existing, err = reg.ParseOrderedImagesFromFile(options.MergeWith)
+		if err != nil {
+			return nil, xerrors.Errorf("error reading %q: %w", options.MergeWith, err)
+		}
+	}
+
+	rc := reg.RegistryContext{
+		Name:           reg.RegistryName(options.Registry),
+		ServiceAccount: options.ServiceAccount,
+		Src:            true,
+	}
+	mfests := []reg.Manifest{{Registries: []reg.RegistryContext{rc}}}
+	sc, err := reg.MakeSyncContext(mfests, 0, options.Threads, true, options.UseServiceAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	sc.ReadRegistries([]reg.RegistryContext{rc}, true, mkProducer)
+	if len(sc.InvIgnore) > 0 {
+		return nil, xerrors.Errorf("could not read all of %q (failed to read: %v)", options.Registry, sc.InvIgnore)
+	}
+
+	generated, err := reg.SelectImages(sc.Inv[rc.Name], options.ImageGlob, selectTag)
+	if err != nil {
+		return nil, err
+	}
+
+	return reg.MergeImages(existing, generated)
+}
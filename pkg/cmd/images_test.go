@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+)
+
+func TestGenerateImages(t *testing.T) {
+	// The repositories of a staging registry, as returned by GCR.
+	repos := map[string]string{
+		"gcr.io/staging": `{
+  "child": ["foo"],
+  "manifest": {},
+  "name": "staging",
+  "tags": []
+}`,
+		"gcr.io/staging/foo": `{
+  "child": ["bar"],
+  "manifest": {
+    "sha256:0000000000000000000000000000000000000000000000000000000000000000": {
+      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+      "tag": ["v1.0.0", "latest"]
+    },
+    "sha256:1111111111111111111111111111111111111111111111111111111111111111": {
+      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+      "tag": ["v1.1.0"]
+    },
+    "sha256:2222222222222222222222222222222222222222222222222222222222222222": {
+      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+      "tag": []
+    }
+  },
+  "name": "staging/foo",
+  "tags": ["v1.0.0", "latest", "v1.1.0"]
+}`,
+		"gcr.io/staging/foo/bar": `{
+  "child": [],
+  "manifest": {
+    "sha256:3333333333333333333333333333333333333333333333333333333333333333": {
+      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+      "tag": ["v0.1.0"]
+    }
+  },
+  "name": "staging/foo/bar",
+  "tags": ["v0.1.0"]
+}`,
+	}
+	mkProducer := func(sc *reg.SyncContext, rc reg.RegistryContext) stream.Producer {
+		var sr stream.Fake
+		sr.Bytes = []byte(repos[string(rc.Name)])
+		return &sr
+	}
+
+	tempDir, err := ioutil.TempDir("", "images")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	existing := filepath.Join(tempDir, "images.yaml")
+	writeExisting := func(content string) {
+		if err := ioutil.WriteFile(existing, []byte(content), 0644); err != nil {
+			t.Fatalf("error writing images.yaml: %v", err)
+		}
+	}
+
+	generate := func(modify func(opt *GenerateImagesOptions)) (string, error) {
+		var opt GenerateImagesOptions
+		opt.PopulateDefaults()
+		opt.Registry = "gcr.io/staging"
+		modify(&opt)
+
+		images, err := GenerateImages(opt, mkProducer)
+		if err != nil {
+			return "", err
+		}
+		return images.ToYAML(), nil
+	}
+
+	actual, err := generate(func(opt *GenerateImagesOptions) {
+		opt.TagSemver = ">=0.1.0"
+	})
+	if err != nil {
+		t.Fatalf("error generating images: %v", err)
+	}
+	AssertMatchesFile(t, actual, "testdata/images/semver.yaml")
+
+	actual, err = generate(func(opt *GenerateImagesOptions) {
+		opt.ImageGlob = "foo"
+		opt.TagRegex = "^v1[.]0"
+	})
+	if err != nil {
+		t.Fatalf("error generating images: %v", err)
+	}
+	AssertMatchesFile(t, actual, "testdata/images/regex.yaml")
+
+	// The existing images (and their digests) keep their order, and new tags
+	// are added.
+	writeExisting(`- name: zzz
+  dmap:
+    sha256:4444444444444444444444444444444444444444444444444444444444444444:
+    - "1.0"
+- name: foo
+  dmap:
+    sha256:1111111111111111111111111111111111111111111111111111111111111111:
+    - v1.1
+    sha256:0000000000000000000000000000000000000000000000000000000000000000:
+    - stable
+`)
+	actual, err = generate(func(opt *GenerateImagesOptions) {
+		opt.TagSemver = ">=0.1.0"
+		opt.MergeWith = existing
+	})
+	if err != nil {
+		t.Fatalf("error generating images: %v", err)
+	}
+	AssertMatchesFile(t, actual, "testdata/images/merged.yaml")
+
+	// v1.1.0 cannot be retargeted.
+	writeExisting(`- name: foo
+  dmap:
+    sha256:2222222222222222222222222222222222222222222222222222222222222222:
+    - v1.1.0
+`)
+	_, err = generate(func(opt *GenerateImagesOptions) {
+		opt.TagSemver = ">=0.1.0"
+		opt.MergeWith = existing
+	})
+	if err == nil || !strings.Contains(err.Error(), "refusing to retarget") {
+		t.Errorf("expected an error when retargeting a tag, got %v", err)
+	}
+
+	_, err = generate(func(opt *GenerateImagesOptions) {})
+	if err == nil || !strings.Contains(err.Error(), "must specify TagRegex or TagSemver") {
+		t.Errorf("expected an error without a tag selector, got %v", err)
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"sync"
 
 	"golang.org/x/xerrors"
 	"k8s.io/klog"
@@ -40,13 +41,41 @@ type PromoteFilesOptions struct {
 	// FilesPath specifies a path to manifest files containing the files section.
 	FilesPath string
 
+	// ThinManifestDir is a directory of per-project manifests (see
+	// api.ParseThinManifestsFromDir), used instead of FilestoresPath and
+	// FilesPath. All projects are promoted in one run.
+	ThinManifestDir string
+
 	// DryRun (if set) will not perform operations, but print them instead
 	DryRun bool
 
+	// Threads is the number of operations to run concurrently
+	Threads int
+
 	// UseServiceAccount must be true, for service accounts to be used
 	// This gives some protection against a hostile manifest.
 	UseServiceAccount bool
 
+	// ForceDownloadVerification makes server-side copies download the source
+	// file to verify its SHA256, instead of trusting its SHA256 metadata.
+	ForceDownloadVerification bool
+
+	// PromoterVersion is recorded in the metadata of the uploaded files.
+	PromoterVersion string
+
+	// Prune deletes destination files that are not in the manifest (they are
+	// only reported otherwise).
+	Prune bool
+
+	// MaxDeletions is the maximum number of files that Prune may delete, in
+	// all manifests together. If more files would be deleted, nothing is done
+	// at all.
+	MaxDeletions int
+
+	// AllowOverwrite allows replacing files in immutable filestores whose
+	// content does not match the manifest.
+	AllowOverwrite bool
+
 	// Out is the destination for "normal" output (such as dry-run)
 	Out io.Writer
 }
@@ -54,6 +83,10 @@ type PromoteFilesOptions struct {
 // PopulateDefaults sets the default values for PromoteFilesOptions
 func (o *PromoteFilesOptions) PopulateDefaults() {
 	o.DryRun = true
+	// nolint[gomnd]
+	o.Threads = 10
+	// nolint[gomnd]
+	o.MaxDeletions = 100
 	o.UseServiceAccount = false
 	o.Out = os.Stdout
 }
@@ -61,7 +94,7 @@ func (o *PromoteFilesOptions) PopulateDefaults() {
 // RunPromoteFiles executes a file promotion command
 // nolint[gocyclo]
 func RunPromoteFiles(ctx context.Context, options PromoteFilesOptions) error {
-	manifest, err := readManifest(options)
+	manifests, err := readManifests(ctx, options)
 	if err != nil {
 		return err
 	}
@@ -76,22 +109,54 @@ func RunPromoteFiles(ctx context.Context, options PromoteFilesOptions) error {
 			"********** START **********\n")
 	}
 
-	promoter := &filepromoter.ManifestPromoter{
-		Manifest:          manifest,
-		UseServiceAccount: options.UseServiceAccount,
+	// All operations are built before any of them is run, so that nothing is
+	// copied if any of the manifests has a problem.
+	var ops []filepromoter.SyncFileOp
+	seen := make(map[string]bool)
+	for i := range manifests {
+		promoter := &filepromoter.ManifestPromoter{
+			Manifest:                  &manifests[i],
+			UseServiceAccount:         options.UseServiceAccount,
+			ForceDownloadVerification: options.ForceDownloadVerification,
+			PromoterVersion:           options.PromoterVersion,
+			Prune:                     options.Prune,
+			MaxDeletions:              options.MaxDeletions,
+			AllowOverwrite:            options.AllowOverwrite,
+			ManagedElsewhere:          managedElsewhere(manifests, i),
+		}
+
+		manifestOps, err := promoter.BuildOperations(ctx)
+		if err != nil {
+			return fmt.Errorf(
+				"error building operations: %v",
+				err)
+		}
+
+		// Projects may share destination filestores, in which case the same
+		// operation (e.g., for an unmanaged file) can come up more than once.
+		for _, op := range manifestOps {
+			key := filepromoter.OperationKey(op)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			ops = append(ops, op)
+		}
 	}
 
-	ops, err := promoter.BuildOperations(ctx)
-	if err != nil {
-		return fmt.Errorf(
-			"error building operations: %v",
-			err)
+	// Each manifest is within the limit on its own, but the limit is for the
+	// whole run.
+	if options.Prune {
+		err := filepromoter.CheckDeletions(ops, options.MaxDeletions)
+		if err != nil {
+			return fmt.Errorf("error building operations: %v", err)
+		}
 	}
 
-	// So that we can support future parallel execution, an error
-	// in one operation does not prevent us attempting the
+	// An error in one operation does not prevent us attempting the
 	// remaining operations
 	var errors []error
+	var toRun []filepromoter.SyncFileOp
 	for _, op := range ops {
 		if _, err := fmt.Fprintf(options.Out, "%v\n", op); err != nil {
 			errors = append(errors, fmt.Errorf(
@@ -99,13 +164,12 @@ func RunPromoteFiles(ctx context.Context, options PromoteFilesOptions) error {
 		}
 
 		if !options.DryRun {
-			if err := op.Run(ctx); err != nil {
-				klog.Warningf("error copying file: %v", err)
-				errors = append(errors, err)
-			}
+			toRun = append(toRun, op)
 		}
 	}
 
+	errors = append(errors, runOperations(ctx, toRun, options.Threads)...)
+
 	if len(errors) != 0 {
 		fmt.Fprintf(
 			options.Out,
@@ -130,6 +194,115 @@ func RunPromoteFiles(ctx context.Context, options PromoteFilesOptions) error {
 	return nil
 }
 
+// runOperations runs the operations using up to threads goroutines. The
+// errors are returned in the order of the operations that caused them. If ctx
+// is cancelled, operations that have not yet been started are skipped.
+func runOperations(
+	ctx context.Context,
+	ops []filepromoter.SyncFileOp,
+	threads int) []error {
+	if threads < 1 {
+		threads = 1
+	}
+
+	results := make([]error, len(ops))
+	sem := make(chan struct{}, threads)
+	var wg sync.WaitGroup
+
+	started := 0
+dispatch:
+	for i, op := range ops {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			break dispatch
+		case sem <- struct{}{}:
+		}
+
+		started++
+		wg.Add(1)
+		go func(i int, op filepromoter.SyncFileOp) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := op.Run(ctx); err != nil {
+				klog.Warningf("error copying file: %v", err)
+				results[i] = err
+			}
+		}(i, op)
+	}
+	wg.Wait()
+
+	var errors []error
+	for _, err := range results {
+		if err != nil {
+			errors = append(errors, err)
+		}
+	}
+	if started < len(ops) {
+		errors = append(errors, fmt.Errorf(
+			"cancelled before starting %d of %d operations: %v",
+			len(ops)-started, len(ops), ctx.Err()))
+	}
+	return errors
+}
+
+// readManifests reads the manifests of either options.ThinManifestDir, or
+// options.FilestoresPath and options.FilesPath. Checksum files in the
+// manifests are expanded (see filepromoter.ExpandChecksumFiles).
+func readManifests(
+	ctx context.Context,
+	options PromoteFilesOptions) ([]api.Manifest, error) {
+	var manifests []api.Manifest
+	if options.ThinManifestDir == "" {
+		manifest, err := readManifest(options)
+		if err != nil {
+			return nil, err
+		}
+		manifests = []api.Manifest{*manifest}
+	} else {
+		if options.FilestoresPath != "" || options.FilesPath != "" {
+			return nil, fmt.Errorf(
+				"ThinManifestDir cannot be used with FilestoresPath or FilesPath")
+		}
+
+		var err error
+		manifests, err = api.ParseThinManifestsFromDir(options.ThinManifestDir)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"error reading manifests from %q: %v",
+				options.ThinManifestDir, err)
+		}
+	}
+
+	for i := range manifests {
+		err := filepromoter.ExpandChecksumFiles(
+			ctx, &manifests[i], options.UseServiceAccount)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return manifests, nil
+}
+
+// managedElsewhere returns the destination files managed by all manifests
+// other than manifests[i].
+func managedElsewhere(manifests []api.Manifest, i int) map[string]bool {
+	managed := make(map[string]bool)
+	for j := range manifests {
+		if j == i {
+			continue
+		}
+		for _, p := range filepromoter.ManagedPaths(&manifests[j]) {
+			managed[p] = true
+		}
+	}
+	return managed
+}
+
 func readManifest(options PromoteFilesOptions) (*api.Manifest, error) {
 	merged := &api.Manifest{}
 
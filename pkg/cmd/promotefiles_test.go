@@ -0,0 +1,456 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/k8s-container-image-promoter/pkg/filepromoter"
+)
+
+// TestPromoteFilesLocal runs a promotion end-to-end, using file:// filestores.
+// There are two destinations, one of which already has some of the files.
+func TestPromoteFilesLocal(t *testing.T) {
+	ctx := context.Background()
+
+	srcDir, err := filepath.Abs("testdata/files")
+	if err != nil {
+		t.Fatalf("error getting absolute path: %v", err)
+	}
+
+	tempDir, err := ioutil.TempDir("", "promotefiles")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	destDir := filepath.Join(tempDir, "dest")
+	mirrorDir := filepath.Join(tempDir, "mirror")
+	filestoresPath := filepath.Join(tempDir, "filestores.yaml")
+	filestores := "filestores:\n" +
+		"- base: file://" + filepath.ToSlash(srcDir) + "\n" +
+		"  src: true\n" +
+		"- base: file://" + filepath.ToSlash(destDir) + "/subdir\n" +
+		"- base: file://" + filepath.ToSlash(mirrorDir) + "\n"
+	if err := ioutil.WriteFile(filestoresPath, []byte(filestores), 0644); err != nil {
+		t.Fatalf("error writing filestores: %v", err)
+	}
+
+	red, err := ioutil.ReadFile(filepath.Join(srcDir, "red.png"))
+	if err != nil {
+		t.Fatalf("error reading source file: %v", err)
+	}
+	if err := os.MkdirAll(mirrorDir, 0755); err != nil {
+		t.Fatalf("error creating mirror dir: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(mirrorDir, "red.png"), red, 0644); err != nil {
+		t.Fatalf("error writing mirror file: %v", err)
+	}
+
+	mkOptions := func(dryRun bool, out *bytes.Buffer) PromoteFilesOptions {
+		var opt PromoteFilesOptions
+		opt.PopulateDefaults()
+		opt.FilestoresPath = filestoresPath
+		opt.FilesPath = "testdata/files-manifest.yaml"
+		opt.DryRun = dryRun
+		opt.Out = out
+		return opt
+	}
+	run := func(dryRun, prune bool, expected string) {
+		var out bytes.Buffer
+
+		opt := mkOptions(dryRun, &out)
+		opt.Prune = prune
+
+		if err := RunPromoteFiles(ctx, opt); err != nil {
+			t.Fatalf("error promoting files: %v", err)
+		}
+
+		actual := out.String()
+		actual = strings.Replace(actual, filepath.ToSlash(srcDir), "$SRC", -1)
+		actual = strings.Replace(actual, filepath.ToSlash(destDir), "$DEST", -1)
+		actual = strings.Replace(actual, filepath.ToSlash(mirrorDir), "$MIRROR", -1)
+		AssertMatchesFile(t, actual, expected)
+	}
+
+	// A dry run must not write anything.
+	run(true, false, "testdata/promote/dryrun.txt")
+	if _, err := os.Stat(destDir); !os.IsNotExist(err) {
+		t.Errorf("dry run created %q", destDir)
+	}
+
+	run(false, false, "testdata/promote/run.txt")
+	for _, name := range []string{"blue.png", "green.png", "red.png"} {
+		expected, err := ioutil.ReadFile(filepath.Join(srcDir, name))
+		if err != nil {
+			t.Fatalf("error reading source file: %v", err)
+		}
+		for _, dir := range []string{filepath.Join(destDir, "subdir"), mirrorDir} {
+			actual, err := ioutil.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatalf("error reading promoted file: %v", err)
+			}
+			if !bytes.Equal(actual, expected) {
+				t.Errorf("promoted file %q in %q did not match source", name, dir)
+			}
+		}
+	}
+
+	// Everything has been promoted, so there should be nothing left to do.
+	run(false, false, "testdata/promote/rerun.txt")
+
+	// Files that are not in the manifest are reported, but only deleted when
+	// pruning.
+	stale := filepath.Join(mirrorDir, "old", "stale.png")
+	if err := os.MkdirAll(filepath.Dir(stale), 0755); err != nil {
+		t.Fatalf("error creating dir: %v", err)
+	}
+	if err := ioutil.WriteFile(stale, red, 0644); err != nil {
+		t.Fatalf("error writing unmanaged file: %v", err)
+	}
+	run(false, false, "testdata/promote/unmanaged.txt")
+	run(true, true, "testdata/promote/prune-dryrun.txt")
+	if _, err := os.Stat(stale); err != nil {
+		t.Errorf("dry run deleted %q: %v", stale, err)
+	}
+
+	// Nothing is deleted if there is more to delete than allowed.
+	opt := mkOptions(false, &bytes.Buffer{})
+	opt.Prune = true
+	opt.MaxDeletions = 0
+	err = RunPromoteFiles(ctx, opt)
+	if err == nil || !strings.Contains(err.Error(), "refusing to delete 1") {
+		t.Errorf("expected the deletion cap to be enforced, got %v", err)
+	}
+	if _, err := os.Stat(stale); err != nil {
+		t.Errorf("%q was deleted despite the cap: %v", stale, err)
+	}
+
+	run(false, true, "testdata/promote/prune.txt")
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("expected %q to be deleted, got %v", stale, err)
+	}
+}
+
+// TestPromoteFilesThinManifests promotes two projects from a thin manifest
+// directory in one run. Both share a destination, so the files of one project
+// must not be considered unmanaged by the other.
+func TestPromoteFilesThinManifests(t *testing.T) {
+	ctx := context.Background()
+
+	srcDir, err := filepath.Abs("testdata/files")
+	if err != nil {
+		t.Fatalf("error getting absolute path: %v", err)
+	}
+
+	tempDir, err := ioutil.TempDir("", "promotefiles")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	destDir := filepath.Join(tempDir, "dest")
+	manifestDir := filepath.Join(tempDir, "manifests")
+	filestores := "filestores:\n" +
+		"- base: file://" + filepath.ToSlash(srcDir) + "\n" +
+		"  src: true\n" +
+		"- base: file://" + filepath.ToSlash(destDir) + "\n"
+	manifests := map[string]string{
+		"filestores/blue/filestores.yaml": filestores,
+		"files/blue/files.yaml": "files:\n" +
+			"- name: blue.png\n" +
+			"  sha256: 905fef7b0658ff5d266140d1cea1eb5b414393b4d0c7897b05beae78678395c3\n",
+		"filestores/red/filestores.yaml": filestores,
+		"files/red/files.yaml": "files:\n" +
+			"- name: red.png\n" +
+			"  sha256: 5e6893c6c9ae8bf2a40b22b4274ca58d68c5614b476451a29859750bf434d6a8\n",
+		// An unmanaged file in the shared destination.
+		"../dest/stale.png": "",
+	}
+	for name, content := range manifests {
+		p := filepath.Join(manifestDir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("error creating dir: %v", err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatalf("error writing %q: %v", p, err)
+		}
+	}
+
+	var out bytes.Buffer
+
+	var opt PromoteFilesOptions
+	opt.PopulateDefaults()
+	opt.ThinManifestDir = manifestDir
+	opt.DryRun = false
+	opt.Prune = true
+	opt.Out = &out
+
+	if err := RunPromoteFiles(ctx, opt); err != nil {
+		t.Fatalf("error promoting files: %v", err)
+	}
+
+	actual := out.String()
+	actual = strings.Replace(actual, filepath.ToSlash(srcDir), "$SRC", -1)
+	actual = strings.Replace(actual, filepath.ToSlash(destDir), "$DEST", -1)
+	AssertMatchesFile(t, actual, "testdata/promote/thin.txt")
+
+	entries, err := ioutil.ReadDir(destDir)
+	if err != nil {
+		t.Fatalf("error reading dest dir: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if !reflect.DeepEqual(names, []string{"blue.png", "red.png"}) {
+		t.Errorf("unexpected files in destination: %v", names)
+	}
+
+	// The flat manifest flags cannot be mixed in.
+	opt.FilesPath = "testdata/files-manifest.yaml"
+	if err := RunPromoteFiles(ctx, opt); err == nil {
+		t.Errorf("expected an error when mixing ThinManifestDir and FilesPath")
+	}
+}
+
+// TestPromoteFilesMaxDeletionsAcrossManifests checks that the deletion cap
+// applies to all the manifests of a run together, not to each one.
+func TestPromoteFilesMaxDeletionsAcrossManifests(t *testing.T) {
+	ctx := context.Background()
+
+	srcDir, err := filepath.Abs("testdata/files")
+	if err != nil {
+		t.Fatalf("error getting absolute path: %v", err)
+	}
+
+	tempDir, err := ioutil.TempDir("", "promotefiles")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	manifestDir := filepath.Join(tempDir, "manifests")
+	files := map[string]string{}
+	var stale []string
+	for _, project := range []string{"blue", "red"} {
+		destDir := filepath.Join(tempDir, "dest-"+project)
+		files["filestores/"+project+"/filestores.yaml"] = "filestores:\n" +
+			"- base: file://" + filepath.ToSlash(srcDir) + "\n" +
+			"  src: true\n" +
+			"- base: file://" + filepath.ToSlash(destDir) + "\n"
+		files["files/"+project+"/files.yaml"] = "files:\n" +
+			"- name: blue.png\n" +
+			"  sha256: 905fef7b0658ff5d266140d1cea1eb5b414393b4d0c7897b05beae78678395c3\n"
+		// One unmanaged file in each destination.
+		files["../dest-"+project+"/stale.png"] = ""
+		stale = append(stale, filepath.Join(destDir, "stale.png"))
+	}
+	for name, content := range files {
+		p := filepath.Join(manifestDir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("error creating dir: %v", err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatalf("error writing %q: %v", p, err)
+		}
+	}
+
+	var opt PromoteFilesOptions
+	opt.PopulateDefaults()
+	opt.ThinManifestDir = manifestDir
+	opt.DryRun = false
+	opt.Prune = true
+	opt.MaxDeletions = 1
+	opt.Out = &bytes.Buffer{}
+
+	err = RunPromoteFiles(ctx, opt)
+	if err == nil || !strings.Contains(err.Error(), "refusing to delete 2") {
+		t.Errorf("expected the deletion cap to be enforced, got %v", err)
+	}
+	for _, p := range stale {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("%q was deleted despite the cap: %v", p, err)
+		}
+	}
+}
+
+// TestPromoteFilesChecksumFile promotes the files listed in a SHA256SUMS file,
+// which is itself pinned by the manifest.
+func TestPromoteFilesChecksumFile(t *testing.T) {
+	ctx := context.Background()
+
+	tempDir, err := ioutil.TempDir("", "promotefiles")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	srcDir := filepath.Join(tempDir, "src")
+	destDir := filepath.Join(tempDir, "dest")
+	releaseDir := filepath.Join(srcDir, "release")
+	if err := os.MkdirAll(releaseDir, 0755); err != nil {
+		t.Fatalf("error creating source dir: %v", err)
+	}
+
+	var sums string
+	for _, name := range []string{"blue.png", "red.png"} {
+		b, err := ioutil.ReadFile(filepath.Join("testdata/files", name))
+		if err != nil {
+			t.Fatalf("error reading source file: %v", err)
+		}
+		p := filepath.Join(releaseDir, name)
+		if err := ioutil.WriteFile(p, b, 0644); err != nil {
+			t.Fatalf("error writing source file: %v", err)
+		}
+		sum := sha256.Sum256(b)
+		sums += hex.EncodeToString(sum[:]) + "  " + name + "\n"
+	}
+	sumsPath := filepath.Join(releaseDir, "SHA256SUMS")
+	if err := ioutil.WriteFile(sumsPath, []byte(sums), 0644); err != nil {
+		t.Fatalf("error writing SHA256SUMS: %v", err)
+	}
+	sum := sha256.Sum256([]byte(sums))
+	sumsSHA256 := hex.EncodeToString(sum[:])
+
+	filestoresPath := filepath.Join(tempDir, "filestores.yaml")
+	filestores := "filestores:\n" +
+		"- base: file://" + filepath.ToSlash(srcDir) + "\n" +
+		"  src: true\n" +
+		"- base: file://" + filepath.ToSlash(destDir) + "\n"
+	if err := ioutil.WriteFile(filestoresPath, []byte(filestores), 0644); err != nil {
+		t.Fatalf("error writing filestores: %v", err)
+	}
+
+	run := func(pin string) (string, error) {
+		filesPath := filepath.Join(tempDir, "files.yaml")
+		files := "files:\n" +
+			"- name: release/SHA256SUMS\n" +
+			"  sha256: " + pin + "\n" +
+			"  checksums: sha256sums\n"
+		if err := ioutil.WriteFile(filesPath, []byte(files), 0644); err != nil {
+			t.Fatalf("error writing files: %v", err)
+		}
+
+		var out bytes.Buffer
+
+		var opt PromoteFilesOptions
+		opt.PopulateDefaults()
+		opt.FilestoresPath = filestoresPath
+		opt.FilesPath = filesPath
+		opt.DryRun = false
+		opt.Out = &out
+
+		err := RunPromoteFiles(ctx, opt)
+		actual := out.String()
+		actual = strings.Replace(actual, filepath.ToSlash(srcDir), "$SRC", -1)
+		actual = strings.Replace(actual, filepath.ToSlash(destDir), "$DEST", -1)
+		return actual, err
+	}
+
+	// A SHA256SUMS file that does not match its pin is rejected, and nothing
+	// it lists is promoted.
+	badPin := strings.Repeat("ab", 32)
+	if _, err := run(badPin); err == nil ||
+		!strings.Contains(err.Error(), "sha256 did not match") {
+		t.Errorf("expected a sha256 mismatch error, got %v", err)
+	}
+	if _, err := os.Stat(destDir); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be promoted, got %v", err)
+	}
+
+	actual, err := run(sumsSHA256)
+	if err != nil {
+		t.Fatalf("error promoting files: %v", err)
+	}
+	AssertMatchesFile(t, actual, "testdata/promote/checksums.txt")
+
+	for _, name := range []string{"SHA256SUMS", "blue.png", "red.png"} {
+		p := filepath.Join(destDir, "release", name)
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("expected %q to be promoted: %v", name, err)
+		}
+	}
+}
+
+// fakeOp is a SyncFileOp that records how many fakeOps run at the same time.
+type fakeOp struct {
+	err error
+
+	mutex   *sync.Mutex
+	running *int
+	maxSeen *int
+	ran     *int
+}
+
+func (o *fakeOp) Run(ctx context.Context) error {
+	o.mutex.Lock()
+	*o.running++
+	*o.ran++
+	if *o.running > *o.maxSeen {
+		*o.maxSeen = *o.running
+	}
+	o.mutex.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	o.mutex.Lock()
+	*o.running--
+	o.mutex.Unlock()
+	return o.err
+}
+
+func TestRunOperations(t *testing.T) {
+	var mutex sync.Mutex
+	var running, maxSeen, ran int
+	mkOps := func(errs ...error) []filepromoter.SyncFileOp {
+		var ops []filepromoter.SyncFileOp
+		for _, err := range errs {
+			ops = append(ops, &fakeOp{
+				err:     err,
+				mutex:   &mutex,
+				running: &running,
+				maxSeen: &maxSeen,
+				ran:     &ran,
+			})
+		}
+		return ops
+	}
+
+	err1 := fmt.Errorf("error 1")
+	err2 := fmt.Errorf("error 2")
+	ops := mkOps(nil, err1, nil, nil, err2, nil, nil, nil)
+
+	errs := runOperations(context.Background(), ops, 3)
+	if !reflect.DeepEqual(errs, []error{err1, err2}) {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	if ran != len(ops) {
+		t.Errorf("expected %d operations to run, but %d did", len(ops), ran)
+	}
+	if maxSeen > 3 {
+		t.Errorf("expected at most 3 concurrent operations, saw %d", maxSeen)
+	}
+
+	// Nothing should be started once the context is cancelled.
+	ran = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	errs = runOperations(ctx, ops, 3)
+	if ran != 0 {
+		t.Errorf("expected no operations to run, but %d did", ran)
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "cancelled before starting 8 of 8") {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"sigs.k8s.io/k8s-container-image-promoter/pkg/filepromoter"
+	"sigs.k8s.io/yaml"
+)
+
+// VerifyReport is the (YAML) output of RunVerifyFiles.
+type VerifyReport struct {
+	// Checked is the number of destination files that were checked.
+	Checked int `json:"checked"`
+	// OK is the number of destination files that matched the manifest.
+	OK int `json:"ok"`
+	// Problems lists the destination files that are missing, or that did
+	// not match the manifest.
+	Problems []filepromoter.VerifyResult `json:"problems,omitempty"`
+}
+
+// RunVerifyFiles checks that every file in the manifest is present in every
+// destination filestore, with the SHA256 given in the manifest. Nothing is
+// ever modified, so DryRun is ignored. A VerifyReport is written to
+// options.Out, and an error is returned if any file failed verification.
+func RunVerifyFiles(ctx context.Context, options PromoteFilesOptions) error {
+	manifests, err := readManifests(ctx, options)
+	if err != nil {
+		return err
+	}
+
+	var verifyOps []*filepromoter.VerifyFileOp
+	for i := range manifests {
+		promoter := &filepromoter.ManifestPromoter{
+			Manifest:          &manifests[i],
+			UseServiceAccount: options.UseServiceAccount,
+		}
+
+		manifestOps, err := promoter.BuildVerifyOperations(ctx)
+		if err != nil {
+			return fmt.Errorf(
+				"error building operations: %v",
+				err)
+		}
+		verifyOps = append(verifyOps, manifestOps...)
+	}
+
+	ops := make([]filepromoter.SyncFileOp, 0, len(verifyOps))
+	for _, op := range verifyOps {
+		ops = append(ops, op)
+	}
+	if errors := runOperations(ctx, ops, options.Threads); len(errors) != 0 {
+		return errors[0]
+	}
+
+	report := VerifyReport{Checked: len(verifyOps)}
+	for _, op := range verifyOps {
+		if op.Result.Status == filepromoter.VerifyOK {
+			report.OK++
+		} else {
+			report.Problems = append(report.Problems, op.Result)
+		}
+	}
+
+	reportYAML, err := yaml.Marshal(&report)
+	if err != nil {
+		return fmt.Errorf("error serializing report: %v", err)
+	}
+	if _, err := options.Out.Write(reportYAML); err != nil {
+		return fmt.Errorf("error writing to output: %v", err)
+	}
+
+	if len(report.Problems) != 0 {
+		return fmt.Errorf(
+			"%d of %d files failed verification",
+			len(report.Problems), report.Checked)
+	}
+	return nil
+}
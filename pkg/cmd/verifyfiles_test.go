@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestVerifyFilesLocal checks a destination with a good, a corrupted and a
+// missing file.
+func TestVerifyFilesLocal(t *testing.T) {
+	ctx := context.Background()
+
+	srcDir, err := filepath.Abs("testdata/files")
+	if err != nil {
+		t.Fatalf("error getting absolute path: %v", err)
+	}
+
+	tempDir, err := ioutil.TempDir("", "verifyfiles")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	destDir := filepath.Join(tempDir, "dest")
+	filestoresPath := filepath.Join(tempDir, "filestores.yaml")
+	filestores := "filestores:\n" +
+		"- base: file://" + filepath.ToSlash(srcDir) + "\n" +
+		"  src: true\n" +
+		"- base: file://" + filepath.ToSlash(destDir) + "\n"
+	if err := ioutil.WriteFile(filestoresPath, []byte(filestores), 0644); err != nil {
+		t.Fatalf("error writing filestores: %v", err)
+	}
+
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		t.Fatalf("error creating dest dir: %v", err)
+	}
+	for _, name := range []string{"blue.png", "red.png"} {
+		b, err := ioutil.ReadFile(filepath.Join(srcDir, name))
+		if err != nil {
+			t.Fatalf("error reading source file: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(destDir, name), b, 0644); err != nil {
+			t.Fatalf("error writing dest file: %v", err)
+		}
+	}
+
+	verify := func(expected string) error {
+		var out bytes.Buffer
+
+		var opt PromoteFilesOptions
+		opt.PopulateDefaults()
+		opt.FilestoresPath = filestoresPath
+		opt.FilesPath = "testdata/files-manifest.yaml"
+		opt.Out = &out
+
+		err := RunVerifyFiles(ctx, opt)
+
+		actual := strings.Replace(
+			out.String(), filepath.ToSlash(destDir), "$DEST", -1)
+		AssertMatchesFile(t, actual, expected)
+		return err
+	}
+
+	// green.png is missing.
+	err = verify("testdata/verify/missing.txt")
+	if err == nil || !strings.Contains(err.Error(), "1 of 3 files failed") {
+		t.Errorf("expected verification to fail, got %v", err)
+	}
+
+	// green.png is restored, but red.png is corrupted.
+	b, err := ioutil.ReadFile(filepath.Join(srcDir, "green.png"))
+	if err != nil {
+		t.Fatalf("error reading source file: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(destDir, "green.png"), b, 0644); err != nil {
+		t.Fatalf("error writing dest file: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(destDir, "red.png"), b, 0644); err != nil {
+		t.Fatalf("error writing dest file: %v", err)
+	}
+	err = verify("testdata/verify/mismatch.txt")
+	if err == nil || !strings.Contains(err.Error(), "1 of 3 files failed") {
+		t.Errorf("expected verification to fail, got %v", err)
+	}
+
+	// Everything is fine again.
+	b, err = ioutil.ReadFile(filepath.Join(srcDir, "red.png"))
+	if err != nil {
+		t.Fatalf("error reading source file: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(destDir, "red.png"), b, 0644); err != nil {
+		t.Fatalf("error writing dest file: %v", err)
+	}
+	if err := verify("testdata/verify/ok.txt"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
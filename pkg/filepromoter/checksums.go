@@ -0,0 +1,130 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"k8s.io/klog"
+	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
+)
+
+// maxChecksumFileSize limits how much of a checksum file is read into memory.
+const maxChecksumFileSize = 64 * 1024 * 1024
+
+// ExpandChecksumFiles reads the checksum files of the manifest (the files with
+// Checksums set) from the source filestore, and adds the files that they list
+// to manifest.Files. Each checksum file must match its SHA256 in the
+// manifest, so the listed files are as trustworthy as if they had been listed
+// in the manifest directly; they are verified when copied just the same.
+func ExpandChecksumFiles(
+	ctx context.Context,
+	manifest *api.Manifest,
+	useServiceAccount bool) error {
+	var checksumFiles []api.File
+	known := make(map[string]string)
+	for _, f := range manifest.Files {
+		known[f.Name] = f.SHA256
+		if f.Checksums != "" {
+			checksumFiles = append(checksumFiles, f)
+		}
+	}
+	if len(checksumFiles) == 0 {
+		return nil
+	}
+
+	source, err := getSourceFilestore(manifest)
+	if err != nil {
+		return err
+	}
+	sourceFilestore, err := openFilestore(ctx, source, useServiceAccount)
+	if err != nil {
+		return err
+	}
+
+	for i := range checksumFiles {
+		f := &checksumFiles[i]
+		absolutePath := joinFilepath(source, f.Name)
+
+		b, err := readVerified(ctx, sourceFilestore, f)
+		if err != nil {
+			return fmt.Errorf(
+				"error reading checksum file %q: %v", absolutePath, err)
+		}
+
+		files, err := api.ParseSHA256Sums(b, path.Dir(f.Name))
+		if err != nil {
+			return fmt.Errorf(
+				"error parsing checksum file %q: %v", absolutePath, err)
+		}
+		klog.Infof("checksum file %q lists %d files", absolutePath, len(files))
+
+		for _, listed := range files {
+			sha256, found := known[listed.Name]
+			if found && !strings.EqualFold(sha256, listed.SHA256) {
+				return fmt.Errorf(
+					"checksum file %q has sha256 %q for %q, but it is"+
+						" listed elsewhere with sha256 %q",
+					absolutePath, listed.SHA256, listed.Name, sha256)
+			}
+			if found {
+				continue
+			}
+			known[listed.Name] = listed.SHA256
+			manifest.Files = append(manifest.Files, listed)
+		}
+	}
+
+	return nil
+}
+
+// readVerified reads a (small) file from the filestore, and checks that it
+// matches the SHA256 in the manifest.
+func readVerified(
+	ctx context.Context,
+	filestore syncFilestore,
+	f *api.File) ([]byte, error) {
+	in, err := filestore.OpenReader(ctx, f.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(in, maxChecksumFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxChecksumFileSize {
+		return nil, fmt.Errorf(
+			"file is larger than %d bytes", maxChecksumFileSize)
+	}
+
+	sum := sha256.Sum256(b)
+	sha256 := hex.EncodeToString(sum[:])
+	if !strings.EqualFold(sha256, f.SHA256) {
+		return nil, fmt.Errorf(
+			"sha256 did not match: actual=%q expected=%q", sha256, f.SHA256)
+	}
+	return b, nil
+}
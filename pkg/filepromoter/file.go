@@ -24,6 +24,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 
 	"k8s.io/klog"
 	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
@@ -41,20 +42,70 @@ type syncFileInfo struct {
 
 	Size int64
 
+	// SHA256 is the (hex-encoded) SHA256 recorded in the object metadata, if
+	// any. Unlike MD5, it is not computed by the backend itself.
+	SHA256 string
+
+	// CRC32C, Generation and ContentType are only set for GCS objects.
+	CRC32C      uint32
+	Generation  int64
+	ContentType string
+
 	filestore syncFilestore
+
+	// sidecars lists the sidecar files (by extension, e.g. "sha256") to write
+	// along with a destination file.
+	sidecars []string
+
+	// listedSidecars holds the sidecar files of a destination file that were
+	// listed (by extension), i.e. that will be overwritten.
+	listedSidecars map[string]*syncFileInfo
+
+	// exists is set for destination files that were listed, i.e. that will be
+	// overwritten.
+	exists bool
 }
 
-// copyFileOp manages copying a single file
+// copyFileOp manages copying a single file to one or more destinations
 type copyFileOp struct {
 	Source *syncFileInfo
-	Dest   *syncFileInfo
+	Dests  []*syncFileInfo
 
 	ManifestFile *api.File
+
+	// ForceDownloadVerification disables trusting the SHA256 metadata of the
+	// source file for server-side copies; the file is downloaded and hashed
+	// instead.
+	ForceDownloadVerification bool
+
+	// PromoterVersion is recorded in the metadata of the uploaded files.
+	PromoterVersion string
 }
 
 // Run implements SyncFileOp.Run
-// nolint[gocyclo]
 func (o *copyFileOp) Run(ctx context.Context) error {
+	if o.canCopyServerSide() {
+		return o.runServerSideCopy(ctx)
+	}
+	if o.canStream() {
+		return o.runStreaming(ctx)
+	}
+	return o.runWithTempFile(ctx)
+}
+
+// writeCondition returns the precondition for writing to dest: either the
+// file must still not exist, or it must not have changed since it was listed.
+func (o *copyFileOp) writeCondition(dest *syncFileInfo) writeCondition {
+	if !dest.exists {
+		return writeCondition{DoesNotExist: true}
+	}
+	return writeCondition{GenerationMatch: dest.Generation}
+}
+
+// runWithTempFile downloads the file to a local temp file, verifies it, and
+// then uploads it to every destination. It works with all filestores.
+// nolint[gocyclo]
+func (o *copyFileOp) runWithTempFile(ctx context.Context) error {
 	// Download to our temp file
 	f, err := ioutil.TempFile("", "promoter")
 	if err != nil {
@@ -106,20 +157,62 @@ func (o *copyFileOp) Run(ctx context.Context) error {
 			o.Source.AbsolutePath, sha256, o.ManifestFile.SHA256)
 	}
 
-	// Upload to the destination
-	if err := o.Dest.filestore.UploadFile(
-		ctx, o.Dest.RelativePath, tempFilename); err != nil {
-		return err
+	hashes := map[string]string{sidecarSHA256: sha256}
+	if o.needsSHA512() {
+		sha512, err := computeSHA512ForFile(tempFilename)
+		if err != nil {
+			return err
+		}
+		hashes[sidecarSHA512] = sha512
+	}
+
+	// Upload to the destinations. A failure to upload to one destination
+	// should not prevent us from uploading to the others.
+	var errs []string
+	for _, dest := range o.Dests {
+		err := dest.filestore.UploadFile(
+			ctx,
+			dest.RelativePath,
+			tempFilename,
+			o.metadata(),
+			o.writeCondition(dest))
+		if err == nil {
+			err = uploadSidecars(
+				ctx, dest, hashes, o.Source, o.PromoterVersion)
+		}
+		if err != nil {
+			klog.Warningf("error uploading to %q: %v", dest.AbsolutePath, err)
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf(
+			"error copying %q: %s",
+			o.Source.AbsolutePath, strings.Join(errs, "; "))
 	}
 
 	return nil
 }
 
-// String is the pretty-printer for an operation, as used by dry-run
+// key implements keyedOp.key
+func (o *copyFileOp) key() string {
+	parts := []string{"copy", o.Source.AbsolutePath}
+	for _, dest := range o.Dests {
+		parts = append(parts, dest.AbsolutePath)
+	}
+	return opKey(parts...)
+}
+
+// String is the pretty-printer for an operation, as used by dry-run. Each
+// destination is shown on its own line.
 func (o *copyFileOp) String() string {
-	return fmt.Sprintf(
-		"COPY %q to %q",
-		o.Source.AbsolutePath, o.Dest.AbsolutePath)
+	lines := make([]string, 0, len(o.Dests))
+	for _, dest := range o.Dests {
+		lines = append(lines, fmt.Sprintf(
+			"COPY %q to %q",
+			o.Source.AbsolutePath, dest.AbsolutePath))
+	}
+	return strings.Join(lines, "\n")
 }
 
 // nolint[lll]
@@ -0,0 +1,845 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
+)
+
+// nolint[funlen]
+func TestCopyFileOp(t *testing.T) {
+	ctx := context.Background()
+
+	tdir, err := ioutil.TempDir("", "promoter-copy-")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tdir)
+
+	content := []byte("hello world")
+	sum := sha256.Sum256(content)
+	goodSHA := hex.EncodeToString(sum[:])
+	badSHA := strings.Repeat("0", 64)
+
+	srcDir := filepath.Join(tdir, "src")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(srcDir, "file"), content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	open := func(base string) syncFilestore {
+		s, err := openFilestore(ctx, &api.Filestore{
+			Base:     base,
+			Endpoint: server.URL,
+		}, false)
+		if err != nil {
+			t.Fatalf("could not open filestore %q: %v", base, err)
+		}
+		return s
+	}
+	mkOp := func(sha string, bases ...string) *copyFileOp {
+		op := &copyFileOp{
+			Source: &syncFileInfo{
+				RelativePath: "file",
+				AbsolutePath: "file://" + srcDir + "/file",
+				filestore:    open("file://" + srcDir),
+			},
+			ManifestFile: &api.File{Name: "file", SHA256: sha},
+		}
+		for _, base := range bases {
+			op.Dests = append(op.Dests, &syncFileInfo{
+				RelativePath: "file",
+				AbsolutePath: base + "/file",
+				filestore:    open(base),
+			})
+		}
+		return op
+	}
+
+	var tests = []struct {
+		name         string
+		sha          string
+		dests        []string
+		expectStream bool
+		expectErr    string
+	}{
+		{
+			name:         "streaming to two local dirs",
+			sha:          goodSHA,
+			dests:        []string{"file://" + tdir + "/a", "file://" + tdir + "/b"},
+			expectStream: true,
+		},
+		{
+			name:         "streaming with bad sha",
+			sha:          badSHA,
+			dests:        []string{"file://" + tdir + "/c", "file://" + tdir + "/d"},
+			expectStream: true,
+			expectErr:    "sha256 did not match",
+		},
+		{
+			name:         "falling back to temp file",
+			sha:          goodSHA,
+			dests:        []string{"file://" + tdir + "/e", "s3://bucket/e"},
+			expectStream: false,
+		},
+		{
+			name:         "falling back to temp file with bad sha",
+			sha:          badSHA,
+			dests:        []string{"file://" + tdir + "/f", "s3://bucket/f"},
+			expectStream: false,
+			expectErr:    "sha256 did not match",
+		},
+	}
+
+	for _, test := range tests {
+		op := mkOp(test.sha, test.dests...)
+		if op.canStream() != test.expectStream {
+			t.Errorf("%s: expected canStream() = %v",
+				test.name, test.expectStream)
+		}
+
+		err := op.Run(ctx)
+		if test.expectErr == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if test.expectErr != "" &&
+			(err == nil || !strings.Contains(err.Error(), test.expectErr)) {
+			t.Errorf("%s: expected error %q, got %v",
+				test.name, test.expectErr, err)
+		}
+
+		for _, dest := range op.Dests {
+			in, err := dest.filestore.OpenReader(ctx, "file")
+			if test.expectErr != "" {
+				if err == nil {
+					_ = in.Close()
+					t.Errorf("%s: %s was written although the sha256 did not match",
+						test.name, dest.AbsolutePath)
+				}
+				if strings.HasPrefix(dest.AbsolutePath, "file://") {
+					dir := filepath.Dir(strings.TrimPrefix(dest.AbsolutePath, "file://"))
+					entries, _ := ioutil.ReadDir(dir)
+					if len(entries) != 0 {
+						t.Errorf("%s: temp files were left behind in %s",
+							test.name, dir)
+					}
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s: %s was not written: %v",
+					test.name, dest.AbsolutePath, err)
+				continue
+			}
+			b, err := ioutil.ReadAll(in)
+			_ = in.Close()
+			if err != nil || string(b) != string(content) {
+				t.Errorf("%s: %s has content %q (err=%v)",
+					test.name, dest.AbsolutePath, b, err)
+			}
+
+			// No temp files must be left behind.
+			listing, err := dest.filestore.ListFiles(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(listing) != 1 {
+				t.Errorf("%s: unexpected files in %s: %v",
+					test.name, dest.AbsolutePath, listing)
+			}
+		}
+	}
+}
+
+// memSyncFilestore is an in-memory syncFilestore that supports server-side
+// copies from other memSyncFilestores.
+type memSyncFilestore struct {
+	files map[string][]byte
+	// metadata holds the custom metadata of the files.
+	metadata map[string]map[string]string
+	// generations holds the older generations of the files (by number).
+	generations map[string]map[int64][]byte
+	// reads counts the calls to OpenReader and OpenGenerationReader.
+	reads int
+}
+
+func (s *memSyncFilestore) setMetadata(
+	name string,
+	metadata map[string]string) {
+	if s.metadata == nil {
+		s.metadata = make(map[string]map[string]string)
+	}
+	s.metadata[name] = metadata
+}
+
+func (s *memSyncFilestore) OpenReader(
+	ctx context.Context,
+	name string) (io.ReadCloser, error) {
+	s.reads++
+	b, found := s.files[name]
+	if !found {
+		return nil, fmt.Errorf("%q not found", name)
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (s *memSyncFilestore) OpenGenerationReader(
+	ctx context.Context,
+	name string,
+	generation int64) (io.ReadCloser, error) {
+	s.reads++
+	b, found := s.generations[name][generation]
+	if !found {
+		return nil, fmt.Errorf("%q#%d not found", name, generation)
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (s *memSyncFilestore) UploadFile(
+	ctx context.Context,
+	dest string,
+	localFile string,
+	metadata map[string]string,
+	cond writeCondition) error {
+	if err := s.checkCondition(dest, cond); err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(localFile)
+	if err != nil {
+		return err
+	}
+	s.files[dest] = b
+	s.setMetadata(dest, metadata)
+	return nil
+}
+
+// checkCondition enforces cond.DoesNotExist (there are no generations).
+func (s *memSyncFilestore) checkCondition(
+	name string,
+	cond writeCondition) error {
+	if _, found := s.files[name]; found && cond.DoesNotExist {
+		return fmt.Errorf("precondition failed: %q exists", name)
+	}
+	return nil
+}
+
+func (s *memSyncFilestore) DeleteFile(
+	ctx context.Context,
+	name string) error {
+	if _, found := s.files[name]; !found {
+		return fmt.Errorf("%q not found", name)
+	}
+	delete(s.files, name)
+	delete(s.metadata, name)
+	return nil
+}
+
+func (s *memSyncFilestore) ListFiles(
+	ctx context.Context) (map[string]*syncFileInfo, error) {
+	files := make(map[string]*syncFileInfo)
+	for name, b := range s.files {
+		files[name] = &syncFileInfo{
+			RelativePath: name,
+			AbsolutePath: "mem://" + name,
+			MD5:          md5Hex(b),
+			SHA256:       s.metadata[name][sha256MetadataKey],
+			Size:         int64(len(b)),
+			filestore:    s,
+		}
+	}
+	return files, nil
+}
+
+func (s *memSyncFilestore) CanCopyFrom(source syncFilestore) bool {
+	_, ok := source.(*memSyncFilestore)
+	return ok
+}
+
+func (s *memSyncFilestore) CopyFrom(
+	ctx context.Context,
+	source *syncFileInfo,
+	dest string,
+	metadata map[string]string,
+	cond writeCondition) error {
+	if err := s.checkCondition(dest, cond); err != nil {
+		return err
+	}
+	src := source.filestore.(*memSyncFilestore)
+	if source.Generation != 0 {
+		s.files[dest] = src.generations[source.RelativePath][source.Generation]
+	} else {
+		s.files[dest] = src.files[source.RelativePath]
+	}
+	s.setMetadata(dest, metadata)
+	return nil
+}
+
+func TestServerSideCopy(t *testing.T) {
+	ctx := context.Background()
+
+	content := []byte("hello world")
+	sum := sha256.Sum256(content)
+	goodSHA := hex.EncodeToString(sum[:])
+	badSHA := strings.Repeat("0", 64)
+
+	var tests = []struct {
+		name           string
+		metadataSHA    string
+		manifestSHA    string
+		forceDownload  bool
+		expectedReads  int
+		expectedCopied bool
+		expectedErr    string
+	}{
+		{
+			name:           "trusted metadata",
+			metadataSHA:    goodSHA,
+			manifestSHA:    goodSHA,
+			expectedReads:  0,
+			expectedCopied: true,
+		},
+		{
+			name:          "metadata does not match manifest",
+			metadataSHA:   badSHA,
+			manifestSHA:   goodSHA,
+			expectedReads: 0,
+			expectedErr:   "sha256 metadata did not match",
+		},
+		{
+			name:           "no metadata",
+			manifestSHA:    goodSHA,
+			expectedReads:  1,
+			expectedCopied: true,
+		},
+		{
+			name:          "no metadata, content does not match manifest",
+			manifestSHA:   badSHA,
+			expectedReads: 1,
+			expectedErr:   "sha256 did not match",
+		},
+		{
+			// The metadata lies, but we check the content anyway.
+			name:          "forced download",
+			metadataSHA:   badSHA,
+			manifestSHA:   badSHA,
+			forceDownload: true,
+			expectedReads: 1,
+			expectedErr:   "sha256 did not match",
+		},
+	}
+
+	for _, test := range tests {
+		src := &memSyncFilestore{files: map[string][]byte{"file": content}}
+		dest1 := &memSyncFilestore{files: map[string][]byte{}}
+		dest2 := &memSyncFilestore{files: map[string][]byte{}}
+
+		op := &copyFileOp{
+			Source: &syncFileInfo{
+				RelativePath: "file",
+				AbsolutePath: "mem://file",
+				SHA256:       test.metadataSHA,
+				filestore:    src,
+			},
+			Dests: []*syncFileInfo{
+				{RelativePath: "file", filestore: dest1},
+				{RelativePath: "file", filestore: dest2},
+			},
+			ManifestFile:              &api.File{Name: "file", SHA256: test.manifestSHA},
+			ForceDownloadVerification: test.forceDownload,
+		}
+		if !op.canCopyServerSide() {
+			t.Fatalf("%s: expected server-side copy to be possible", test.name)
+		}
+
+		err := op.Run(ctx)
+		if test.expectedErr == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if test.expectedErr != "" &&
+			(err == nil || !strings.Contains(err.Error(), test.expectedErr)) {
+			t.Errorf("%s: expected error %q, got %v",
+				test.name, test.expectedErr, err)
+		}
+		if src.reads != test.expectedReads {
+			t.Errorf("%s: expected %d reads of the source, got %d",
+				test.name, test.expectedReads, src.reads)
+		}
+		for _, dest := range []*memSyncFilestore{dest1, dest2} {
+			_, copied := dest.files["file"]
+			if copied != test.expectedCopied {
+				t.Errorf("%s: expected copied=%v, got %v",
+					test.name, test.expectedCopied, copied)
+			}
+		}
+	}
+
+	// The generation that was listed is checked and copied, even if the file
+	// has been replaced since.
+	src := &memSyncFilestore{
+		files: map[string][]byte{"file": []byte("replaced")},
+		generations: map[string]map[int64][]byte{
+			"file": {1: content},
+		},
+	}
+	dest := &memSyncFilestore{files: map[string][]byte{}}
+	op := &copyFileOp{
+		Source: &syncFileInfo{
+			RelativePath: "file",
+			AbsolutePath: "mem://file",
+			Generation:   1,
+			filestore:    src,
+		},
+		Dests:        []*syncFileInfo{{RelativePath: "file", filestore: dest}},
+		ManifestFile: &api.File{Name: "file", SHA256: goodSHA},
+	}
+	if err := op.Run(ctx); err != nil {
+		t.Errorf("listed generation: unexpected error: %v", err)
+	}
+	if !bytes.Equal(dest.files["file"], content) {
+		t.Errorf("listed generation: copied %q", dest.files["file"])
+	}
+
+	// Server-side copies are not possible across different backends.
+	op = &copyFileOp{
+		Source: &syncFileInfo{filestore: &memSyncFilestore{}},
+		Dests: []*syncFileInfo{
+			{filestore: &memSyncFilestore{}},
+			{filestore: &localSyncFilestore{}},
+		},
+	}
+	if op.canCopyServerSide() {
+		t.Errorf("expected server-side copy to be impossible")
+	}
+}
+
+// nolint[funlen]
+func TestSidecarsAndMetadata(t *testing.T) {
+	ctx := context.Background()
+
+	content := []byte("hello world")
+	sum256 := sha256.Sum256(content)
+	sha256Hex := hex.EncodeToString(sum256[:])
+	sum512 := sha512.Sum512(content)
+	sha512Hex := hex.EncodeToString(sum512[:])
+
+	src := &memSyncFilestore{files: map[string][]byte{"file": content}}
+	src.setMetadata("file", map[string]string{sha256MetadataKey: sha256Hex})
+	dest1 := &memSyncFilestore{files: map[string][]byte{}}
+	dest2 := &memSyncFilestore{files: map[string][]byte{}}
+
+	p := &FilestorePromoter{
+		Source: &api.Filestore{Base: "mem://src"},
+		Dests: []*api.Filestore{
+			{Base: "mem://dest1", Sidecars: []string{"sha256"}},
+			{Base: "mem://dest2", Sidecars: []string{"sha256", "sha512"}},
+		},
+		Files:           []api.File{{Name: "file", SHA256: sha256Hex}},
+		PromoterVersion: "v1.2.3",
+	}
+	destFilestores := []syncFilestore{dest1, dest2}
+
+	buildOps := func() []SyncFileOp {
+		source, err := src.ListFiles(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dests []map[string]*syncFileInfo
+		for _, dest := range destFilestores {
+			listing, err := dest.ListFiles(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dests = append(dests, listing)
+		}
+		ops, err := p.computeNeededOperations(source, dests, destFilestores)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ops
+	}
+
+	ops := buildOps()
+	if len(ops) != 1 {
+		t.Fatalf("expected 1 operation, got %d", len(ops))
+	}
+	if err := ops[0].Run(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The source must be downloaded once, for the sha512.
+	if src.reads != 1 {
+		t.Errorf("expected 1 read of the source, got %d", src.reads)
+	}
+
+	expectedMetadata := map[string]string{
+		sha256MetadataKey:          sha256Hex,
+		sourceMetadataKey:          "mem://file",
+		promoterVersionMetadataKey: "v1.2.3",
+	}
+	expectedFiles := []map[string]string{
+		{"file": string(content), "file.sha256": sha256Hex},
+		{
+			"file":        string(content),
+			"file.sha256": sha256Hex,
+			"file.sha512": sha512Hex,
+		},
+	}
+	for i, dest := range []*memSyncFilestore{dest1, dest2} {
+		if len(dest.files) != len(expectedFiles[i]) {
+			t.Errorf("dest%d: expected files %v, got %v",
+				i+1, expectedFiles[i], dest.files)
+		}
+		for name, want := range expectedFiles[i] {
+			if got := string(dest.files[name]); got != want {
+				t.Errorf("dest%d: %q has content %q, want %q",
+					i+1, name, got, want)
+			}
+		}
+		if !reflect.DeepEqual(dest.metadata["file"], expectedMetadata) {
+			t.Errorf("dest%d: got metadata %v, want %v",
+				i+1, dest.metadata["file"], expectedMetadata)
+		}
+	}
+
+	// Everything is up to date now.
+	if ops := buildOps(); len(ops) != 0 {
+		t.Errorf("expected no operations, got %v", ops)
+	}
+
+	// A missing sidecar is written on its own, without copying the file.
+	delete(dest2.files, "file.sha512")
+	ops = buildOps()
+	expected := `WRITE "mem://file.sha512"`
+	if len(ops) != 1 || fmt.Sprintf("%v", ops[0]) != expected {
+		t.Fatalf("expected %s, got %v", expected, ops)
+	}
+
+	// A destination file with a different sha256 is copied, even though its
+	// MD5 and size match the source (dest2 still misses its sidecar).
+	dest1.setMetadata("file", map[string]string{
+		sha256MetadataKey: strings.Repeat("0", 64),
+	})
+	ops = buildOps()
+	if len(ops) != 2 || len(ops[0].(*copyFileOp).Dests) != 1 ||
+		fmt.Sprintf("%v", ops[1]) != expected {
+		t.Fatalf("expected 1 copy to dest1 and %s, got %v", expected, ops)
+	}
+
+	// The sidecar is computed from the destination file, which is verified,
+	// and the source is not read again.
+	reads := src.reads
+	if err := ops[1].Run(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := string(dest2.files["file.sha512"]); got != sha512Hex {
+		t.Errorf("file.sha512 has content %q, want %q", got, sha512Hex)
+	}
+	if src.reads != reads {
+		t.Errorf("the source was read to write a sidecar")
+	}
+
+	// Sidecars are written with the same preconditions as files: a sidecar
+	// that appeared since it was listed as missing is not replaced.
+	delete(dest2.files, "file.sha512")
+	ops = buildOps()
+	dest2.files["file.sha512"] = []byte("written concurrently")
+	if err := ops[1].Run(ctx); err == nil {
+		t.Errorf("expected the sidecar not to be replaced")
+	}
+	if got := string(dest2.files["file.sha512"]); got != "written concurrently" {
+		t.Errorf("file.sha512 was replaced with %q", got)
+	}
+}
+
+func TestComputeUnmanagedOperations(t *testing.T) {
+	dest := &memSyncFilestore{files: map[string][]byte{
+		"a":        nil,
+		"a.sha256": nil,
+		"a.sha512": nil,
+		"b":        nil,
+		"c/d":      nil,
+	}}
+	listing, err := dest.ListFiles(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &FilestorePromoter{
+		Dests: []*api.Filestore{
+			{Base: "mem://dest", Sidecars: []string{"sha256"}},
+		},
+		Files:        []api.File{{Name: "a"}},
+		MaxDeletions: 3,
+	}
+
+	var tests = []struct {
+		prune    bool
+		expected []string
+	}{
+		{
+			expected: []string{
+				`UNMANAGED "mem://a.sha512"`,
+				`UNMANAGED "mem://b"`,
+				`UNMANAGED "mem://c/d"`,
+			},
+		},
+		{
+			prune: true,
+			expected: []string{
+				`DELETE "mem://a.sha512"`,
+				`DELETE "mem://b"`,
+				`DELETE "mem://c/d"`,
+			},
+		},
+	}
+	for _, test := range tests {
+		p.Prune = test.prune
+		ops, err := p.computeUnmanagedOperations(
+			[]map[string]*syncFileInfo{listing})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var actual []string
+		for _, op := range ops {
+			actual = append(actual, fmt.Sprintf("%v", op))
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("prune=%v: got %v, want %v",
+				test.prune, actual, test.expected)
+		}
+	}
+
+	p.MaxDeletions = 2
+	_, err = p.computeUnmanagedOperations([]map[string]*syncFileInfo{listing})
+	if err == nil || !strings.Contains(err.Error(), "refusing to delete 3") {
+		t.Errorf("expected the deletion cap to be enforced, got %v", err)
+	}
+}
+
+func TestImmutableFilestores(t *testing.T) {
+	ctx := context.Background()
+
+	content := []byte("hello world")
+	sum := sha256.Sum256(content)
+	sha := hex.EncodeToString(sum[:])
+
+	src := &memSyncFilestore{files: map[string][]byte{"file": content}}
+	source, err := src.ListFiles(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := &memSyncFilestore{files: map[string][]byte{"file": []byte("tampered")}}
+	listing, err := dest.ListFiles(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name           string
+		immutable      bool
+		allowOverwrite bool
+		expectedErr    string
+	}{
+		{
+			name: "mutable",
+		},
+		{
+			name:        "immutable",
+			immutable:   true,
+			expectedErr: "refusing to overwrite files in immutable filestores",
+		},
+		{
+			name:           "immutable, but overwrite allowed",
+			immutable:      true,
+			allowOverwrite: true,
+		},
+	}
+	for _, test := range tests {
+		p := &FilestorePromoter{
+			Source: &api.Filestore{Base: "mem://src"},
+			Dests: []*api.Filestore{
+				{Base: "mem://dest", Immutable: test.immutable},
+			},
+			Files:          []api.File{{Name: "file", SHA256: sha}},
+			AllowOverwrite: test.allowOverwrite,
+		}
+		ops, err := p.computeNeededOperations(
+			source,
+			[]map[string]*syncFileInfo{listing},
+			[]syncFilestore{dest})
+		if test.expectedErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+				t.Errorf("%s: expected error %q, got %v",
+					test.name, test.expectedErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if len(ops) != 1 {
+			t.Errorf("%s: expected 1 operation, got %v", test.name, ops)
+			continue
+		}
+
+		// The overwrite must only happen if the file was not replaced in
+		// the meantime.
+		op := ops[0].(*copyFileOp)
+		if cond := op.writeCondition(op.Dests[0]); cond.DoesNotExist {
+			t.Errorf("%s: unexpected write condition %+v", test.name, cond)
+		}
+	}
+}
+
+func TestWriteConditions(t *testing.T) {
+	ctx := context.Background()
+
+	tdir, err := ioutil.TempDir("", "promoter-conditions-")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tdir)
+
+	content := []byte("hello world")
+	sum := sha256.Sum256(content)
+	sha := hex.EncodeToString(sum[:])
+
+	src := &memSyncFilestore{files: map[string][]byte{"file": content}}
+	local, err := openFilestore(
+		ctx, &api.Filestore{Base: "file://" + tdir}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone else writes the file after it was listed as missing.
+	concurrent := []byte("written concurrently")
+	err = ioutil.WriteFile(filepath.Join(tdir, "file"), concurrent, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dest := range []syncFilestore{
+		local,
+		&memSyncFilestore{files: map[string][]byte{"file": concurrent}},
+	} {
+		op := &copyFileOp{
+			Source: &syncFileInfo{
+				RelativePath: "file",
+				AbsolutePath: "mem://file",
+				filestore:    src,
+			},
+			Dests: []*syncFileInfo{
+				{RelativePath: "file", filestore: dest},
+			},
+			ManifestFile: &api.File{Name: "file", SHA256: sha},
+		}
+		if err := op.Run(ctx); err == nil {
+			t.Errorf("expected %T to refuse to replace the file", dest)
+		}
+
+		in, err := dest.OpenReader(ctx, "file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(in)
+		_ = in.Close()
+		if err != nil || !bytes.Equal(b, concurrent) {
+			t.Errorf("%T: file was replaced with %q (err=%v)", dest, b, err)
+		}
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	s := &localSyncFilestore{
+		filestore: &api.Filestore{Base: "file:///root"},
+		root:      filepath.FromSlash("/root"),
+	}
+
+	var tests = []struct {
+		name     string
+		expected string
+	}{
+		{name: "foo", expected: "/root/foo"},
+		{name: "dir/foo", expected: "/root/dir/foo"},
+		{name: "dir/../foo", expected: "/root/foo"},
+		{name: "../foo"},
+		{name: "dir/../../root2/foo"},
+		{name: ".."},
+		{name: "."},
+	}
+	for _, test := range tests {
+		actual, err := s.localPath(test.name)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", test.name, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.name, err)
+		} else if actual != filepath.FromSlash(test.expected) {
+			t.Errorf("%q: got %q, want %q", test.name, actual, test.expected)
+		}
+	}
+}
+
+func TestReadVerified(t *testing.T) {
+	ctx := context.Background()
+
+	content := []byte("hello world")
+	sum := sha256.Sum256(content)
+	sha := hex.EncodeToString(sum[:])
+	s := &memSyncFilestore{files: map[string][]byte{"SHA256SUMS": content}}
+
+	// Hex digests are not case-sensitive.
+	for _, pin := range []string{sha, strings.ToUpper(sha)} {
+		b, err := readVerified(ctx, s, &api.File{Name: "SHA256SUMS", SHA256: pin})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", pin, err)
+		} else if !bytes.Equal(b, content) {
+			t.Errorf("%s: got %q, want %q", pin, b, content)
+		}
+	}
+
+	pin := strings.Repeat("0", 64)
+	_, err := readVerified(ctx, s, &api.File{Name: "SHA256SUMS", SHA256: pin})
+	if err == nil || !strings.Contains(err.Error(), "sha256 did not match") {
+		t.Errorf("expected a sha256 mismatch error, got %v", err)
+	}
+}
@@ -23,33 +23,107 @@ import (
 	"net/url"
 	"strings"
 
-	"cloud.google.com/go/storage"
-	"google.golang.org/api/option"
 	"k8s.io/klog"
 	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
 )
 
-// FilestorePromoter manages the promotion of files
+// FilestorePromoter manages the promotion of files from one Source Filestore
+// to any number of Dest Filestores.
 type FilestorePromoter struct {
 	Source *api.Filestore
-	Dest   *api.Filestore
+	Dests  []*api.Filestore
 
 	Files []api.File
 
 	// UseServiceAccount must be true, for service accounts to be used
 	// This gives some protection against a hostile manifest.
 	UseServiceAccount bool
+
+	// ForceDownloadVerification makes server-side copies download the source
+	// file to verify its SHA256, instead of trusting its SHA256 metadata.
+	ForceDownloadVerification bool
+
+	// PromoterVersion is recorded in the metadata of the uploaded files.
+	PromoterVersion string
+
+	// Prune deletes destination files that are not in the manifest (they are
+	// only reported otherwise), as long as there are at most MaxDeletions.
+	Prune        bool
+	MaxDeletions int
+
+	// AllowOverwrite allows replacing files in Immutable filestores whose
+	// content does not match the manifest.
+	AllowOverwrite bool
+
+	// ManagedElsewhere holds the absolute paths of destination files that
+	// are managed by other manifests (see ManagedPaths), which must not be
+	// reported as unmanaged (nor pruned).
+	ManagedElsewhere map[string]bool
 }
 
 type syncFilestore interface {
 	// OpenReader opens an io.ReadCloser for the specified file
 	OpenReader(ctx context.Context, name string) (io.ReadCloser, error)
 
-	// UploadFile uploads a local file to the specified destination
-	UploadFile(ctx context.Context, dest string, localFile string) error
+	// UploadFile uploads a local file to the specified destination, with the
+	// given custom metadata (if the filestore supports metadata), as long as
+	// cond holds
+	UploadFile(
+		ctx context.Context,
+		dest string,
+		localFile string,
+		metadata map[string]string,
+		cond writeCondition) error
 
 	// ListFiles returns all the file artifacts in the filestore, recursively.
 	ListFiles(ctx context.Context) (map[string]*syncFileInfo, error)
+
+	// DeleteFile deletes the specified file
+	DeleteFile(ctx context.Context, name string) error
+}
+
+// metadataFilestore is implemented by filestores whose listings do not include
+// the custom metadata of the files (such as S3). The metadata is then only
+// read for the files that are needed.
+type metadataFilestore interface {
+	// ReadMetadata fills in the hashes recorded in the custom metadata of
+	// the given (listed) files.
+	ReadMetadata(ctx context.Context, files []*syncFileInfo) error
+}
+
+// generationFilestore is implemented by filestores that keep the generations
+// of their files (such as GCS), so that the generation that was listed can
+// still be read after the file has been replaced.
+type generationFilestore interface {
+	// OpenGenerationReader opens an io.ReadCloser for the given generation
+	// of the specified file.
+	OpenGenerationReader(
+		ctx context.Context,
+		name string,
+		generation int64) (io.ReadCloser, error)
+}
+
+// openListedFile opens the file as it was listed: if the filestore supports
+// it, the listed generation is read rather than the latest one.
+func openListedFile(
+	ctx context.Context,
+	file *syncFileInfo) (io.ReadCloser, error) {
+	if s, ok := file.filestore.(generationFilestore); ok &&
+		file.Generation != 0 {
+		return s.OpenGenerationReader(ctx, file.RelativePath, file.Generation)
+	}
+	return file.filestore.OpenReader(ctx, file.RelativePath)
+}
+
+// writeCondition is a precondition for writing a file, which protects against
+// concurrent writers. The zero value means that there is no precondition.
+// Filestores ignore the conditions that they cannot enforce.
+type writeCondition struct {
+	// DoesNotExist requires that the file does not exist.
+	DoesNotExist bool
+	// GenerationMatch (if non-zero) requires that the file still has the
+	// generation that was listed, i.e. that nobody else has replaced it since.
+	GenerationMatch int64
 }
 
 func openFilestore(
@@ -63,48 +137,32 @@ func openFilestore(
 			filestore.Base, err)
 	}
 
-	if u.Scheme != "gs" {
+	switch u.Scheme {
+	case "gs":
+		return openGCSFilestore(ctx, filestore, u, useServiceAccount)
+	case "s3":
+		return openS3Filestore(filestore, u, useServiceAccount)
+	case "file":
+		return openLocalFilestore(filestore, u)
+	default:
 		return nil, fmt.Errorf(
-			"unrecognized scheme %q (supported schemes: gs://)",
+			"unrecognized scheme %q (supported schemes: gs://, s3://, file://)",
 			filestore.Base)
 	}
-
-	var opts []option.ClientOption
-	if useServiceAccount && filestore.ServiceAccount != "" {
-		ts := &gcloudTokenSource{ServiceAccount: filestore.ServiceAccount}
-		opts = append(opts, option.WithTokenSource(ts))
-	} else {
-		opts = append(opts, option.WithoutAuthentication())
-	}
-
-	client, err := storage.NewClient(ctx, opts...)
-	if err != nil {
-		return nil, fmt.Errorf("error building GCS client: %v", err)
-	}
-
-	prefix := strings.TrimPrefix(u.Path, "/")
-	if prefix != "" && !strings.HasSuffix(prefix, "/") {
-		prefix += "/"
-	}
-
-	bucket := u.Host
-
-	s := &gcsSyncFilestore{
-		filestore: filestore,
-		client:    client,
-		bucket:    bucket,
-		prefix:    prefix,
-	}
-	return s, nil
 }
 
-// computeNeededOperations determines the list of files that need to be copied
-// nolint[funlen]
+// computeNeededOperations determines the list of files that need to be copied.
+// dests and destFilestores are the listings and filestores of p.Dests (in the
+// same order). Each file gets a single operation, which copies it to all of
+// the destinations that need it.
 func (p *FilestorePromoter) computeNeededOperations(
-	source, dest map[string]*syncFileInfo,
-	destFilestore syncFilestore) ([]SyncFileOp, error) {
+	source map[string]*syncFileInfo,
+	dests []map[string]*syncFileInfo,
+	destFilestores []syncFilestore) ([]SyncFileOp, error) {
 	// nolint[prealloc]
 	var ops []SyncFileOp
+	var sidecarOps []SyncFileOp
+	var conflicts []string
 
 	for i := range p.Files {
 		f := &p.Files[i]
@@ -118,53 +176,148 @@ func (p *FilestorePromoter) computeNeededOperations(
 				relativePath, absolutePath)
 		}
 
-		destFile := dest[relativePath]
-		if destFile == nil {
-			destFile = &syncFileInfo{}
-			destFile.RelativePath = sourceFile.RelativePath
-			destFile.AbsolutePath = joinFilepath(
-				p.Dest,
-				sourceFile.RelativePath)
-			destFile.filestore = destFilestore
-			ops = append(ops, &copyFileOp{
-				Source:       sourceFile,
-				Dest:         destFile,
-				ManifestFile: f,
-			})
-			continue
+		op := &copyFileOp{
+			Source:                    sourceFile,
+			ManifestFile:              f,
+			ForceDownloadVerification: p.ForceDownloadVerification,
+			PromoterVersion:           p.PromoterVersion,
+		}
+		for j, dest := range dests {
+			destFile := dest[relativePath]
+			if destFile == nil {
+				destFile = &syncFileInfo{}
+				destFile.RelativePath = sourceFile.RelativePath
+				destFile.AbsolutePath = joinFilepath(
+					p.Dests[j],
+					sourceFile.RelativePath)
+				destFile.filestore = destFilestores[j]
+				destFile.listedSidecars = listSidecars(
+					dest, destFile, p.Dests[j].Sidecars)
+			} else {
+				destFile.listedSidecars = listSidecars(
+					dest, destFile, p.Dests[j].Sidecars)
+				changed := needsCopy(sourceFile, destFile, f.SHA256)
+				if !changed {
+					missing := missingSidecars(destFile, p.Dests[j].Sidecars)
+					if len(missing) == 0 {
+						klog.V(2).Infof(
+							"metadata match for %q", destFile.AbsolutePath)
+						continue
+					}
+					// Only the sidecars need to be written.
+					destFile.sidecars = missing
+					sidecarOps = append(sidecarOps, &sidecarFileOp{
+						Dest:            destFile,
+						ManifestFile:    f,
+						Source:          sourceFile,
+						PromoterVersion: p.PromoterVersion,
+					})
+					continue
+				}
+				if p.Dests[j].Immutable && !p.AllowOverwrite {
+					conflicts = append(conflicts, destFile.AbsolutePath)
+					continue
+				}
+				destFile.exists = true
+			}
+			destFile.sidecars = p.Dests[j].Sidecars
+			op.Dests = append(op.Dests, destFile)
 		}
 
-		changed := false
-		if destFile.MD5 != sourceFile.MD5 {
-			klog.Warningf("MD5 mismatch on source %q vs dest %q: %q vs %q",
-				sourceFile.AbsolutePath,
-				destFile.AbsolutePath,
-				sourceFile.MD5,
-				destFile.MD5)
-			changed = true
+		if len(op.Dests) != 0 {
+			ops = append(ops, op)
 		}
+	}
+
+	if len(conflicts) != 0 {
+		return nil, fmt.Errorf(
+			"refusing to overwrite files in immutable filestores, as their"+
+				" content may not match the manifest: %s",
+			strings.Join(conflicts, ", "))
+	}
 
-		if destFile.Size != sourceFile.Size {
-			klog.Warningf("Size mismatch on source %q vs dest %q: %d vs %d",
-				sourceFile.AbsolutePath,
+	unmanagedOps, err := p.computeUnmanagedOperations(dests)
+	if err != nil {
+		return nil, err
+	}
+
+	ops = append(ops, sidecarOps...)
+	return append(ops, unmanagedOps...), nil
+}
+
+// needsCopy compares the metadata of a file that exists in both the source and
+// a destination, and reports whether it needs to be copied (again).
+//
+// If the destination file has SHA256 metadata, that is compared with the
+// SHA256 in the manifest; this works across filestores that compute MD5s
+// differently (or not at all). Otherwise, the MD5s and sizes are compared.
+func needsCopy(sourceFile, destFile *syncFileInfo, sha256 string) bool {
+	if destFile.SHA256 != "" {
+		if destFile.SHA256 != sha256 {
+			klog.Warningf("SHA256 mismatch on dest %q: %q vs %q",
 				destFile.AbsolutePath,
-				sourceFile.Size,
-				destFile.Size)
-			changed = true
+				sha256,
+				destFile.SHA256)
+			return true
 		}
+		return false
+	}
 
-		if !changed {
-			klog.V(2).Infof("metadata match for %q", destFile.AbsolutePath)
-			continue
+	changed := false
+	if destFile.MD5 == "" || sourceFile.MD5 == "" {
+		// We can't tell whether the content is the same (e.g., for
+		// multipart uploads to S3), so err on the side of copying.
+		klog.Warningf("MD5 not known for source %q or dest %q",
+			sourceFile.AbsolutePath,
+			destFile.AbsolutePath)
+		changed = true
+	} else if destFile.MD5 != sourceFile.MD5 {
+		klog.Warningf("MD5 mismatch on source %q vs dest %q: %q vs %q",
+			sourceFile.AbsolutePath,
+			destFile.AbsolutePath,
+			sourceFile.MD5,
+			destFile.MD5)
+		changed = true
+	}
+
+	if destFile.Size != sourceFile.Size {
+		klog.Warningf("Size mismatch on source %q vs dest %q: %d vs %d",
+			sourceFile.AbsolutePath,
+			destFile.AbsolutePath,
+			sourceFile.Size,
+			destFile.Size)
+		changed = true
+	}
+
+	return changed
+}
+
+// listSidecars returns the sidecars of destFile that are in the dest listing,
+// keyed by extension.
+func listSidecars(
+	dest map[string]*syncFileInfo,
+	destFile *syncFileInfo,
+	sidecars []string) map[string]*syncFileInfo {
+	listed := make(map[string]*syncFileInfo)
+	for _, sidecar := range sidecars {
+		if file := dest[destFile.RelativePath+"."+sidecar]; file != nil {
+			listed[sidecar] = file
 		}
-		ops = append(ops, &copyFileOp{
-			Source:       sourceFile,
-			Dest:         destFile,
-			ManifestFile: f,
-		})
 	}
+	return listed
+}
 
-	return ops, nil
+// missingSidecars returns the sidecars of destFile that were not listed.
+func missingSidecars(destFile *syncFileInfo, sidecars []string) []string {
+	var missing []string
+	for _, sidecar := range sidecars {
+		if destFile.listedSidecars[sidecar] == nil {
+			klog.Warningf("%s sidecar missing for %q",
+				sidecar, destFile.AbsolutePath)
+			missing = append(missing, sidecar)
+		}
+	}
+	return missing
 }
 
 func joinFilepath(filestore *api.Filestore, relativePath string) string {
@@ -175,27 +328,80 @@ func joinFilepath(filestore *api.Filestore, relativePath string) string {
 }
 
 // BuildOperations builds the required operations to sync from the
-// Source Filestore to the Dest Filestore
+// Source Filestore to all of the Dest Filestores
 func (p *FilestorePromoter) BuildOperations(
 	ctx context.Context) ([]SyncFileOp, error) {
 	sourceFilestore, err := openFilestore(ctx, p.Source, p.UseServiceAccount)
 	if err != nil {
 		return nil, err
 	}
-	destFilestore, err := openFilestore(ctx, p.Dest, p.UseServiceAccount)
+
+	sourceFiles, err := sourceFilestore.ListFiles(ctx)
 	if err != nil {
 		return nil, err
 	}
-
-	sourceFiles, err := sourceFilestore.ListFiles(ctx)
+	err = p.readMetadata(ctx, sourceFilestore, sourceFiles)
 	if err != nil {
 		return nil, err
 	}
 
-	destFiles, err := destFilestore.ListFiles(ctx)
+	destFiles, destFilestores, err := p.listDests(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	return p.computeNeededOperations(sourceFiles, destFiles, destFilestore)
+	return p.computeNeededOperations(sourceFiles, destFiles, destFilestores)
+}
+
+// listDests opens and lists all of the Dest Filestores, returning the listings
+// and the filestores in the same order as p.Dests.
+func (p *FilestorePromoter) listDests(
+	ctx context.Context) (
+	[]map[string]*syncFileInfo, []syncFilestore, error) {
+	destFilestores := make([]syncFilestore, 0, len(p.Dests))
+	destFiles := make([]map[string]*syncFileInfo, 0, len(p.Dests))
+	for _, dest := range p.Dests {
+		klog.Infof("processing destination %q", dest.Base)
+		destFilestore, err := openFilestore(ctx, dest, p.UseServiceAccount)
+		if err != nil {
+			return nil, nil, fmt.Errorf(
+				"error building promotion operations for %q: %v",
+				dest.Base, err)
+		}
+
+		files, err := destFilestore.ListFiles(ctx)
+		if err == nil {
+			err = p.readMetadata(ctx, destFilestore, files)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf(
+				"error building promotion operations for %q: %v",
+				dest.Base, err)
+		}
+
+		destFilestores = append(destFilestores, destFilestore)
+		destFiles = append(destFiles, files)
+	}
+
+	return destFiles, destFilestores, nil
+}
+
+// readMetadata reads the metadata of the listed files that the manifest
+// mentions, if the filestore does not list it (see metadataFilestore).
+func (p *FilestorePromoter) readMetadata(
+	ctx context.Context,
+	filestore syncFilestore,
+	listing map[string]*syncFileInfo) error {
+	s, ok := filestore.(metadataFilestore)
+	if !ok {
+		return nil
+	}
+
+	var files []*syncFileInfo
+	for i := range p.Files {
+		if file := listing[p.Files[i].Name]; file != nil {
+			files = append(files, file)
+		}
+	}
+	return s.ReadMetadata(ctx, files)
 }
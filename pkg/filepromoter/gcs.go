@@ -22,11 +22,13 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
+	"net/url"
 	"os"
 	"strings"
 
 	"cloud.google.com/go/storage"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 	"k8s.io/klog"
 	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
 )
@@ -38,6 +40,40 @@ type gcsSyncFilestore struct {
 	prefix    string
 }
 
+func openGCSFilestore(
+	ctx context.Context,
+	filestore *api.Filestore,
+	u *url.URL,
+	useServiceAccount bool) (syncFilestore, error) {
+	var opts []option.ClientOption
+	if useServiceAccount && filestore.ServiceAccount != "" {
+		ts := &gcloudTokenSource{ServiceAccount: filestore.ServiceAccount}
+		opts = append(opts, option.WithTokenSource(ts))
+	} else {
+		opts = append(opts, option.WithoutAuthentication())
+	}
+
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error building GCS client: %v", err)
+	}
+
+	prefix := strings.TrimPrefix(u.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	bucket := u.Host
+
+	s := &gcsSyncFilestore{
+		filestore: filestore,
+		client:    client,
+		bucket:    bucket,
+		prefix:    prefix,
+	}
+	return s, nil
+}
+
 // OpenReader opens an io.ReadCloser for the specified file
 func (s *gcsSyncFilestore) OpenReader(
 	ctx context.Context,
@@ -46,11 +82,29 @@ func (s *gcsSyncFilestore) OpenReader(
 	return s.client.Bucket(s.bucket).Object(absolutePath).NewReader(ctx)
 }
 
+// OpenGenerationReader implements generationFilestore.OpenGenerationReader
+func (s *gcsSyncFilestore) OpenGenerationReader(
+	ctx context.Context,
+	name string,
+	generation int64) (io.ReadCloser, error) {
+	absolutePath := s.prefix + name
+	obj := s.client.Bucket(s.bucket).Object(absolutePath)
+	return obj.Generation(generation).NewReader(ctx)
+}
+
+// DeleteFile deletes the specified file
+func (s *gcsSyncFilestore) DeleteFile(ctx context.Context, name string) error {
+	absolutePath := s.prefix + name
+	return s.client.Bucket(s.bucket).Object(absolutePath).Delete(ctx)
+}
+
 // UploadFile uploads a local file to the specified destination
 func (s *gcsSyncFilestore) UploadFile(
 	ctx context.Context,
 	dest string,
-	localFile string) error {
+	localFile string,
+	metadata map[string]string,
+	cond writeCondition) error {
 	absolutePath := s.prefix + dest
 
 	gcsURL := "gs://" + s.bucket + "/" + absolutePath
@@ -81,10 +135,11 @@ func (s *gcsSyncFilestore) UploadFile(
 
 	klog.Infof("uploading to %s", gcsURL)
 
-	w := s.client.Bucket(s.bucket).Object(absolutePath).NewWriter(ctx)
+	w := s.object(absolutePath, cond).NewWriter(ctx)
 
 	w.CRC32C = fileCRC32C
 	w.SendCRC32C = true
+	w.Metadata = metadata
 
 	// Much bigger chunk size for faster uploading
 	// nolint[gomnd]
@@ -105,6 +160,116 @@ func (s *gcsSyncFilestore) UploadFile(
 	return nil
 }
 
+// UploadStream implements streamingSyncFilestore.UploadStream.
+//
+// GCS only creates the object once the upload is finalized, which happens
+// when the writer is closed. If verification fails, we cancel the upload
+// instead, so the object is never created (or overwritten).
+func (s *gcsSyncFilestore) UploadStream(
+	ctx context.Context,
+	dest string,
+	in io.Reader,
+	metadata map[string]string,
+	cond writeCondition,
+	verify func() error) error {
+	absolutePath := s.prefix + dest
+
+	gcsURL := "gs://" + s.bucket + "/" + absolutePath
+
+	klog.Infof("streaming to %s", gcsURL)
+
+	uploadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := s.object(absolutePath, cond).NewWriter(uploadCtx)
+	w.Metadata = metadata
+
+	// Much bigger chunk size for faster uploading
+	// nolint[gomnd]
+	w.ChunkSize = 128 * 1024 * 1024
+
+	if _, err := io.Copy(w, in); err != nil {
+		cancel()
+		_ = w.Close()
+		return fmt.Errorf("error uploading to %q: %v", gcsURL, err)
+	}
+
+	if err := verify(); err != nil {
+		cancel()
+		_ = w.Close()
+		return fmt.Errorf("not committing upload to %q: %v", gcsURL, err)
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("error uploading to %q: %v", gcsURL, err)
+	}
+
+	return nil
+}
+
+// object returns a handle for the object at absolutePath, which enforces cond
+// on writes.
+func (s *gcsSyncFilestore) object(
+	absolutePath string,
+	cond writeCondition) *storage.ObjectHandle {
+	obj := s.client.Bucket(s.bucket).Object(absolutePath)
+	switch {
+	case cond.DoesNotExist:
+		return obj.If(storage.Conditions{DoesNotExist: true})
+	case cond.GenerationMatch != 0:
+		return obj.If(storage.Conditions{GenerationMatch: cond.GenerationMatch})
+	default:
+		return obj
+	}
+}
+
+// CanCopyFrom implements serverSideCopyFilestore.CanCopyFrom; GCS can rewrite
+// objects from any other GCS bucket.
+func (s *gcsSyncFilestore) CanCopyFrom(source syncFilestore) bool {
+	_, ok := source.(*gcsSyncFilestore)
+	return ok
+}
+
+// CopyFrom implements serverSideCopyFilestore.CopyFrom, using the GCS rewrite
+// API. The exact generation of the source object that was listed (and
+// verified) is copied, and the CRC32C of the copy is checked against it.
+func (s *gcsSyncFilestore) CopyFrom(
+	ctx context.Context,
+	source *syncFileInfo,
+	dest string,
+	metadata map[string]string,
+	cond writeCondition) error {
+	src := source.filestore.(*gcsSyncFilestore)
+	srcObj := s.client.Bucket(src.bucket).Object(src.prefix + source.RelativePath)
+	if source.Generation != 0 {
+		srcObj = srcObj.Generation(source.Generation)
+	}
+
+	absolutePath := s.prefix + dest
+	gcsURL := "gs://" + s.bucket + "/" + absolutePath
+
+	klog.Infof("rewriting %s to %s", source.AbsolutePath, gcsURL)
+
+	copier := s.object(absolutePath, cond).CopierFrom(srcObj)
+	// Setting any attributes replaces all of them, so carry over the content
+	// type of the source.
+	copier.ContentType = source.ContentType
+	copier.Metadata = metadata
+	attrs, err := copier.Run(ctx)
+	if err != nil {
+		return fmt.Errorf(
+			"error copying %q to %q: %v", source.AbsolutePath, gcsURL, err)
+	}
+
+	if source.CRC32C != 0 && attrs.CRC32C != source.CRC32C {
+		return fmt.Errorf(
+			"crc32c of %q did not match source %q after copy: %d vs %d",
+			gcsURL, source.AbsolutePath, attrs.CRC32C, source.CRC32C)
+	}
+
+	return nil
+}
+
 // ListFiles returns all the file artifacts in the filestore, recursively.
 func (s *gcsSyncFilestore) ListFiles(
 	ctx context.Context) (map[string]*syncFileInfo, error) {
@@ -133,12 +298,15 @@ func (s *gcsSyncFilestore) ListFiles(
 		file := &syncFileInfo{}
 		file.AbsolutePath = "gs://" + s.bucket + "/" + obj.Name
 		file.RelativePath = strings.TrimPrefix(name, s.prefix)
-		if obj.MD5 == nil {
-			return nil, fmt.Errorf("MD5 not set on file %q", file.AbsolutePath)
+		// Composite objects do not have an MD5.
+		if obj.MD5 != nil {
+			file.MD5 = hex.EncodeToString(obj.MD5)
 		}
-
-		file.MD5 = hex.EncodeToString(obj.MD5)
 		file.Size = obj.Size
+		file.SHA256 = obj.Metadata[sha256MetadataKey]
+		file.ContentType = obj.ContentType
+		file.CRC32C = obj.CRC32C
+		file.Generation = obj.Generation
 		file.filestore = s
 
 		files[file.RelativePath] = file
@@ -0,0 +1,157 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"k8s.io/klog"
+	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
+)
+
+// HashFilestore lists the files in the filestore, and computes their sha256
+// by reading them through the filestore (the sha256 metadata of a file is
+// not trusted, because anyone who can write to a staging filestore can set
+// it). Only the files for which include returns true are hashed; a nil
+// include hashes every file. Up to threads files are hashed concurrently.
+// The files are returned sorted by name.
+func HashFilestore(
+	ctx context.Context,
+	filestore *api.Filestore,
+	useServiceAccount bool,
+	include func(name string) bool,
+	threads int) ([]api.File, error) {
+	s, err := openFilestore(ctx, filestore, useServiceAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := listFileNames(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	// nolint[prealloc]
+	var files []api.File
+	for _, name := range names {
+		if include == nil || include(name) {
+			files = append(files, api.File{Name: name})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+
+	if threads < 1 {
+		threads = 1
+	}
+
+	// Each worker fills in the sha256 of the files it takes, in place, so
+	// the order does not depend on which files are hashed first.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var firstErr error
+	next := 0
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				mutex.Lock()
+				if next >= len(files) || firstErr != nil {
+					mutex.Unlock()
+					return
+				}
+				f := &files[next]
+				next++
+				mutex.Unlock()
+
+				sha256, err := hashFile(ctx, s, f.Name)
+				if err != nil {
+					mutex.Lock()
+					if firstErr == nil {
+						firstErr = fmt.Errorf(
+							"error hashing file %q: %v",
+							joinFilepath(filestore, f.Name), err)
+						cancel()
+					}
+					mutex.Unlock()
+					return
+				}
+				f.SHA256 = sha256
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	klog.Infof("hashed %d of %d files in %q",
+		len(files), len(names), filestore.Base)
+	return files, nil
+}
+
+// listFileNames returns the relative paths of the files in the filestore.
+// Local filestores are walked directly, because their ListFiles hashes the
+// files.
+func listFileNames(
+	ctx context.Context,
+	filestore syncFilestore) ([]string, error) {
+	if local, ok := filestore.(*localSyncFilestore); ok {
+		return local.listFileNames()
+	}
+
+	listing, err := filestore.ListFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(listing))
+	for name := range listing {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// hashFile returns the hex-encoded sha256 of the file, streaming its content
+// from the filestore.
+func hashFile(
+	ctx context.Context,
+	filestore syncFilestore,
+	name string) (string, error) {
+	in, err := filestore.OpenReader(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, in); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -16,9 +16,35 @@ limitations under the License.
 
 package filepromoter
 
-import "context"
+import (
+	"context"
+	"fmt"
+	"strings"
+)
 
 // SyncFileOp defines a synchronization operation
 type SyncFileOp interface {
 	Run(ctx context.Context) error
 }
+
+// keyedOp is implemented by the operations that can be told apart by the
+// files they act on (see OperationKey()).
+type keyedOp interface {
+	key() string
+}
+
+// OperationKey returns a key that identifies what op does, i.e. which files
+// (by filestore and name) it acts on and how. Operations with the same key
+// are duplicates: this happens when several manifests share a destination
+// filestore. Operations of other types than ours are never duplicates.
+func OperationKey(op SyncFileOp) string {
+	if o, ok := op.(keyedOp); ok {
+		return o.key()
+	}
+	return fmt.Sprintf("%T %p", op, op)
+}
+
+// opKey joins the parts of an operation key, which never contain newlines.
+func opKey(parts ...string) string {
+	return strings.Join(parts, "\n")
+}
@@ -0,0 +1,282 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"context"
+	"crypto/md5" // nolint[gosec]
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog"
+	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
+)
+
+// localTempFilePrefix is the prefix of the temporary files that are written
+// (and then renamed into place) by UploadFile. They are ignored by ListFiles.
+const localTempFilePrefix = ".promoter-"
+
+// localSyncFilestore is a syncFilestore backed by a directory on local disk.
+type localSyncFilestore struct {
+	filestore *api.Filestore
+	root      string
+}
+
+func openLocalFilestore(
+	filestore *api.Filestore,
+	u *url.URL) (syncFilestore, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, fmt.Errorf(
+			"file:// filestore %q must not have a host", filestore.Base)
+	}
+	if u.Path == "" {
+		return nil, fmt.Errorf(
+			"file:// filestore %q must have a path", filestore.Base)
+	}
+
+	s := &localSyncFilestore{
+		filestore: filestore,
+		root:      filepath.FromSlash(u.Path),
+	}
+	return s, nil
+}
+
+// localPath returns the path of the named file, which must be under the root
+// of the filestore.
+func (s *localSyncFilestore) localPath(name string) (string, error) {
+	p := filepath.Join(s.root, filepath.FromSlash(name))
+	rel, err := filepath.Rel(s.root, p)
+	if err != nil || rel == "." || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf(
+			"file %q is not under %q", name, s.filestore.Base)
+	}
+	return p, nil
+}
+
+// OpenReader opens an io.ReadCloser for the specified file
+func (s *localSyncFilestore) OpenReader(
+	ctx context.Context,
+	name string) (io.ReadCloser, error) {
+	p, err := s.localPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+// DeleteFile deletes the specified file
+func (s *localSyncFilestore) DeleteFile(
+	ctx context.Context,
+	name string) error {
+	p, err := s.localPath(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+// UploadFile uploads a local file to the specified destination. Local files
+// have no metadata, so metadata is ignored.
+func (s *localSyncFilestore) UploadFile(
+	ctx context.Context,
+	dest string,
+	localFile string,
+	metadata map[string]string,
+	cond writeCondition) error {
+	in, err := os.Open(localFile)
+	if err != nil {
+		return fmt.Errorf("error opening %q: %v", localFile, err)
+	}
+	defer func() {
+		if err := in.Close(); err != nil {
+			klog.Warningf("error closing %q: %v", localFile, err)
+		}
+	}()
+
+	return s.UploadStream(
+		ctx, dest, in, metadata, cond, func() error { return nil })
+}
+
+// UploadStream implements streamingSyncFilestore.UploadStream. The content is
+// first written to a temporary file in the destination directory, which is
+// renamed into place once verified, so that readers never see a partially
+// written (or unverified) file. metadata is ignored, and so is
+// cond.GenerationMatch (local files have no generations).
+func (s *localSyncFilestore) UploadStream(
+	ctx context.Context,
+	dest string,
+	in io.Reader,
+	metadata map[string]string,
+	cond writeCondition,
+	verify func() error) error {
+	destPath, err := s.localPath(dest)
+	if err != nil {
+		return err
+	}
+
+	klog.Infof("copying to %s", destPath)
+
+	// nolint[gomnd]
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return fmt.Errorf(
+			"error creating directory for %q: %v", destPath, err)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(destPath), localTempFilePrefix)
+	if err != nil {
+		return fmt.Errorf("error creating temp file: %v", err)
+	}
+	tempFilename := f.Name()
+
+	err = func() error {
+		if _, err := io.Copy(f, in); err != nil {
+			_ = f.Close()
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			_ = f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if err := verify(); err != nil {
+			return err
+		}
+		// ioutil.TempFile creates files that only the owner can read.
+		// nolint[gomnd]
+		if err := os.Chmod(tempFilename, 0644); err != nil {
+			return err
+		}
+		if cond.DoesNotExist {
+			// Unlike renaming, linking fails if destPath exists.
+			if err := os.Link(tempFilename, destPath); err != nil {
+				return err
+			}
+			return os.Remove(tempFilename)
+		}
+		return os.Rename(tempFilename, destPath)
+	}()
+	if err != nil {
+		if err := os.Remove(tempFilename); err != nil && !os.IsNotExist(err) {
+			klog.Warningf(
+				"unable to remove temp file %q: %v",
+				tempFilename, err)
+		}
+		return fmt.Errorf("error writing %q: %v", destPath, err)
+	}
+
+	return nil
+}
+
+// ListFiles returns all the file artifacts in the filestore, recursively. A
+// filestore whose directory does not exist yet is treated as empty.
+func (s *localSyncFilestore) ListFiles(
+	ctx context.Context) (map[string]*syncFileInfo, error) {
+	files := make(map[string]*syncFileInfo)
+
+	klog.Infof("listing files in directory %s", s.root)
+	err := s.walk(func(p, relativePath string, info os.FileInfo) error {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		// There is no metadata to read the hashes from, so compute them.
+		// nolint[gosec]
+		md5Hasher := md5.New()
+		sha256Hasher := sha256.New()
+		_, err = io.Copy(io.MultiWriter(md5Hasher, sha256Hasher), f)
+		_ = f.Close()
+		if err != nil {
+			return fmt.Errorf("error hashing file %q: %v", p, err)
+		}
+
+		file := &syncFileInfo{}
+		file.AbsolutePath = "file://" + filepath.ToSlash(p)
+		file.RelativePath = relativePath
+		file.MD5 = hex.EncodeToString(md5Hasher.Sum(nil))
+		file.SHA256 = hex.EncodeToString(sha256Hasher.Sum(nil))
+		file.Size = info.Size()
+		file.filestore = s
+
+		files[file.RelativePath] = file
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// listFileNames returns the relative paths of all the files in the filestore,
+// like ListFiles but without hashing them.
+func (s *localSyncFilestore) listFileNames() ([]string, error) {
+	var names []string
+
+	klog.Infof("listing files in directory %s", s.root)
+	err := s.walk(func(p, relativePath string, info os.FileInfo) error {
+		names = append(names, relativePath)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+// walk calls fn for each file in the filestore, with its local path and its
+// (slash-separated) path relative to the filestore base.
+func (s *localSyncFilestore) walk(
+	fn func(p, relativePath string, info os.FileInfo) error) error {
+	if _, err := os.Stat(s.root); os.IsNotExist(err) {
+		return nil
+	}
+
+	err := filepath.Walk(s.root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() ||
+			strings.HasPrefix(info.Name(), localTempFilePrefix) {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+
+		return fn(p, filepath.ToSlash(relativePath), info)
+	})
+	if err != nil {
+		return fmt.Errorf(
+			"error listing files in %q: %v",
+			s.filestore.Base, err)
+	}
+
+	return nil
+}
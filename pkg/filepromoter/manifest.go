@@ -20,7 +20,6 @@ import (
 	"context"
 	"fmt"
 
-	"k8s.io/klog"
 	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
 )
 
@@ -31,42 +30,80 @@ type ManifestPromoter struct {
 	// UseServiceAccount must be true, for service accounts to be used
 	// This gives some protection against a hostile manifest.
 	UseServiceAccount bool
+
+	// ForceDownloadVerification makes server-side copies download the source
+	// file to verify its SHA256, instead of trusting its SHA256 metadata.
+	ForceDownloadVerification bool
+
+	// PromoterVersion is recorded in the metadata of the uploaded files.
+	PromoterVersion string
+
+	// Prune deletes destination files that are not in the manifest (they are
+	// only reported otherwise), as long as there are at most MaxDeletions.
+	Prune        bool
+	MaxDeletions int
+
+	// AllowOverwrite allows replacing files in Immutable filestores whose
+	// content does not match the manifest.
+	AllowOverwrite bool
+
+	// ManagedElsewhere holds the absolute paths of destination files that
+	// are managed by other manifests (see ManagedPaths), which must not be
+	// reported as unmanaged (nor pruned).
+	ManagedElsewhere map[string]bool
 }
 
 // BuildOperations builds the required operations to sync from the
 // Source Filestore to all Dest Filestores in the manifest.
 func (p *ManifestPromoter) BuildOperations(
 	ctx context.Context) ([]SyncFileOp, error) {
+	fp, err := p.filestorePromoter()
+	if err != nil {
+		return nil, err
+	}
+	return fp.BuildOperations(ctx)
+}
+
+// BuildVerifyOperations builds the operations to verify the content of every
+// file in the manifest, in all Dest Filestores in the manifest.
+func (p *ManifestPromoter) BuildVerifyOperations(
+	ctx context.Context) ([]*VerifyFileOp, error) {
+	fp, err := p.filestorePromoter()
+	if err != nil {
+		return nil, err
+	}
+	return fp.BuildVerifyOperations(ctx)
+}
+
+// filestorePromoter returns the FilestorePromoter for the manifest.
+func (p *ManifestPromoter) filestorePromoter() (*FilestorePromoter, error) {
 	source, err := getSourceFilestore(p.Manifest)
 	if err != nil {
 		return nil, err
 	}
 
 	// nolint[prealloc]
-	var operations []SyncFileOp
-
+	var dests []*api.Filestore
 	for i := range p.Manifest.Filestores {
 		filestore := &p.Manifest.Filestores[i]
 		if filestore.Src {
 			continue
 		}
-		klog.Infof("processing destination %q", filestore.Base)
-		fp := &FilestorePromoter{
-			Source:            source,
-			Dest:              filestore,
-			Files:             p.Manifest.Files,
-			UseServiceAccount: p.UseServiceAccount,
-		}
-		ops, err := fp.BuildOperations(ctx)
-		if err != nil {
-			return nil, fmt.Errorf(
-				"error building promotion operations for %q: %v",
-				filestore.Base, err)
-		}
-		operations = append(operations, ops...)
+		dests = append(dests, filestore)
 	}
 
-	return operations, nil
+	return &FilestorePromoter{
+		Source:                    source,
+		Dests:                     dests,
+		Files:                     p.Manifest.Files,
+		UseServiceAccount:         p.UseServiceAccount,
+		ForceDownloadVerification: p.ForceDownloadVerification,
+		PromoterVersion:           p.PromoterVersion,
+		Prune:                     p.Prune,
+		MaxDeletions:              p.MaxDeletions,
+		AllowOverwrite:            p.AllowOverwrite,
+		ManagedElsewhere:          p.ManagedElsewhere,
+	}, nil
 }
 
 // getSourceFilestore returns the Filestore with the source attribute
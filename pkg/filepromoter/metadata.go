@@ -0,0 +1,245 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"k8s.io/klog"
+	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
+)
+
+// Custom object metadata keys, written on every upload (if the filestore
+// supports metadata). This lets consumers of the filestores verify files
+// without fetching the promoter manifests.
+const (
+	// sha256MetadataKey holds the (hex-encoded) SHA256 of the content, as
+	// given in the manifest.
+	sha256MetadataKey = "sha256"
+	// sourceMetadataKey holds the absolute path of the source file.
+	sourceMetadataKey = "source"
+	// promoterVersionMetadataKey holds the version of the promoter that
+	// copied the file.
+	promoterVersionMetadataKey = "promoter-version"
+)
+
+// Sidecar files hold the hex-encoded hash of the file they belong to. They are
+// named after the file, with the extension appended.
+const (
+	sidecarSHA256 = "sha256"
+	sidecarSHA512 = "sha512"
+)
+
+// metadata returns the custom metadata to set on the uploaded files.
+func (o *copyFileOp) metadata() map[string]string {
+	metadata := map[string]string{
+		sha256MetadataKey: o.ManifestFile.SHA256,
+		sourceMetadataKey: o.Source.AbsolutePath,
+	}
+	if o.PromoterVersion != "" {
+		metadata[promoterVersionMetadataKey] = o.PromoterVersion
+	}
+	return metadata
+}
+
+// needsSHA512 checks whether any destination wants a SHA512 sidecar file.
+func (o *copyFileOp) needsSHA512() bool {
+	for _, dest := range o.Dests {
+		for _, sidecar := range dest.sidecars {
+			if sidecar == sidecarSHA512 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// uploadSidecars writes the sidecar files of a destination file (copied from
+// source), given the hashes of the file (keyed by sidecar extension).
+func uploadSidecars(
+	ctx context.Context,
+	dest *syncFileInfo,
+	hashes map[string]string,
+	source *syncFileInfo,
+	promoterVersion string) error {
+	for _, sidecar := range dest.sidecars {
+		hash := hashes[sidecar]
+		if hash == "" {
+			return fmt.Errorf(
+				"%s of %q is not known", sidecar, source.AbsolutePath)
+		}
+		if err := uploadBytes(
+			ctx,
+			dest.filestore,
+			dest.RelativePath+"."+sidecar,
+			[]byte(hash),
+			sidecarMetadata(source, promoterVersion),
+			sidecarWriteCondition(dest, sidecar)); err != nil {
+			return fmt.Errorf(
+				"error writing %s sidecar of %q: %v",
+				sidecar, dest.AbsolutePath, err)
+		}
+	}
+	return nil
+}
+
+// sidecarWriteCondition returns the precondition for writing a sidecar of
+// dest, which is the same as for writing dest itself (see
+// copyFileOp.writeCondition()): either the sidecar must still not exist, or it
+// must not have changed since it was listed.
+func sidecarWriteCondition(
+	dest *syncFileInfo,
+	sidecar string) writeCondition {
+	listed := dest.listedSidecars[sidecar]
+	if listed == nil {
+		return writeCondition{DoesNotExist: true}
+	}
+	return writeCondition{GenerationMatch: listed.Generation}
+}
+
+// sidecarMetadata returns the custom metadata to set on sidecar files.
+func sidecarMetadata(
+	source *syncFileInfo,
+	promoterVersion string) map[string]string {
+	metadata := map[string]string{
+		sourceMetadataKey: source.AbsolutePath,
+	}
+	if promoterVersion != "" {
+		metadata[promoterVersionMetadataKey] = promoterVersion
+	}
+	return metadata
+}
+
+// sidecarFileOp writes the missing sidecars (Dest.sidecars) of a destination
+// file that is otherwise up to date.
+type sidecarFileOp struct {
+	Dest *syncFileInfo
+
+	// Source is only used for the metadata of the sidecars.
+	Source *syncFileInfo
+
+	ManifestFile *api.File
+
+	// PromoterVersion is recorded in the metadata of the sidecars.
+	PromoterVersion string
+}
+
+// Run implements SyncFileOp.Run. The SHA256 sidecar is written from the
+// manifest; if a SHA512 sidecar is needed, the destination file is downloaded
+// (and verified against the manifest) to compute it.
+func (o *sidecarFileOp) Run(ctx context.Context) error {
+	hashes := map[string]string{sidecarSHA256: o.ManifestFile.SHA256}
+	for _, sidecar := range o.Dest.sidecars {
+		if sidecar != sidecarSHA512 {
+			continue
+		}
+		sha256, sha512, err := downloadHashes(ctx, o.Dest)
+		if err != nil {
+			return err
+		}
+		if sha256 != o.ManifestFile.SHA256 {
+			return fmt.Errorf(
+				"sha256 did not match for file %q: actual=%q expected=%q",
+				o.Dest.AbsolutePath, sha256, o.ManifestFile.SHA256)
+		}
+		hashes[sidecarSHA512] = sha512
+	}
+
+	return uploadSidecars(ctx, o.Dest, hashes, o.Source, o.PromoterVersion)
+}
+
+// key implements keyedOp.key
+func (o *sidecarFileOp) key() string {
+	return opKey(append(
+		[]string{"sidecars", o.Dest.AbsolutePath}, o.Dest.sidecars...)...)
+}
+
+// String is the pretty-printer for an operation, as used by dry-run. Each
+// sidecar is shown on its own line.
+func (o *sidecarFileOp) String() string {
+	lines := make([]string, 0, len(o.Dest.sidecars))
+	for _, sidecar := range o.Dest.sidecars {
+		lines = append(lines, fmt.Sprintf(
+			"WRITE %q", o.Dest.AbsolutePath+"."+sidecar))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// uploadBytes uploads a small in-memory file, by way of a local temp file.
+func uploadBytes(
+	ctx context.Context,
+	filestore syncFilestore,
+	dest string,
+	b []byte,
+	metadata map[string]string,
+	cond writeCondition) error {
+	f, err := ioutil.TempFile("", "promoter")
+	if err != nil {
+		return fmt.Errorf("error creating temp file: %v", err)
+	}
+	tempFilename := f.Name()
+	defer func() {
+		if err := os.Remove(tempFilename); err != nil {
+			klog.Warningf(
+				"unable to remove temp file %q: %v",
+				tempFilename, err)
+		}
+	}()
+
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("error writing temp file %q: %v", tempFilename, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing temp file %q: %v", tempFilename, err)
+	}
+
+	return filestore.UploadFile(
+		ctx, dest, tempFilename, metadata, cond)
+}
+
+// computeSHA512ForFile returns the hex-encoded sha512 hash of the file named
+// filename
+func computeSHA512ForFile(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", fmt.Errorf(
+			"error re-opening temp file %q: %v",
+			filename, err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			klog.Warningf(
+				"error closing file %q: %v",
+				filename, err)
+		}
+	}()
+
+	hasher := sha512.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", fmt.Errorf("error hashing file %q: %v", filename, err)
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
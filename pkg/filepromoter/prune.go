@@ -0,0 +1,145 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"k8s.io/klog"
+	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
+)
+
+// unmanagedFileOp reports a destination file that is not referenced by the
+// manifest (nor is a sidecar of a file that is), and deletes it if Prune is
+// set.
+type unmanagedFileOp struct {
+	// Filestore is the destination filestore that Dest is in.
+	Filestore *api.Filestore
+	Dest      *syncFileInfo
+
+	Prune bool
+}
+
+// Run implements SyncFileOp.Run
+func (o *unmanagedFileOp) Run(ctx context.Context) error {
+	if !o.Prune {
+		return nil
+	}
+
+	klog.Infof("deleting unmanaged file %q", o.Dest.AbsolutePath)
+	err := o.Dest.filestore.DeleteFile(ctx, o.Dest.RelativePath)
+	if err != nil {
+		return fmt.Errorf("error deleting %q: %v", o.Dest.AbsolutePath, err)
+	}
+	return nil
+}
+
+// key implements keyedOp.key
+func (o *unmanagedFileOp) key() string {
+	return opKey("unmanaged", o.Filestore.Base, o.Dest.RelativePath)
+}
+
+func (o *unmanagedFileOp) String() string {
+	if o.Prune {
+		return fmt.Sprintf("DELETE %q", o.Dest.AbsolutePath)
+	}
+	return fmt.Sprintf("UNMANAGED %q", o.Dest.AbsolutePath)
+}
+
+// ManagedPaths returns the absolute paths of all the files (including
+// sidecars) that the manifest manages in its destination filestores.
+func ManagedPaths(manifest *api.Manifest) []string {
+	// nolint[prealloc]
+	var paths []string
+	for i := range manifest.Filestores {
+		filestore := &manifest.Filestores[i]
+		if filestore.Src {
+			continue
+		}
+		for _, f := range manifest.Files {
+			path := joinFilepath(filestore, f.Name)
+			paths = append(paths, path)
+			for _, sidecar := range filestore.Sidecars {
+				paths = append(paths, path+"."+sidecar)
+			}
+		}
+	}
+	return paths
+}
+
+// computeUnmanagedOperations returns an unmanagedFileOp for every file in the
+// dest listings that the manifest does not know about. If pruning, it fails
+// if more than p.MaxDeletions files would be deleted (see CheckDeletions()).
+func (p *FilestorePromoter) computeUnmanagedOperations(
+	dests []map[string]*syncFileInfo) ([]SyncFileOp, error) {
+	// nolint[prealloc]
+	var ops []SyncFileOp
+
+	for j, dest := range dests {
+		managed := make(map[string]bool)
+		for i := range p.Files {
+			name := p.Files[i].Name
+			managed[name] = true
+			for _, sidecar := range p.Dests[j].Sidecars {
+				managed[name+"."+sidecar] = true
+			}
+		}
+
+		var unmanaged []string
+		for name, file := range dest {
+			if !managed[name] && !p.ManagedElsewhere[file.AbsolutePath] {
+				unmanaged = append(unmanaged, name)
+			}
+		}
+		sort.Strings(unmanaged)
+
+		for _, name := range unmanaged {
+			ops = append(ops, &unmanagedFileOp{
+				Filestore: p.Dests[j],
+				Dest:      dest[name],
+				Prune:     p.Prune,
+			})
+		}
+	}
+
+	if err := CheckDeletions(ops, p.MaxDeletions); err != nil {
+		return nil, err
+	}
+
+	return ops, nil
+}
+
+// CheckDeletions fails if more than maxDeletions of the operations delete
+// files. Operations that are built separately (e.g., for several manifests)
+// must also be checked together, after removing the duplicates (see
+// OperationKey()).
+func CheckDeletions(ops []SyncFileOp, maxDeletions int) error {
+	deletions := 0
+	for _, op := range ops {
+		if o, ok := op.(*unmanagedFileOp); ok && o.Prune {
+			deletions++
+		}
+	}
+	if deletions > maxDeletions {
+		return fmt.Errorf(
+			"refusing to delete %d unmanaged files (the limit is %d)",
+			deletions, maxDeletions)
+	}
+	return nil
+}
@@ -0,0 +1,557 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5" // nolint[gosec]
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// defaultS3Region is used if the filestore does not specify a region.
+	defaultS3Region = "us-east-1"
+
+	// defaultS3PartSize is the size of the parts of a multipart upload. Files
+	// up to this size are uploaded with a single PUT.
+	// nolint[gomnd]
+	defaultS3PartSize = 64 * 1024 * 1024
+
+	// s3MD5Header is the user metadata in which we store the (hex-encoded) MD5
+	// of the content of every object we upload. The ETag of an object is only
+	// the MD5 of its content if it was not uploaded in multiple parts, so this
+	// lets us compare multipart uploads against other filestores.
+	s3MD5Header = "X-Amz-Meta-Md5"
+
+	// s3MetadataHeaderPrefix is the prefix of the headers that hold custom
+	// object metadata.
+	s3MetadataHeaderPrefix = "X-Amz-Meta-"
+)
+
+// s3SyncFilestore is a syncFilestore backed by an S3 (or S3-compatible)
+// bucket. It talks the S3 REST API directly, using path-style addressing.
+type s3SyncFilestore struct {
+	filestore *api.Filestore
+	client    *http.Client
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+
+	// signer is nil if requests are to be sent anonymously.
+	signer *awsSigner
+
+	partSize int64
+}
+
+func openS3Filestore(
+	filestore *api.Filestore,
+	u *url.URL,
+	useServiceAccount bool) (syncFilestore, error) {
+	region := filestore.Region
+	if region == "" {
+		region = defaultS3Region
+	}
+
+	endpoint := filestore.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"error parsing filestore endpoint %q: %v", endpoint, err)
+	}
+
+	var signer *awsSigner
+	if useServiceAccount {
+		credentials, err := loadAWSCredentials(filestore)
+		if err != nil {
+			return nil, err
+		}
+		if credentials != nil {
+			signer = &awsSigner{
+				credentials: *credentials,
+				region:      region,
+				service:     "s3",
+				now:         time.Now,
+			}
+		}
+	}
+
+	prefix := strings.TrimPrefix(u.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	s := &s3SyncFilestore{
+		filestore: filestore,
+		client:    &http.Client{},
+		endpoint:  endpointURL,
+		bucket:    u.Host,
+		prefix:    prefix,
+		signer:    signer,
+		partSize:  defaultS3PartSize,
+	}
+	return s, nil
+}
+
+// loadAWSCredentials reads the credentials from the filestore's
+// credentials-file, or else from the standard AWS environment variables. It
+// returns nil if no credentials are configured.
+func loadAWSCredentials(filestore *api.Filestore) (*awsCredentials, error) {
+	if filestore.CredentialsFile != "" {
+		b, err := ioutil.ReadFile(filestore.CredentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"error reading credentials file %q: %v",
+				filestore.CredentialsFile, err)
+		}
+		credentials := &awsCredentials{}
+		if err := yaml.Unmarshal(b, credentials); err != nil {
+			return nil, fmt.Errorf(
+				"error parsing credentials file %q: %v",
+				filestore.CredentialsFile, err)
+		}
+		if credentials.AccessKeyID == "" ||
+			credentials.SecretAccessKey == "" {
+			return nil, fmt.Errorf(
+				"credentials file %q must set accessKeyID and secretAccessKey",
+				filestore.CredentialsFile)
+		}
+		return credentials, nil
+	}
+
+	credentials := &awsCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if credentials.AccessKeyID == "" || credentials.SecretAccessKey == "" {
+		return nil, nil
+	}
+	return credentials, nil
+}
+
+// s3URL returns the s3:// URL of the object with the given key.
+func (s *s3SyncFilestore) s3URL(key string) string {
+	return "s3://" + s.bucket + "/" + key
+}
+
+// do sends a request for the given object key (or the bucket itself, if key
+// is empty). The caller must close the body of the returned response. Non-2xx
+// responses are turned into errors.
+func (s *s3SyncFilestore) do(
+	ctx context.Context,
+	method string,
+	key string,
+	query url.Values,
+	header http.Header,
+	body io.Reader,
+	contentLength int64) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = "/" + s.bucket
+	u.RawPath = "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+		u.RawPath += "/" + awsEscape(key, false)
+	}
+	u.RawQuery = canonicalQueryString(query)
+
+	if contentLength == 0 {
+		body = nil
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = contentLength
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	if s.signer != nil {
+		payloadHash := unsignedPayload
+		if body == nil {
+			payloadHash = emptyPayloadHash
+		}
+		s.signer.Sign(req, payloadHash)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	// nolint[gomnd]
+	if resp.StatusCode/100 != 2 {
+		// nolint[errcheck]
+		defer resp.Body.Close()
+		// nolint[gomnd]
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf(
+			"%s %s: unexpected status %q: %s",
+			method, s.s3URL(key), resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+// OpenReader opens an io.ReadCloser for the specified file
+func (s *s3SyncFilestore) OpenReader(
+	ctx context.Context,
+	name string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.prefix+name, nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// DeleteFile deletes the specified file
+func (s *s3SyncFilestore) DeleteFile(ctx context.Context, name string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.prefix+name, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// UploadFile uploads a local file to the specified destination
+func (s *s3SyncFilestore) UploadFile(
+	ctx context.Context,
+	dest string,
+	localFile string,
+	metadata map[string]string,
+	cond writeCondition) error {
+	key := s.prefix + dest
+
+	in, err := os.Open(localFile)
+	if err != nil {
+		return fmt.Errorf("error opening %q: %v", localFile, err)
+	}
+	defer func() {
+		if err := in.Close(); err != nil {
+			klog.Warningf("error closing %q: %v", localFile, err)
+		}
+	}()
+
+	stat, err := in.Stat()
+	if err != nil {
+		return fmt.Errorf("error getting size of %q: %v", localFile, err)
+	}
+	size := stat.Size()
+
+	// Compute the MD5 for upload integrity, and for later comparisons (see
+	// s3MD5Header).
+	fileMD5, err := computeMD5(io.NewSectionReader(in, 0, size))
+	if err != nil {
+		return fmt.Errorf("error computing md5 checksum: %v", err)
+	}
+
+	klog.Infof("uploading to %s", s.s3URL(key))
+
+	header := http.Header{}
+	for k, v := range metadata {
+		header.Set(s3MetadataHeaderPrefix+k, v)
+	}
+	header.Set(s3MD5Header, hex.EncodeToString(fileMD5))
+
+	// S3 objects have no generations, so only DoesNotExist is enforced.
+	completeHeader := http.Header{}
+	if cond.DoesNotExist {
+		completeHeader.Set("If-None-Match", "*")
+	}
+
+	if size <= s.partSize {
+		for k, v := range completeHeader {
+			header[k] = v
+		}
+		header.Set("Content-MD5", base64.StdEncoding.EncodeToString(fileMD5))
+		resp, err := s.do(ctx, http.MethodPut, key, nil, header,
+			io.NewSectionReader(in, 0, size), size)
+		if err != nil {
+			return fmt.Errorf("error uploading to %q: %v", s.s3URL(key), err)
+		}
+		return resp.Body.Close()
+	}
+
+	err = s.uploadMultipart(ctx, key, header, completeHeader, in, size)
+	if err != nil {
+		return fmt.Errorf("error uploading to %q: %v", s.s3URL(key), err)
+	}
+	return nil
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+// s3CompleteMultipartUploadResult is the response to a
+// CompleteMultipartUpload, which can be an <Error> even though the status is
+// 200 OK (the status is sent before the parts have been assembled).
+type s3CompleteMultipartUploadResult struct {
+	XMLName xml.Name
+	Code    string
+	Message string
+}
+
+// uploadMultipart uploads a file in parts of s.partSize bytes. If any part
+// fails, the whole upload is aborted so that no partial object is left
+// behind. header is sent when the upload is started, and completeHeader when
+// it is completed.
+func (s *s3SyncFilestore) uploadMultipart(
+	ctx context.Context,
+	key string,
+	header http.Header,
+	completeHeader http.Header,
+	in io.ReaderAt,
+	size int64) error {
+	resp, err := s.do(ctx, http.MethodPost, key,
+		url.Values{"uploads": {""}}, header, nil, 0)
+	if err != nil {
+		return err
+	}
+	var initiated s3InitiateMultipartUploadResult
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	_ = resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("error parsing multipart upload response: %v", err)
+	}
+	uploadID := initiated.UploadID
+
+	complete := s3CompleteMultipartUpload{}
+	err = func() error {
+		for offset := int64(0); offset < size; offset += s.partSize {
+			partSize := s.partSize
+			if offset+partSize > size {
+				partSize = size - offset
+			}
+			partNumber := len(complete.Parts) + 1
+
+			partMD5, err := computeMD5(io.NewSectionReader(in, offset, partSize))
+			if err != nil {
+				return err
+			}
+			partHeader := http.Header{}
+			partHeader.Set(
+				"Content-MD5", base64.StdEncoding.EncodeToString(partMD5))
+
+			resp, err := s.do(ctx, http.MethodPut, key,
+				url.Values{
+					"partNumber": {strconv.Itoa(partNumber)},
+					"uploadId":   {uploadID},
+				},
+				partHeader,
+				io.NewSectionReader(in, offset, partSize),
+				partSize)
+			if err != nil {
+				return err
+			}
+			_ = resp.Body.Close()
+
+			complete.Parts = append(complete.Parts, s3CompletedPart{
+				PartNumber: partNumber,
+				ETag:       resp.Header.Get("ETag"),
+			})
+		}
+
+		b, err := xml.Marshal(&complete)
+		if err != nil {
+			return err
+		}
+		resp, err := s.do(ctx, http.MethodPost, key,
+			url.Values{"uploadId": {uploadID}},
+			completeHeader,
+			bytes.NewReader(b),
+			int64(len(b)))
+		if err != nil {
+			return err
+		}
+		var result s3CompleteMultipartUploadResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		_ = resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf(
+				"error parsing complete multipart upload response: %v", err)
+		}
+		if result.XMLName.Local == "Error" {
+			return fmt.Errorf(
+				"error completing multipart upload: %s: %s",
+				result.Code, result.Message)
+		}
+		return nil
+	}()
+	if err != nil {
+		resp, abortErr := s.do(ctx, http.MethodDelete, key,
+			url.Values{"uploadId": {uploadID}}, nil, nil, 0)
+		if abortErr != nil {
+			klog.Warningf("error aborting multipart upload to %q: %v",
+				s.s3URL(key), abortErr)
+		} else {
+			_ = resp.Body.Close()
+		}
+		return err
+	}
+
+	return nil
+}
+
+type s3ListBucketResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key  string
+		ETag string
+		Size int64
+	}
+}
+
+// ListFiles returns all the file artifacts in the filestore, recursively.
+func (s *s3SyncFilestore) ListFiles(
+	ctx context.Context) (map[string]*syncFileInfo, error) {
+	files := make(map[string]*syncFileInfo)
+
+	klog.Infof("listing files in bucket %s with prefix %q", s.bucket, s.prefix)
+	continuationToken := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {s.prefix},
+		}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"error listing objects in %q: %v",
+				s.filestore.Base, err)
+		}
+		var result s3ListBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf(
+				"error parsing object listing of %q: %v",
+				s.filestore.Base, err)
+		}
+
+		for _, obj := range result.Contents {
+			name := obj.Key
+			if !strings.HasPrefix(name, s.prefix) {
+				return nil, fmt.Errorf(
+					"found object %q without prefix %q",
+					name, s.prefix)
+			}
+
+			file := &syncFileInfo{}
+			file.AbsolutePath = s.s3URL(name)
+			file.RelativePath = strings.TrimPrefix(name, s.prefix)
+			file.Size = obj.Size
+			file.filestore = s
+
+			file.MD5 = contentMD5(obj.ETag)
+
+			files[file.RelativePath] = file
+		}
+
+		if !result.IsTruncated {
+			break
+		}
+		continuationToken = result.NextContinuationToken
+	}
+
+	return files, nil
+}
+
+// contentMD5 returns the hex-encoded MD5 of the content of an object, given
+// its ETag, or the empty string if it is not known.
+//
+// The ETag of an object uploaded with a single PUT is the MD5 of its content.
+// For multipart uploads, it is the MD5 of the concatenated MD5s of the parts,
+// followed by "-" and the number of parts, which cannot be compared against
+// anything. For those, the MD5 can only be found in the object metadata (see
+// ReadMetadata()).
+func contentMD5(etag string) string {
+	etag = strings.Trim(etag, `"`)
+	if strings.Contains(etag, "-") {
+		return ""
+	}
+	return etag
+}
+
+// ReadMetadata reads the SHA256 metadata of the given files, and their MD5
+// metadata if it is not known from their ETag. Object listings do not include
+// metadata, so this takes a HEAD request per file.
+func (s *s3SyncFilestore) ReadMetadata(
+	ctx context.Context,
+	files []*syncFileInfo) error {
+	for _, file := range files {
+		key := s.prefix + file.RelativePath
+		resp, err := s.do(ctx, http.MethodHead, key, nil, nil, nil, 0)
+		if err != nil {
+			return fmt.Errorf(
+				"error reading metadata of %q: %v", s.s3URL(key), err)
+		}
+		_ = resp.Body.Close()
+
+		file.SHA256 = resp.Header.Get(
+			s3MetadataHeaderPrefix + sha256MetadataKey)
+		if file.MD5 == "" {
+			file.MD5 = resp.Header.Get(s3MD5Header)
+		}
+		if file.MD5 == "" && file.SHA256 == "" {
+			klog.Warningf(
+				"MD5 of multipart object %q is not known", file.AbsolutePath)
+		}
+	}
+	return nil
+}
+
+func computeMD5(in io.Reader) ([]byte, error) {
+	// nolint[gosec]
+	hasher := md5.New()
+	if _, err := io.Copy(hasher, in); err != nil {
+		return nil, err
+	}
+	return hasher.Sum(nil), nil
+}
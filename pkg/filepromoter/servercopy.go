@@ -0,0 +1,143 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// serverSideCopyFilestore is implemented by filestores that can copy objects
+// from another filestore without the content passing through the promoter.
+type serverSideCopyFilestore interface {
+	// CanCopyFrom checks whether files from source can be copied with
+	// CopyFrom.
+	CanCopyFrom(source syncFilestore) bool
+
+	// CopyFrom copies the source file to the specified destination (as long
+	// as cond holds), replacing its custom metadata with the given metadata.
+	CopyFrom(
+		ctx context.Context,
+		source *syncFileInfo,
+		dest string,
+		metadata map[string]string,
+		cond writeCondition) error
+}
+
+// canCopyServerSide checks whether all destinations of the operation can copy
+// the source file natively.
+func (o *copyFileOp) canCopyServerSide() bool {
+	for _, dest := range o.Dests {
+		s, ok := dest.filestore.(serverSideCopyFilestore)
+		if !ok || !s.CanCopyFrom(o.Source.filestore) {
+			return false
+		}
+	}
+	return true
+}
+
+// runServerSideCopy verifies the source file, and then copies it to all
+// destinations natively.
+//
+// If the source has SHA256 metadata, it is trusted (unless
+// ForceDownloadVerification is set, or a SHA512 sidecar has to be written),
+// and the file is not downloaded at all. Otherwise, the source is downloaded
+// once to compute its hashes (but is never uploaded by us).
+func (o *copyFileOp) runServerSideCopy(ctx context.Context) error {
+	hashes := map[string]string{sidecarSHA256: o.ManifestFile.SHA256}
+	if o.Source.SHA256 != "" && !o.ForceDownloadVerification &&
+		!o.needsSHA512() {
+		if o.Source.SHA256 != o.ManifestFile.SHA256 {
+			return fmt.Errorf(
+				"sha256 metadata did not match for file %q: actual=%q expected=%q",
+				o.Source.AbsolutePath, o.Source.SHA256, o.ManifestFile.SHA256)
+		}
+		klog.V(2).Infof("trusting sha256 metadata of %q", o.Source.AbsolutePath)
+	} else {
+		sha256, sha512, err := downloadHashes(ctx, o.Source)
+		if err != nil {
+			return err
+		}
+		if sha256 != o.ManifestFile.SHA256 {
+			return fmt.Errorf(
+				"sha256 did not match for file %q: actual=%q expected=%q",
+				o.Source.AbsolutePath, sha256, o.ManifestFile.SHA256)
+		}
+		hashes[sidecarSHA512] = sha512
+	}
+
+	// A failure to copy to one destination should not prevent us from
+	// copying to the others.
+	var errs []string
+	for _, dest := range o.Dests {
+		s := dest.filestore.(serverSideCopyFilestore)
+		err := s.CopyFrom(
+			ctx,
+			o.Source,
+			dest.RelativePath,
+			o.metadata(),
+			o.writeCondition(dest))
+		if err == nil {
+			err = uploadSidecars(
+				ctx, dest, hashes, o.Source, o.PromoterVersion)
+		}
+		if err != nil {
+			klog.Warningf("error copying to %q: %v", dest.AbsolutePath, err)
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf(
+			"error copying %q: %s",
+			o.Source.AbsolutePath, strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// downloadHashes downloads the file and returns its SHA256 and SHA512. The
+// listed generation of the file is read (where the filestore supports it),
+// which is the one that CopyFrom() copies.
+func downloadHashes(
+	ctx context.Context,
+	file *syncFileInfo) (string, string, error) {
+	in, err := openListedFile(ctx, file)
+	if err != nil {
+		return "", "", fmt.Errorf(
+			"error reading %q: %v", file.AbsolutePath, err)
+	}
+	defer in.Close()
+
+	sha256Hasher := sha256.New()
+	sha512Hasher := sha512.New()
+	_, err = io.Copy(io.MultiWriter(sha256Hasher, sha512Hasher), in)
+	if err != nil {
+		return "", "", fmt.Errorf(
+			"error downloading %s: %v",
+			file.AbsolutePath, err)
+	}
+	return hex.EncodeToString(sha256Hasher.Sum(nil)),
+		hex.EncodeToString(sha512Hasher.Sum(nil)),
+		nil
+}
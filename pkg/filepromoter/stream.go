@@ -0,0 +1,189 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"sync"
+
+	"k8s.io/klog"
+)
+
+// streamingSyncFilestore is implemented by filestores that can upload a file
+// while it is still being downloaded (and hashed), without going through a
+// local temp file.
+type streamingSyncFilestore interface {
+	// UploadStream uploads everything read from in to the specified
+	// destination, with the given custom metadata (as long as cond holds).
+	// Once in has been read to
+	// the end, verify must be called; the upload must only be committed
+	// (i.e., become visible at dest) if verify returns nil.
+	UploadStream(
+		ctx context.Context,
+		dest string,
+		in io.Reader,
+		metadata map[string]string,
+		cond writeCondition,
+		verify func() error) error
+}
+
+// canStream checks whether all destinations of the operation support
+// streaming uploads.
+func (o *copyFileOp) canStream() bool {
+	for _, dest := range o.Dests {
+		if _, ok := dest.filestore.(streamingSyncFilestore); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// sha256Result is the outcome of hashing a source file, shared by all the
+// destinations it is being streamed to.
+type sha256Result struct {
+	done chan struct{}
+	err  error
+}
+
+// wait blocks until the source has been read completely, and returns nil if
+// the SHA256 matched the manifest.
+func (r *sha256Result) wait() error {
+	<-r.done
+	return r.err
+}
+
+// dropOnErrorWriter forwards writes to w until the first error, after which it
+// silently discards everything. This prevents a failed destination from
+// interrupting the copy to the other destinations.
+type dropOnErrorWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (d *dropOnErrorWriter) Write(p []byte) (int, error) {
+	if d.err == nil {
+		_, d.err = d.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// runStreaming copies the file from the source to all destinations at once,
+// hashing it on the way. The destinations only commit the file once the
+// SHA256 has been found to match the manifest.
+func (o *copyFileOp) runStreaming(ctx context.Context) error {
+	in, err := o.Source.filestore.OpenReader(ctx, o.Source.RelativePath)
+	if err != nil {
+		return fmt.Errorf("error reading %q: %v", o.Source.AbsolutePath, err)
+	}
+	defer in.Close()
+
+	result := &sha256Result{done: make(chan struct{})}
+	hasher := sha256.New()
+	writers := []io.Writer{hasher}
+	var sha512Hasher hash.Hash
+	if o.needsSHA512() {
+		sha512Hasher = sha512.New()
+		writers = append(writers, sha512Hasher)
+	}
+	pipes := make([]*io.PipeWriter, 0, len(o.Dests))
+	errs := make([]error, len(o.Dests))
+
+	var wg sync.WaitGroup
+	for i, dest := range o.Dests {
+		pr, pw := io.Pipe()
+		pipes = append(pipes, pw)
+		writers = append(writers, &dropOnErrorWriter{w: pw})
+
+		wg.Add(1)
+		go func(i int, dest *syncFileInfo) {
+			defer wg.Done()
+
+			s := dest.filestore.(streamingSyncFilestore)
+			err := s.UploadStream(
+				ctx,
+				dest.RelativePath,
+				pr,
+				o.metadata(),
+				o.writeCondition(dest),
+				result.wait)
+			if err != nil {
+				klog.Warningf("error uploading to %q: %v", dest.AbsolutePath, err)
+				errs[i] = err
+			}
+			// Unblock the writer if the upload gave up early; if we have
+			// consumed everything already, this is a no-op.
+			_ = pr.CloseWithError(fmt.Errorf("upload to %q failed", dest.AbsolutePath))
+		}(i, dest)
+	}
+
+	if _, err := io.Copy(io.MultiWriter(writers...), in); err != nil {
+		result.err = fmt.Errorf(
+			"error downloading %s: %v",
+			o.Source.AbsolutePath, err)
+	} else {
+		sha256 := hex.EncodeToString(hasher.Sum(nil))
+		if sha256 != o.ManifestFile.SHA256 {
+			result.err = fmt.Errorf(
+				"sha256 did not match for file %q: actual=%q expected=%q",
+				o.Source.AbsolutePath, sha256, o.ManifestFile.SHA256)
+		}
+	}
+	close(result.done)
+
+	for _, pw := range pipes {
+		if result.err != nil {
+			_ = pw.CloseWithError(result.err)
+		} else {
+			_ = pw.Close()
+		}
+	}
+	wg.Wait()
+
+	if result.err != nil {
+		return result.err
+	}
+
+	hashes := map[string]string{sidecarSHA256: o.ManifestFile.SHA256}
+	if sha512Hasher != nil {
+		hashes[sidecarSHA512] = hex.EncodeToString(sha512Hasher.Sum(nil))
+	}
+
+	var msgs []string
+	for i, err := range errs {
+		if err == nil {
+			err = uploadSidecars(
+				ctx, o.Dests[i], hashes, o.Source, o.PromoterVersion)
+		}
+		if err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if len(msgs) != 0 {
+		return fmt.Errorf(
+			"error copying %q: %s",
+			o.Source.AbsolutePath, strings.Join(msgs, "; "))
+	}
+
+	return nil
+}
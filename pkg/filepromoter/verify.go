@@ -0,0 +1,138 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
+)
+
+// VerifyStatus is the outcome of verifying a single destination file.
+type VerifyStatus string
+
+// The possible outcomes of verifying a destination file.
+const (
+	VerifyOK       VerifyStatus = "ok"
+	VerifyMissing  VerifyStatus = "missing"
+	VerifyMismatch VerifyStatus = "mismatch"
+	VerifyError    VerifyStatus = "error"
+)
+
+// VerifyResult describes the outcome of verifying a single destination file.
+type VerifyResult struct {
+	// Name is the name of the file in the manifest.
+	Name string `json:"name"`
+	// Path is the absolute path of the file in the destination filestore.
+	Path   string       `json:"path"`
+	Status VerifyStatus `json:"status"`
+
+	ExpectedSHA256 string `json:"expected-sha256,omitempty"`
+	ActualSHA256   string `json:"actual-sha256,omitempty"`
+	// Error is set if the file could not be read.
+	Error string `json:"error,omitempty"`
+}
+
+// VerifyFileOp checks that a destination file exists and that its content
+// matches the SHA256 in the manifest. It implements SyncFileOp, but never
+// modifies anything; the outcome is recorded in Result.
+type VerifyFileOp struct {
+	Result VerifyResult
+
+	// dest is nil if the file is missing from the destination.
+	dest *syncFileInfo
+}
+
+// Run implements SyncFileOp.Run. The only errors returned are for
+// cancellation; problems with the file itself are recorded in o.Result.
+func (o *VerifyFileOp) Run(ctx context.Context) error {
+	if o.dest == nil {
+		o.Result.Status = VerifyMissing
+		return nil
+	}
+
+	in, err := o.dest.filestore.OpenReader(ctx, o.dest.RelativePath)
+	if err != nil {
+		o.Result.Status = VerifyError
+		o.Result.Error = err.Error()
+		return ctx.Err()
+	}
+	defer in.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, in); err != nil {
+		o.Result.Status = VerifyError
+		o.Result.Error = fmt.Sprintf("error reading file: %v", err)
+		return ctx.Err()
+	}
+
+	o.Result.ActualSHA256 = hex.EncodeToString(hasher.Sum(nil))
+	if o.Result.ActualSHA256 != o.Result.ExpectedSHA256 {
+		o.Result.Status = VerifyMismatch
+	} else {
+		o.Result.Status = VerifyOK
+	}
+	return nil
+}
+
+func (o *VerifyFileOp) String() string {
+	return fmt.Sprintf("VERIFY %q", o.Result.Path)
+}
+
+// BuildVerifyOperations lists the Dest Filestores, and builds an operation
+// for every file in the manifest in every destination, to check its content.
+func (p *FilestorePromoter) BuildVerifyOperations(
+	ctx context.Context) ([]*VerifyFileOp, error) {
+	destFiles, _, err := p.listDests(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.computeVerifyOperations(destFiles), nil
+}
+
+// computeVerifyOperations builds the operations to verify every file of the
+// manifest, given the listings of p.Dests (in the same order).
+func (p *FilestorePromoter) computeVerifyOperations(
+	dests []map[string]*syncFileInfo) []*VerifyFileOp {
+	ops := make([]*VerifyFileOp, 0, len(p.Files)*len(dests))
+	for i := range p.Files {
+		f := &p.Files[i]
+		for j, dest := range dests {
+			ops = append(ops, newVerifyFileOp(f, p.Dests[j], dest[f.Name]))
+		}
+	}
+	return ops
+}
+
+func newVerifyFileOp(
+	f *api.File,
+	filestore *api.Filestore,
+	dest *syncFileInfo) *VerifyFileOp {
+	return &VerifyFileOp{
+		Result: VerifyResult{
+			Name:           f.Name,
+			Path:           joinFilepath(filestore, f.Name),
+			ExpectedSHA256: f.SHA256,
+		},
+		dest: dest,
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+)
+
+// runRetain implements "cip retain [flags]", which deletes old digests from a
+// (staging) registry according to a RetentionPolicy. Nothing that the
+// promoter manifests reference is ever deleted.
+//
+// nolint[lll]
+func runRetain(args []string) {
+	fs := flag.NewFlagSet("retain", flag.ExitOnError)
+	klog.InitFlags(fs)
+
+	registry := fs.String(
+		"registry",
+		"",
+		"the registry to delete old digests from, e.g. gcr.io/k8s-staging-foo (REQUIRED)")
+	serviceAccount := fs.String(
+		"service-account",
+		"",
+		"service account to use for -registry")
+	var manifests, thinManifestDirs repeatedFlag
+	fs.Var(
+		&manifests,
+		"manifest",
+		"never delete the digests that this manifest promotes; can be repeated (at least one -manifest or -thin-manifest-dir is REQUIRED)")
+	fs.Var(
+		&thinManifestDirs,
+		"thin-manifest-dir",
+		"never delete the digests that the thin manifests in this directory promote; can be repeated")
+	keepTagged := fs.Int(
+		"keep-tagged",
+		0,
+		"keep the given number of tagged digests per image (the most recently uploaded ones), and delete the others along with their tags (default: 0, which never deletes tagged digests)")
+	untaggedMaxAgeDays := fs.Int(
+		"delete-untagged-after-days",
+		0,
+		"delete the untagged digests uploaded more than the given number of days ago (default: 0, which never deletes untagged digests)")
+	dryRun := fs.Bool(
+		"dry-run",
+		true,
+		"print what would have been deleted; do not actually modify the registry")
+	threads := fs.Int(
+		"threads",
+		10, "number of concurrent goroutines to use when talking to GCR")
+	useServiceAccount := fs.Bool(
+		"use-service-account",
+		false,
+		"pass '--account=...' to all gcloud calls (default: false)")
+
+	// The FlagSet exits on errors.
+	_ = fs.Parse(args)
+
+	if *registry == "" {
+		klog.Exitln("-registry is required")
+	}
+	if len(manifests) == 0 && len(thinManifestDirs) == 0 {
+		klog.Exitln("at least one -manifest or -thin-manifest-dir is required")
+	}
+	if *keepTagged < 0 || *untaggedMaxAgeDays < 0 {
+		klog.Exitln("-keep-tagged and -delete-untagged-after-days cannot be negative")
+	}
+	if *keepTagged == 0 && *untaggedMaxAgeDays == 0 {
+		klog.Exitln("at least one of -keep-tagged or -delete-untagged-after-days is required")
+	}
+
+	var mfests []reg.Manifest
+	for _, manifest := range manifests {
+		mfest, err := reg.ParseManifestFromFile(manifest)
+		if err != nil {
+			klog.Exitln(err)
+		}
+		mfests = append(mfests, mfest)
+	}
+	for _, thinManifestDir := range thinManifestDirs {
+		thinMfests, err := reg.ParseThinManifestsFromDir(thinManifestDir)
+		if err != nil {
+			klog.Exitln(err)
+		}
+		mfests = append(mfests, thinMfests...)
+	}
+
+	policy := reg.RetentionPolicy{
+		KeepTagged:     *keepTagged,
+		UntaggedMaxAge: time.Duration(*untaggedMaxAgeDays) * 24 * time.Hour,
+	}
+
+	rc := reg.RegistryContext{
+		Name:           reg.RegistryName(*registry),
+		ServiceAccount: *serviceAccount,
+	}
+	sc, err := reg.MakeSyncContext(
+		[]reg.Manifest{{Registries: []reg.RegistryContext{rc}}},
+		2,
+		*threads,
+		*dryRun,
+		*useServiceAccount)
+	if err != nil {
+		klog.Exitln(err)
+	}
+
+	sc.ReadRegistries(
+		[]reg.RegistryContext{rc},
+		true,
+		reg.MkReadRepositoryCmdReal)
+	// Deleting from a partial view of the registry could delete children of
+	// manifest lists that were not read, so refuse to.
+	if len(sc.InvIgnore) > 0 {
+		klog.Exitf(
+			"could not read all of %q (failed to read: %v)",
+			rc.Name, sc.InvIgnore)
+	}
+	sc.ReadGCRManifestLists(reg.MkReadManifestListCmdReal)
+	// The children of a manifest list that could not be read have no
+	// known parents, so they would be deleted even if the list is kept.
+	if len(sc.UnreadManifestLists) > 0 {
+		klog.Exitf(
+			"could not read all the manifest lists of %q (failed to read: %v)",
+			rc.Name, sc.UnreadManifestLists)
+	}
+
+	deletions := reg.SelectForRetention(
+		sc.Inv[rc.Name],
+		sc.DigestInfo[rc.Name],
+		sc.ManifestListParents[rc.Name],
+		reg.ReferencedDigests(mfests),
+		policy,
+		time.Now())
+	klog.Infof("%d digest(s) to delete from %s", len(deletions), rc.Name)
+
+	mkDeletionCmd := func(
+		dest reg.RegistryContext,
+		imageName reg.ImageName,
+		digest reg.Digest) stream.Producer {
+		var sp stream.Subprocess
+		sp.CmdInvocation = reg.GetDeleteCmd(
+			dest,
+			sc.UseServiceAccount,
+			imageName,
+			digest,
+			true)
+		return &sp
+	}
+	sc.ApplyRetention(rc, deletions, mkDeletionCmd, nil)
+
+	os.Exit(0)
+}
+
+// repeatedFlag is a flag.Value that collects the values of a flag that can be
+// given several times.
+type repeatedFlag []string
+
+func (f *repeatedFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+// Set implements flag.Value.Set.
+func (f *repeatedFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}